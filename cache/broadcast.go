@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	guuid "github.com/google/uuid"
+)
+
+const (
+	// OpDel 删除键
+	OpDel = "del"
+	// OpNamespace 命名空间 generation 加一
+	OpNamespace = "namespace"
+	// OpTags 按标签失效
+	OpTags = "tags"
+)
+
+// Invalidation 在实例之间广播的失效消息
+type Invalidation struct {
+	// 发出消息的实例，实例忽略自己发出的消息
+	Origin string `json:"origin"`
+	// 操作：del|namespace|tags
+	Op string `json:"op"`
+	// del 为键，namespace 为命名空间名称，tags 为标签
+	Keys []string `json:"keys"`
+	// 删除命名空间内的键时为命名空间名称，接收方用本地的 generation 重新生成键后删除
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Bus 失效消息的传输通道
+type Bus interface {
+	// Publish 发布一条消息
+	Publish(ctx context.Context, msg []byte) error
+	// Subscribe 持续接收消息直到 ctx 结束，断线后自动重新订阅
+	Subscribe(ctx context.Context, handle func(msg []byte)) error
+}
+
+// BroadcastCache 将本地缓存的失效操作广播给其他实例
+// Del、InvalidateTags 和命名空间失效在本地执行后发布消息，其他实例收到后对各自的本地缓存执行同样的操作。
+// 读写操作不广播，仍由过期时间保证最终一致。
+type BroadcastCache struct {
+	Cache
+	bus    Bus
+	id     string
+	logger *log.Logger
+}
+
+// NewBroadcastCache 包装本地缓存，需要调用 Start 接收其他实例的消息
+func NewBroadcastCache(local Cache, bus Bus, log *log.Logger) *BroadcastCache {
+	return &BroadcastCache{
+		Cache:  local,
+		bus:    bus,
+		id:     guuid.New().String(),
+		logger: log,
+	}
+}
+
+// ID 返回实例标识
+func (b *BroadcastCache) ID() string {
+	return b.id
+}
+
+// Start 在后台接收失效消息直到 ctx 结束
+func (b *BroadcastCache) Start(ctx context.Context) {
+	go func() {
+		err := b.bus.Subscribe(ctx, func(msg []byte) {
+			b.apply(ctx, msg)
+		})
+		if err != nil {
+			b.logger.Error(ctx, "cache broadcast", log.ErrorType("err", err))
+		}
+	}()
+}
+
+func (b *BroadcastCache) Del(ctx context.Context, key string) error {
+	err := b.Cache.Del(ctx, key)
+	b.publish(ctx, Invalidation{Op: OpDel, Keys: []string{key}})
+	return err
+}
+
+// DelNamespaced 删除命名空间 name 内的键并广播，由 NamespaceCache.Del 调用，key 为本实例实际写入的键
+// generation 保存在各实例本地时各实例的键不同，只广播 key 其他实例无法删除。
+func (b *BroadcastCache) DelNamespaced(ctx context.Context, name, key string) error {
+	err := b.Cache.Del(ctx, key)
+	b.publish(ctx, Invalidation{Op: OpDel, Keys: []string{key}, Namespace: name})
+	return err
+}
+
+func (b *BroadcastCache) SetWithTags(ctx context.Context, key string, value interface{}, expireSeconds int, tags ...string) error {
+	return SetWithTags(ctx, b.Cache, key, value, expireSeconds, tags...)
+}
+
+func (b *BroadcastCache) InvalidateTags(ctx context.Context, tags ...string) error {
+	err := InvalidateTags(ctx, b.Cache, tags...)
+	if err != nil {
+		return err
+	}
+
+	b.publish(ctx, Invalidation{Op: OpTags, Keys: tags})
+	return nil
+}
+
+// InvalidateNamespace 使本地命名空间失效并广播，由 NamespaceCache.InvalidateNamespace 调用
+func (b *BroadcastCache) InvalidateNamespace(ctx context.Context, name string) error {
+	err := bumpGeneration(ctx, b.Cache, name)
+	if err != nil {
+		return err
+	}
+
+	b.publish(ctx, Invalidation{Op: OpNamespace, Keys: []string{name}})
+	return nil
+}
+
+// publish 广播失败只记录日志，本地操作已经完成
+func (b *BroadcastCache) publish(ctx context.Context, inv Invalidation) {
+	inv.Origin = b.id
+	msg, err := json.Marshal(inv)
+	if err == nil {
+		err = b.bus.Publish(ctx, msg)
+	}
+	if err != nil {
+		b.logger.Error(ctx, "cache broadcast publish",
+			log.String("op", inv.Op),
+			log.Any("keys", inv.Keys),
+			log.ErrorType("err", err),
+		)
+	}
+}
+
+func (b *BroadcastCache) apply(ctx context.Context, msg []byte) {
+	var inv Invalidation
+	if err := json.Unmarshal(msg, &inv); err != nil {
+		b.logger.Warn(ctx, "cache broadcast decode", log.ByteString("msg", msg), log.ErrorType("err", err))
+		return
+	}
+	if inv.Origin == b.id {
+		return
+	}
+
+	var err error
+	switch inv.Op {
+	case OpDel:
+		for _, key := range inv.Keys {
+			// 本地没有该键属于正常情况
+			_ = b.Cache.Del(ctx, key)
+			if inv.Namespace != "" {
+				b.delLocalNamespaced(ctx, inv.Namespace, key)
+			}
+		}
+	case OpNamespace:
+		for _, name := range inv.Keys {
+			if e := bumpGeneration(ctx, b.Cache, name); e != nil {
+				err = e
+			}
+		}
+	case OpTags:
+		err = InvalidateTags(ctx, b.Cache, inv.Keys...)
+	default:
+		b.logger.Warn(ctx, "cache broadcast unknown op", log.String("op", inv.Op))
+		return
+	}
+	if err != nil {
+		b.logger.Error(ctx, "cache broadcast apply",
+			log.String("op", inv.Op),
+			log.Any("keys", inv.Keys),
+			log.ErrorType("err", err),
+		)
+	}
+}
+
+// delLocalNamespaced 将其他实例的键换成本地 generation 下的键后删除
+// 本地没有 generation 时本地也没有该命名空间的键；generation 共用时两者相同，已经删除。
+func (b *BroadcastCache) delLocalNamespaced(ctx context.Context, name, key string) {
+	prefix := namespacePrefix(name)
+	if !strings.HasPrefix(key, prefix) {
+		return
+	}
+	rest := key[len(prefix):]
+	i := strings.IndexByte(rest, ':')
+	if i < 0 {
+		return
+	}
+
+	val, err := b.Cache.Get(ctx, generationKey(name))
+	if err != nil {
+		return
+	}
+	gen, ok := val.(int64)
+	if !ok || strconv.FormatInt(gen, 10) == rest[:i] {
+		return
+	}
+	_ = b.Cache.Del(ctx, namespaceKey(name, gen, rest[i+1:]))
+}
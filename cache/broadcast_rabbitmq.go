@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	"git.zhwenxue.com/zhgo/gocontrib/mq/rabbitmq"
+	guuid "github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// 失效消息在队列中的存活时间，超过后没有意义
+	rabbitBusMessageExpire = time.Minute
+	// 断线重新消费的退避时间
+	rabbitBusMinBackoff = 100 * time.Millisecond
+	rabbitBusMaxBackoff = 5 * time.Second
+)
+
+// RabbitBus 基于 rabbitmq fanout 交换器的失效消息通道
+// 每个实例使用自己的临时队列绑定到同一个交换器
+type RabbitBus struct {
+	option rabbitmq.RMQOption
+	device string
+	logger *log.Logger
+
+	mu  sync.Mutex
+	pub *rabbitmq.RMQClient
+}
+
+// NewRabbitBus option 中的 Server 会被替换为名为 exchange 的 fanout 交换器
+// 每个实例的队列是独占、自动删除的，进程退出后不会在 rabbitmq 上残留
+func NewRabbitBus(option rabbitmq.RMQOption, exchange string, log *log.Logger) *RabbitBus {
+	option.Server = rabbitmq.Broker{
+		QuePrefix: exchange,
+		Transient: true,
+		Topics: []rabbitmq.Topic{{
+			ChanName:  exchange,
+			ChanType:  amqp.ExchangeFanout,
+			KeyPrefix: exchange,
+		}},
+	}
+	// 非 reliable 模式下 Publish 等不到确认，只能等待超时
+	option.Reliable = true
+
+	return &RabbitBus{
+		option: option,
+		device: guuid.New().String(),
+		logger: log,
+	}
+}
+
+func (b *RabbitBus) Publish(ctx context.Context, msg []byte) (err error) {
+	pub, err := b.publisher()
+	if err != nil {
+		return err
+	}
+
+	err = pub.Publish(b.exchange(), "", rabbitBusMessageExpire, msg)
+	if err != nil {
+		// 下次发布时重新连接
+		b.mu.Lock()
+		if b.pub == pub {
+			b.pub = nil
+		}
+		b.mu.Unlock()
+		_ = pub.Close()
+	}
+
+	return err
+}
+
+func (b *RabbitBus) Subscribe(ctx context.Context, handle func(msg []byte)) error {
+	wait := rabbitBusMinBackoff
+	for {
+		err := b.consume(ctx, handle, &wait)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		b.logger.Warn(ctx, "cache rabbit bus resubscribe",
+			log.String("exchange", b.exchange()),
+			log.ErrorType("err", err),
+		)
+		if !backoff(ctx, &wait) {
+			return nil
+		}
+	}
+}
+
+// consume 消费直到连接断开或 ctx 结束
+func (b *RabbitBus) consume(ctx context.Context, handle func(msg []byte), wait *time.Duration) (err error) {
+	// rabbitmq 包在连接失败时 panic
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rabbitmq consumer: %v", r)
+		}
+	}()
+
+	clt := rabbitmq.NewConsumer(ctx, b.option.Server, b.device, b.option, *b.logger)
+	if clt == nil {
+		return fmt.Errorf("rabbitmq consumer: init failed")
+	}
+
+	closed := make(chan struct{})
+	err = clt.Consume(ctx, func(deliveries <-chan amqp.Delivery, done chan error) {
+		for d := range deliveries {
+			handle(d.Body)
+			_ = d.Ack(false)
+		}
+		close(closed)
+		done <- nil
+	})
+	if err != nil {
+		return err
+	}
+	*wait = rabbitBusMinBackoff
+
+	select {
+	case <-closed:
+		err = fmt.Errorf("rabbitmq consumer: deliveries closed")
+	case <-ctx.Done():
+	}
+	_ = clt.Close()
+
+	return err
+}
+
+// publisher 生产者的生命周期与 RabbitBus 一致，不使用调用方的 ctx
+func (b *RabbitBus) publisher() (pub *rabbitmq.RMQClient, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pub != nil {
+		return b.pub, nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rabbitmq publisher: %v", r)
+		}
+	}()
+
+	pub = rabbitmq.NewPublisherClient(context.Background(), b.option, *b.logger)
+	if pub == nil {
+		return nil, fmt.Errorf("rabbitmq publisher: init failed")
+	}
+	b.pub = pub
+
+	return pub, nil
+}
+
+func (b *RabbitBus) exchange() string {
+	return b.option.Server.Topics[0].ChanName
+}
+
+// backoff 退避等待，ctx 结束时返回 false
+func backoff(ctx context.Context, d *time.Duration) bool {
+	timer := time.NewTimer(*d)
+	defer timer.Stop()
+
+	*d *= 2
+	if *d > rabbitBusMaxBackoff {
+		*d = rabbitBusMaxBackoff
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"context"
+
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	goRedis "github.com/go-redis/redis/v8"
+)
+
+// RedisBus 基于 redis pub/sub 的失效消息通道
+type RedisBus struct {
+	client  *db.Redis
+	channel string
+	logger  *log.Logger
+}
+
+func NewRedisBus(client *db.Redis, channel string, log *log.Logger) *RedisBus {
+	return &RedisBus{
+		client:  client,
+		channel: channel,
+		logger:  log,
+	}
+}
+
+func (b *RedisBus) Publish(ctx context.Context, msg []byte) error {
+	return b.client.Publish(ctx, b.channel, msg).Err()
+}
+
+// Subscribe 使用 db.Subscriber 订阅，断线重连由其处理，消息按收到的顺序逐条处理
+func (b *RedisBus) Subscribe(ctx context.Context, handle func(msg []byte)) error {
+	sub := b.client.NewSubscriber(db.SubscriberConfig{})
+	err := sub.Handle(ctx, b.channel, func(_ context.Context, msg *goRedis.Message) {
+		handle([]byte(msg.Payload))
+	})
+	if err != nil {
+		return err
+	}
+
+	sub.Start()
+	<-ctx.Done()
+	return sub.Close()
+}
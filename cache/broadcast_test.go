@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestBroadcastCache(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx, cancel := context.WithCancel(hctx.GetContext(context.Background(), ""))
+	defer cancel()
+
+	client, err := db.NewRedis(newTestRedisConfig(t), *logger)
+	assert.Nil(t, err)
+
+	newInstance := func() *BroadcastCache {
+		local := NewCache(Config{Cache: FreeCacheConfig{CacheSizeMB: 1, GCPercent: 100}}, logger)
+		b := NewBroadcastCache(local, NewRedisBus(client, "cache-invalidation", logger), logger)
+		b.Start(ctx)
+		return b
+	}
+	a, b := newInstance(), newInstance()
+	// 等待订阅生效
+	assert.Eventually(t, func() bool {
+		n, _ := client.PubSubNumSub(ctx, "cache-invalidation").Result()
+		return n["cache-invalidation"] == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// Del
+	assert.Nil(t, a.Set(ctx, "book:42", "a", 60))
+	assert.Nil(t, b.Set(ctx, "book:42", "b", 60))
+	assert.Nil(t, a.Del(ctx, "book:42"))
+	assert.Eventually(t, func() bool {
+		_, err := b.Get(ctx, "book:42")
+		return err == ErrNotFound
+	}, time.Second, 10*time.Millisecond)
+
+	// 命名空间
+	nsA, nsB := Namespace(a, "ranking"), Namespace(b, "ranking")
+	assert.Nil(t, nsA.Set(ctx, "top", "a", 60))
+	assert.Nil(t, nsB.Set(ctx, "top", "b", 60))
+	assert.Nil(t, nsA.InvalidateNamespace(ctx))
+	_, err = nsA.Get(ctx, "top")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Eventually(t, func() bool {
+		_, err := nsB.Get(ctx, "top")
+		return err == ErrNotFound
+	}, time.Second, 10*time.Millisecond)
+
+	// 各实例的 generation 不同，删除命名空间内的键按各自的 generation 删除
+	nsA, nsB = Namespace(a, "book"), Namespace(Chain(b, WithMetrics()), "book")
+	assert.Nil(t, nsA.Set(ctx, "42", "a", 60))
+	assert.Nil(t, nsB.Set(ctx, "42", "b", 60))
+	keyA, _ := nsA.key(ctx, "42")
+	keyB, _ := nsB.key(ctx, "42")
+	assert.NotEqual(t, keyA, keyB)
+	assert.Nil(t, nsA.Del(ctx, "42"))
+	assert.Eventually(t, func() bool {
+		_, err := nsB.Get(ctx, "42")
+		return err == ErrNotFound
+	}, time.Second, 10*time.Millisecond)
+	// 经过中间件的删除同样广播
+	assert.Nil(t, nsA.Set(ctx, "43", "a", 60))
+	assert.Nil(t, nsB.Set(ctx, "43", "b", 60))
+	assert.Nil(t, nsB.Del(ctx, "43"))
+	assert.Eventually(t, func() bool {
+		_, err := nsA.Get(ctx, "43")
+		return err == ErrNotFound
+	}, time.Second, 10*time.Millisecond)
+
+	// 标签
+	assert.Nil(t, SetWithTags(ctx, b, "book:43", "b", 60, "author:7"))
+	assert.Nil(t, InvalidateTags(ctx, a, "author:7"))
+	assert.Eventually(t, func() bool {
+		_, err := b.Get(ctx, "book:43")
+		return err == ErrNotFound
+	}, time.Second, 10*time.Millisecond)
+}
@@ -3,21 +3,59 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 
+	"git.zhwenxue.com/zhgo/gocontrib/db"
 	"git.zhwenxue.com/zhgo/gocontrib/log"
+	"github.com/coocood/freecache"
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	// DriverFreeCache 进程内 freecache 缓存，默认驱动
+	DriverFreeCache = "freecache"
+	// DriverRedis redis 缓存
+	DriverRedis = "redis"
+	// DriverMemory 直接保存 Go 值的进程内缓存
+	DriverMemory = "memory"
+	// DriverMemcached memcached 缓存
+	DriverMemcached = "memcached"
+)
+
+var (
+	// ErrNotFound 键不存在，与 freecache.ErrNotFound 为同一个值
+	ErrNotFound = freecache.ErrNotFound
+	// ErrNotCounter 键对应的值不是 Incr/Decr 写入的计数器
+	ErrNotCounter = errors.New("cache: value is not a counter")
+)
+
 type Cache interface {
 	Get(context.Context, string) (interface{}, error)
 	Set(context.Context, string, interface{}, int) error
 	Del(context.Context, string) error
-	Stats() interface{}
+	// Incr 将计数器原子地加上 delta 并返回新值，键不存在时从 0 开始，保留原有过期时间
+	Incr(context.Context, string, int64) (int64, error)
+	// Decr 将计数器原子地减去 delta 并返回新值
+	Decr(context.Context, string, int64) (int64, error)
+	// SetNX 仅当键不存在时写入，返回是否写入成功
+	SetNX(context.Context, string, interface{}, int) (bool, error)
+	// TTL 返回键的剩余过期秒数，0 表示永不过期，键不存在时返回 ErrNotFound
+	TTL(context.Context, string) (int, error)
+	// Touch 重新设置键的过期秒数，expireSeconds <= 0 表示永不过期
+	Touch(context.Context, string, int) error
+	Stats() Stats
 }
 
 type Config struct {
-	Cache FreeCacheConfig `yaml:"cache"`
+	// 缓存驱动：freecache|redis|memory|memcached，默认 freecache
+	Driver    string            `yaml:"driver"`
+	Cache     FreeCacheConfig   `yaml:"cache"`
+	Redis     *db.RedisConfig   `yaml:"redis"`
+	Memory    MemoryCacheConfig `yaml:"memory"`
+	Memcached MemcachedConfig   `yaml:"memcached"`
+	// 中间件，如日志、熔断
+	Middleware MiddlewareConfig `yaml:"middleware"`
 }
 
 func ConfigWithPath(path string) (Config, error) {
@@ -37,5 +75,28 @@ func ConfigWithPath(path string) (Config, error) {
 }
 
 func NewCache(cnf Config, log *log.Logger) Cache {
-	return newFreeCache(cnf.Cache, log)
+	return Chain(newDriver(cnf, log), cnf.Middleware.Middlewares(log)...)
+}
+
+func newDriver(cnf Config, log *log.Logger) Cache {
+	switch cnf.Driver {
+	case DriverRedis:
+		if cnf.Redis == nil {
+			panic("cache: redis driver without redis config")
+		}
+		client, err := db.NewRedis(cnf.Redis, *log)
+		if err != nil {
+			panic(err)
+		}
+		return NewRedisCache(client, log)
+	case DriverMemory:
+		return newMemoryCache(cnf.Memory, log)
+	case DriverMemcached:
+		if len(cnf.Memcached.Servers) == 0 {
+			panic("cache: memcached driver without servers")
+		}
+		return newMemcachedCache(cnf.Memcached, log)
+	default:
+		return newFreeCache(cnf.Cache, log)
+	}
 }
@@ -47,4 +47,70 @@ func TestCache(t *testing.T) {
 	// Stats
 	stats := cache.Stats()
 	fmt.Printf("stats : %+v\n", stats)
+	old, ok := FreeCacheStatsOf(cache)
+	assert.True(t, ok)
+	assert.Equal(t, stats.Hits, old.HitCount)
+	assert.Equal(t, stats.Misses, old.MissCount)
+}
+
+func TestFreeCacheCounter(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx := hctx.GetContext(context.Background(), "")
+	cache := NewCache(Config{Cache: FreeCacheConfig{CacheSizeMB: 1, GCPercent: 100}}, logger)
+	testCounter(t, ctx, cache)
+}
+
+func testCounter(t *testing.T, ctx context.Context, cache Cache) {
+	key := "test_counter"
+
+	n, err := cache.Incr(ctx, key, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), n)
+
+	n, err = cache.Decr(ctx, key, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+
+	val, err := cache.Get(ctx, key)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), val)
+
+	// 计数器保留原有过期时间
+	err = cache.Touch(ctx, key, 60)
+	assert.Nil(t, err)
+	_, err = cache.Incr(ctx, key, 1)
+	assert.Nil(t, err)
+	ttl, err := cache.TTL(ctx, key)
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= 60)
+
+	err = cache.Touch(ctx, key, 0)
+	assert.Nil(t, err)
+	ttl, err = cache.TTL(ctx, key)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, ttl)
+
+	// 值不是计数器
+	err = cache.Set(ctx, "test_not_counter", "hachi", 60)
+	assert.Nil(t, err)
+	_, err = cache.Incr(ctx, "test_not_counter", 1)
+	assert.Equal(t, ErrNotCounter, err)
+	_, err = cache.Decr(ctx, "test_not_counter", 1)
+	assert.Equal(t, ErrNotCounter, err)
+
+	_, err = cache.TTL(ctx, "test_missing")
+	assert.Equal(t, ErrNotFound, err)
+	err = cache.Touch(ctx, "test_missing", 10)
+	assert.Equal(t, ErrNotFound, err)
+
+	// SetNX
+	ok, err := cache.SetNX(ctx, "test_flag", "first", 60)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = cache.SetNX(ctx, "test_flag", "second", 60)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	val, err = cache.Get(ctx, "test_flag")
+	assert.Nil(t, err)
+	assert.Equal(t, "first", val)
 }
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strconv"
+)
+
+// 各驱动共用的值编码
+// 普通值使用 gob 编码；int64 和 Incr/Decr 写入的计数器以十进制字符串保存，
+// 与 redis INCRBY 的存储格式一致，Get 读取时返回 int64。
+// gob 编码的 interface 值必然包含类型名，不会与纯数字冲突。
+
+func serialize(value interface{}) ([]byte, error) {
+	if n, ok := value.(int64); ok {
+		return encodeCounter(n), nil
+	}
+
+	buf := bytes.Buffer{}
+	enc := gob.NewEncoder(&buf)
+	gob.Register(value)
+
+	err := enc.Encode(&value)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func deserialize(valueBytes []byte) (interface{}, error) {
+	if isCounter(valueBytes) {
+		return decodeCounter(valueBytes)
+	}
+
+	var value interface{}
+	buf := bytes.NewBuffer(valueBytes)
+	dec := gob.NewDecoder(buf)
+
+	err := dec.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func encodeCounter(n int64) []byte {
+	return strconv.AppendInt(nil, n, 10)
+}
+
+func decodeCounter(valueBytes []byte) (int64, error) {
+	if !isCounter(valueBytes) {
+		return 0, ErrNotCounter
+	}
+	return strconv.ParseInt(string(valueBytes), 10, 64)
+}
+
+func isCounter(valueBytes []byte) bool {
+	if len(valueBytes) == 0 || len(valueBytes) > 20 {
+		return false
+	}
+	for i, b := range valueBytes {
+		if b == '-' && i == 0 && len(valueBytes) > 1 {
+			continue
+		}
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -1,11 +1,11 @@
 package cache
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"errors"
+	"hash/fnv"
 	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 
 	"git.zhwenxue.com/zhgo/gocontrib/log"
@@ -19,11 +19,9 @@ type FreeCacheConfig struct {
 	GCPercent int `yaml:"gcPercent"`
 }
 
-type freeCache struct {
-	cache  *freecache.Cache
-	logger *log.Logger
-}
-
+// FreeCacheStats freecache 的统计
+//
+// Deprecated: 使用 Cache.Stats 返回的 Stats；需要 freecache 特有的计数时使用 FreeCacheStatsOf。
 type FreeCacheStats struct {
 	// 驱逐发生的次数
 	EvacuateCount int64 `json:"evacuate_count"`
@@ -47,6 +45,18 @@ type FreeCacheStats struct {
 	TouchedCount int64 `json:"touched_count"`
 }
 
+// 计数器和 SetNX 的读改写需要加锁，按键哈希分段以减少竞争
+const lockSegments = 256
+
+type freeCache struct {
+	cache  *freecache.Cache
+	logger *log.Logger
+	locks  [lockSegments]sync.Mutex
+	tags   *tagIndex
+	size   int64
+	timing *latencies
+}
+
 func newFreeCache(cnf FreeCacheConfig, log *log.Logger) *freeCache {
 	c := freecache.NewCache(cnf.CacheSizeMB * 1024 * 1024) // MB => Byte
 	debug.SetGCPercent(cnf.GCPercent)                      // !!!
@@ -54,7 +64,10 @@ func newFreeCache(cnf FreeCacheConfig, log *log.Logger) *freeCache {
 	cache := &freeCache{
 		cache:  c,
 		logger: log,
+		size:   int64(cnf.CacheSizeMB) * 1024 * 1024,
+		timing: newLatencies(),
 	}
+	cache.tags = newTagIndex(cache.exists)
 
 	return cache
 }
@@ -67,32 +80,138 @@ func (c *freeCache) Get(ctx context.Context, key string) (interface{}, error) {
 		return nil, err
 	}
 
-	return c.deserialize(valueBytes)
+	return deserialize(valueBytes)
 }
 
 func (c *freeCache) Set(ctx context.Context, key string, value interface{}, expireSeconds int) error {
 	defer c.trace(ctx, "set", key, time.Now())
 
-	valueBytes, err := c.serialize(value)
+	valueBytes, err := serialize(value)
 	if err != nil {
 		return err
 	}
 
+	c.tags.remove(key)
 	return c.cache.Set([]byte(key), valueBytes, expireSeconds)
 }
 
 func (c *freeCache) Del(ctx context.Context, key string) error {
 	defer c.trace(ctx, "del", key, time.Now())
 
+	c.tags.remove(key)
 	ok := c.cache.Del([]byte(key))
 	if !ok {
-		return errors.New("freecache delete failed")
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (c *freeCache) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	defer c.trace(ctx, "incr", key, time.Now())
+
+	c.tags.remove(key)
+	return c.incr([]byte(key), delta)
+}
+
+func (c *freeCache) Decr(ctx context.Context, key string, delta int64) (int64, error) {
+	defer c.trace(ctx, "decr", key, time.Now())
+
+	c.tags.remove(key)
+	return c.incr([]byte(key), -delta)
+}
+
+func (c *freeCache) SetNX(ctx context.Context, key string, value interface{}, expireSeconds int) (bool, error) {
+	defer c.trace(ctx, "setnx", key, time.Now())
+
+	valueBytes, err := serialize(value)
+	if err != nil {
+		return false, err
+	}
+
+	mu := c.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	old, err := c.cache.GetOrSet([]byte(key), valueBytes, expireSeconds)
+	if err != nil {
+		return false, err
+	}
+
+	return old == nil, nil
+}
+
+func (c *freeCache) TTL(ctx context.Context, key string) (int, error) {
+	defer c.trace(ctx, "ttl", key, time.Now())
+
+	timeLeft, err := c.cache.TTL([]byte(key))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(timeLeft), nil
+}
+
+func (c *freeCache) Touch(ctx context.Context, key string, expireSeconds int) error {
+	defer c.trace(ctx, "touch", key, time.Now())
+
+	return c.cache.Touch([]byte(key), expireSeconds)
+}
+
+func (c *freeCache) SetWithTags(ctx context.Context, key string, value interface{}, expireSeconds int, tags ...string) error {
+	defer c.trace(ctx, "setwithtags", key, time.Now())
+
+	valueBytes, err := serialize(value)
+	if err != nil {
+		return err
 	}
 
+	return c.tags.set(key, tags, func() error {
+		return c.cache.Set([]byte(key), valueBytes, expireSeconds)
+	})
+}
+
+func (c *freeCache) InvalidateTags(ctx context.Context, tags ...string) error {
+	defer c.trace(ctx, "invalidatetags", strings.Join(tags, ","), time.Now())
+
+	c.tags.invalidate(tags, func(key string) {
+		c.cache.Del([]byte(key))
+	})
+
 	return nil
 }
 
-func (c *freeCache) Stats() interface{} {
+func (c *freeCache) Stats() Stats {
+	return Stats{
+		Hits:        c.cache.HitCount(),
+		Misses:      c.cache.MissCount(),
+		HitRate:     c.cache.HitRate(),
+		Entries:     c.cache.EntryCount(),
+		Evictions:   c.cache.EvacuateCount(),
+		Expirations: c.cache.ExpiredCount(),
+		// freecache 启动时预分配全部内存
+		BytesUsed: c.size,
+		Latency:   c.timing.snapshot(),
+	}
+}
+
+// FreeCacheStatsOf 返回 freecache 驱动的旧版统计，会穿过中间件；c 不是 freecache 时返回 false
+//
+// Deprecated: 使用 Cache.Stats。
+func FreeCacheStatsOf(c Cache) (FreeCacheStats, bool) {
+	s, ok := c.(freeCacheStatser)
+	if !ok {
+		return FreeCacheStats{}, false
+	}
+	return s.freeCacheStats()
+}
+
+// freeCacheStatser 由 freecache 和中间件实现
+type freeCacheStatser interface {
+	freeCacheStats() (FreeCacheStats, bool)
+}
+
+func (c *freeCache) freeCacheStats() (FreeCacheStats, bool) {
 	return FreeCacheStats{
 		EvacuateCount:     c.cache.EvacuateCount(),
 		ExpiredCount:      c.cache.ExpiredCount(),
@@ -104,39 +223,88 @@ func (c *freeCache) Stats() interface{} {
 		HitRate:           c.cache.HitRate(),
 		OverwriteCount:    c.cache.OverwriteCount(),
 		TouchedCount:      c.cache.TouchedCount(),
-	}
+	}, true
 }
 
 func (c *freeCache) trace(ctx context.Context, cmd, key string, start time.Time) {
-	c.logger.Info(ctx, "Cache",
-		log.String("cmd", cmd),
-		log.String("key", key),
-		log.Duration("time", time.Since(start)),
-	)
+	c.timing.trace(ctx, c.logger, cmd, key, start)
 }
 
-func (c *freeCache) serialize(value interface{}) ([]byte, error) {
-	buf := bytes.Buffer{}
-	enc := gob.NewEncoder(&buf)
-	gob.Register(value)
+// rangeEntries 遍历未过期的条目用于快照，标签索引不包含在快照中
+func (c *freeCache) rangeEntries(fn func(key, value []byte, expireAt int64) error) error {
+	it := c.cache.NewIterator()
+	for entry := it.Next(); entry != nil; entry = it.Next() {
+		timeLeft, err := c.cache.TTL(entry.Key)
+		if err != nil {
+			// 遍历期间过期或被删除
+			continue
+		}
 
-	err := enc.Encode(&value)
-	if err != nil {
-		return nil, err
+		var expireAt int64
+		if timeLeft > 0 {
+			expireAt = time.Now().Unix() + int64(timeLeft)
+		}
+		if err = fn(entry.Key, entry.Value, expireAt); err != nil {
+			return err
+		}
 	}
 
-	return buf.Bytes(), nil
+	return nil
+}
+
+func (c *freeCache) loadEntry(key, value []byte, expireSeconds int) error {
+	return c.cache.Set(key, value, expireSeconds)
 }
 
-func (c *freeCache) deserialize(valueBytes []byte) (interface{}, error) {
-	var value interface{}
-	buf := bytes.NewBuffer(valueBytes)
-	dec := gob.NewDecoder(buf)
+func (c *freeCache) incr(key []byte, delta int64) (int64, error) {
+	mu := c.lock(string(key))
+	mu.Lock()
+	defer mu.Unlock()
+
+	var n int64
+	valueBytes, expireAt, err := c.cache.GetWithExpiration(key)
+	switch err {
+	case nil:
+		n, err = decodeCounter(valueBytes)
+		if err != nil {
+			return 0, err
+		}
+	case freecache.ErrNotFound:
+	default:
+		return 0, err
+	}
 
-	err := dec.Decode(&value)
+	n += delta
+	err = c.cache.Set(key, encodeCounter(n), expireSecondsLeft(expireAt))
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// exists 供标签索引清理使用，TTL 不计入命中统计
+func (c *freeCache) exists(key string) bool {
+	_, err := c.cache.TTL([]byte(key))
+	return err == nil
+}
+
+func (c *freeCache) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &c.locks[h.Sum32()%lockSegments]
+}
+
+// expireSecondsLeft 将 freecache 的过期时间戳换算为剩余秒数，0 表示永不过期
+func expireSecondsLeft(expireAt uint32) int {
+	if expireAt == 0 {
+		return 0
+	}
+
+	left := int64(expireAt) - time.Now().Unix()
+	if left <= 0 {
+		return 1
 	}
 
-	return value, nil
+	return int(left)
 }
@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+const (
+	defaultHotKeyTopK     = 10
+	defaultHotKeyWindow   = time.Minute
+	defaultL1ExpireSecond = 1
+	defaultL1MaxEntries   = 1000
+	// count-min sketch 的行数和每行的计数器数
+	sketchDepth = 4
+	sketchWidth = 2048
+)
+
+type HotKeyConfig struct {
+	// 统计的热点键数量，默认 10
+	TopK int `yaml:"topK"`
+	// 统计窗口，每个窗口结束时所有计数减半，默认 1m
+	Window time.Duration `yaml:"window"`
+	// 访问次数（按窗口衰减）达到该值的键提升到本地 L1，0 表示不提升
+	PromoteThreshold int64 `yaml:"promoteThreshold"`
+	// L1 条目的过期秒数，即其他实例修改后本实例最长读到旧值的时间，默认 1
+	L1ExpireSeconds int `yaml:"l1ExpireSeconds"`
+	// L1 最大条目数，默认 1000
+	L1MaxEntries int `yaml:"l1MaxEntries"`
+}
+
+// HotKey 热点键及其近似访问次数
+type HotKey struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// WithHotKeys 用 count-min sketch 统计各键的访问次数，维护近似的 top-K，通过 Stats 的 HotKeys 输出
+// 设置了 PromoteThreshold 时，热点键的 Get 先读本地 L1（memory 驱动），未命中再读内层并写入 L1；
+// 经过本层的写操作会删除 L1 中的键，其他实例的修改最多延迟 L1ExpireSeconds 可见。
+func WithHotKeys(logger *log.Logger, cnf HotKeyConfig) Middleware {
+	if cnf.TopK <= 0 {
+		cnf.TopK = defaultHotKeyTopK
+	}
+	if cnf.Window <= 0 {
+		cnf.Window = defaultHotKeyWindow
+	}
+	if cnf.L1ExpireSeconds <= 0 {
+		cnf.L1ExpireSeconds = defaultL1ExpireSecond
+	}
+	if cnf.L1MaxEntries <= 0 {
+		cnf.L1MaxEntries = defaultL1MaxEntries
+	}
+
+	return func(c Cache) Cache {
+		h := &hotKeyCache{
+			cnf:     cnf,
+			logger:  logger,
+			tracker: newHotKeyTracker(cnf.TopK, cnf.Window),
+		}
+		h.decorated = decorated{Cache: c, intercept: h.intercept}
+		h.resetL1()
+		return h
+	}
+}
+
+// ReportHotKeys 每隔 interval 以 Info 级别记录一次热点键，ctx 结束时返回
+// c 需要启用 WithHotKeys，否则没有数据可记录。
+func ReportHotKeys(ctx context.Context, c Cache, interval time.Duration, logger *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			keys := c.Stats().HotKeys
+			if len(keys) > 0 {
+				logger.Info(ctx, "cache hot keys", log.Any("keys", keys))
+			}
+		}
+	}
+}
+
+type hotKeyCache struct {
+	decorated
+	cnf     HotKeyConfig
+	logger  *log.Logger
+	tracker *hotKeyTracker
+	l1      atomic.Value // *memoryCache
+}
+
+func (h *hotKeyCache) Get(ctx context.Context, key string) (interface{}, error) {
+	n := h.tracker.record(key)
+	if h.cnf.PromoteThreshold <= 0 || n < h.cnf.PromoteThreshold {
+		return h.Cache.Get(ctx, key)
+	}
+
+	l1 := h.local()
+	if value, err := l1.Get(ctx, key); err == nil {
+		return value, nil
+	}
+
+	value, err := h.Cache.Get(ctx, key)
+	if err == nil {
+		_ = l1.Set(ctx, key, value, h.cnf.L1ExpireSeconds)
+	}
+	return value, err
+}
+
+func (h *hotKeyCache) intercept(ctx context.Context, op, key string, call func(ctx context.Context) error) error {
+	switch op {
+	case "invalidatetags", "invalidatenamespace":
+		// 无法知道涉及哪些键，清空 L1
+		err := call(ctx)
+		h.resetL1()
+		return err
+	}
+
+	h.tracker.record(key)
+	err := call(ctx)
+	if isWriteOp(op) {
+		h.local().del(key)
+	}
+	return err
+}
+
+func (h *hotKeyCache) Stats() Stats {
+	stats := h.Cache.Stats()
+	stats.HotKeys = h.tracker.top()
+	return stats
+}
+
+func (h *hotKeyCache) local() *memoryCache {
+	return h.l1.Load().(*memoryCache)
+}
+
+func (h *hotKeyCache) resetL1() {
+	h.l1.Store(newMemoryCache(MemoryCacheConfig{MaxEntries: h.cnf.L1MaxEntries}, h.logger))
+}
+
+// hotKeyTracker count-min sketch 估算访问次数，估算值超过当前 top-K 最小值的键替换该键
+type hotKeyTracker struct {
+	mu      sync.Mutex
+	sketch  [sketchDepth][sketchWidth]uint32
+	k       int
+	keys    map[string]int64
+	floor   int64 // keys 中的最小计数的下界，用于跳过扫描
+	window  time.Duration
+	decayAt time.Time
+}
+
+func newHotKeyTracker(k int, window time.Duration) *hotKeyTracker {
+	return &hotKeyTracker{
+		k:       k,
+		keys:    make(map[string]int64, k),
+		window:  window,
+		decayAt: time.Now().Add(window),
+	}
+}
+
+// record 记录一次访问并返回估算的访问次数
+func (t *hotKeyTracker) record(key string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now := time.Now(); now.After(t.decayAt) {
+		t.decay()
+		t.decayAt = now.Add(t.window)
+	}
+
+	var est uint32 = math.MaxUint32
+	for i := range t.sketch {
+		c := &t.sketch[i][(h1+uint32(i)*h2)%sketchWidth]
+		if *c < math.MaxUint32 {
+			*c++
+		}
+		if *c < est {
+			est = *c
+		}
+	}
+	n := int64(est)
+
+	if _, ok := t.keys[key]; ok || len(t.keys) < t.k {
+		t.keys[key] = n
+		return n
+	}
+	if n <= t.floor {
+		return n
+	}
+
+	minKey, minCount := "", int64(math.MaxInt64)
+	for k, c := range t.keys {
+		if c < minCount {
+			minKey, minCount = k, c
+		}
+	}
+	if n > minCount {
+		delete(t.keys, minKey)
+		t.keys[key] = n
+		minCount = n
+		for _, c := range t.keys {
+			if c < minCount {
+				minCount = c
+			}
+		}
+	}
+	t.floor = minCount
+
+	return n
+}
+
+// decay 所有计数减半，使统计偏向最近的访问，调用方持有锁
+func (t *hotKeyTracker) decay() {
+	for i := range t.sketch {
+		for j := range t.sketch[i] {
+			t.sketch[i][j] >>= 1
+		}
+	}
+	for k, c := range t.keys {
+		if c >>= 1; c == 0 {
+			delete(t.keys, k)
+		} else {
+			t.keys[k] = c
+		}
+	}
+	t.floor >>= 1
+}
+
+// top 按访问次数从高到低返回热点键
+func (t *hotKeyTracker) top() []HotKey {
+	t.mu.Lock()
+	keys := make([]HotKey, 0, len(t.keys))
+	for k, c := range t.keys {
+		keys = append(keys, HotKey{Key: k, Count: c})
+	}
+	t.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+// countingCache 记录 Get 到达内层的次数
+type countingCache struct {
+	Cache
+	gets int
+}
+
+func (c *countingCache) Get(ctx context.Context, key string) (interface{}, error) {
+	c.gets++
+	return c.Cache.Get(ctx, key)
+}
+
+func TestHotKeys(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	c := Chain(newTestMemoryCache(), WithHotKeys(log.Default(), HotKeyConfig{TopK: 3}))
+
+	for i := 0; i < 200; i++ {
+		_, _ = c.Get(ctx, fmt.Sprintf("book:%d", i))
+		_, _ = c.Get(ctx, "book:hot")
+		if i%2 == 0 {
+			_, _ = c.Get(ctx, "book:warm")
+		}
+	}
+
+	keys := c.Stats().HotKeys
+	assert.Equal(t, 3, len(keys))
+	assert.Equal(t, HotKey{Key: "book:hot", Count: 200}, keys[0])
+	assert.Equal(t, "book:warm", keys[1].Key)
+	assert.True(t, keys[1].Count >= 100)
+
+	// 窗口结束时计数减半
+	tracker := newHotKeyTracker(3, 10*time.Millisecond)
+	for i := 0; i < 8; i++ {
+		tracker.record("book:hot")
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int64(5), tracker.record("book:hot"))
+}
+
+func TestHotKeysPromote(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	inner := &countingCache{Cache: newTestMemoryCache()}
+	c := Chain(inner, WithHotKeys(log.Default(), HotKeyConfig{PromoteThreshold: 3, L1ExpireSeconds: 60}))
+
+	assert.Nil(t, c.Set(ctx, "book:42", "hachi", 60))
+	for i := 0; i < 10; i++ {
+		val, err := c.Get(ctx, "book:42")
+		assert.Nil(t, err)
+		assert.Equal(t, "hachi", val)
+	}
+	// Set 也计入访问，第二次 Get 达到阈值，读内层后写入 L1
+	assert.Equal(t, 2, inner.gets)
+
+	// 写操作删除 L1 中的键
+	assert.Nil(t, c.Set(ctx, "book:42", "hachi2", 60))
+	val, err := c.Get(ctx, "book:42")
+	assert.Nil(t, err)
+	assert.Equal(t, "hachi2", val)
+	assert.Equal(t, 3, inner.gets)
+
+	// 标签失效清空 L1
+	c = Chain(newTestMemoryCache(), WithHotKeys(log.Default(), HotKeyConfig{PromoteThreshold: 3, L1ExpireSeconds: 60}))
+	assert.Nil(t, SetWithTags(ctx, c, "book:43", "hachi", 60, "books"))
+	for i := 0; i < 5; i++ {
+		_, _ = c.Get(ctx, "book:43")
+	}
+	assert.Nil(t, InvalidateTags(ctx, c, "books"))
+	_, err = c.Get(ctx, "book:43")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestReportHotKeys(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, log.InfoLevel)
+	c := Chain(newTestMemoryCache(), WithHotKeys(logger, HotKeyConfig{}))
+	_, _ = c.Get(ctx, "book:42")
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Millisecond)
+	defer cancel()
+	ReportHotKeys(ctx, c, 10*time.Millisecond, logger)
+	assert.True(t, strings.Contains(buf.String(), "book:42"))
+}
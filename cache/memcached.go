@@ -0,0 +1,535 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+const (
+	defaultMemcachedIdleConns = 2
+	defaultMemcachedTimeout   = 500 * time.Millisecond
+	// 每台服务器在哈希环上的虚拟节点数
+	memcachedVirtualNodes = 160
+	// Incr 的 CAS 冲突重试次数
+	memcachedCASRetries = 16
+)
+
+var (
+	// ErrMemcachedKey 键不符合 memcached 要求（最长 250 字节，不含空白和控制字符）
+	ErrMemcachedKey = errors.New("cache: invalid memcached key")
+	// ErrMemcachedCAS 并发修改导致 CAS 多次失败
+	ErrMemcachedCAS = errors.New("cache: memcached cas conflict")
+	// ErrMemcachedNoServers 没有配置服务器
+	ErrMemcachedNoServers = errors.New("cache: no memcached servers")
+)
+
+type MemcachedConfig struct {
+	// 服务器地址列表，host:port，按一致性哈希分布键
+	Servers []string `yaml:"servers"`
+	// 每台服务器保留的空闲连接数，默认 2
+	MaxIdleConns int `yaml:"maxIdleConns"`
+	// 单次操作的超时时间，ctx 没有截止时间时使用，默认 500ms
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// memcachedCache 使用 memcached 文本协议和 meta 协议的缓存
+// Incr/Decr 用 meta get/set 的 CAS 实现，计数器可以为负并保留原有过期时间；SetNX 使用 add。
+type memcachedCache struct {
+	ring    []uint32
+	nodes   map[uint32]*memcachedPool
+	timeout time.Duration
+	logger  *log.Logger
+	hits    int64
+	misses  int64
+	timing  *latencies
+}
+
+func newMemcachedCache(cnf MemcachedConfig, log *log.Logger) *memcachedCache {
+	if cnf.MaxIdleConns <= 0 {
+		cnf.MaxIdleConns = defaultMemcachedIdleConns
+	}
+	if cnf.Timeout <= 0 {
+		cnf.Timeout = defaultMemcachedTimeout
+	}
+
+	c := &memcachedCache{
+		nodes:   make(map[uint32]*memcachedPool),
+		timeout: cnf.Timeout,
+		logger:  log,
+		timing:  newLatencies(),
+	}
+	for _, addr := range cnf.Servers {
+		pool := &memcachedPool{
+			addr: addr,
+			idle: make(chan *memcachedConn, cnf.MaxIdleConns),
+		}
+		for i := 0; i < memcachedVirtualNodes; i++ {
+			point := crc32.ChecksumIEEE([]byte(addr + "-" + strconv.Itoa(i)))
+			if _, ok := c.nodes[point]; !ok {
+				c.nodes[point] = pool
+				c.ring = append(c.ring, point)
+			}
+		}
+	}
+	sort.Slice(c.ring, func(i, j int) bool { return c.ring[i] < c.ring[j] })
+
+	return c
+}
+
+func (c *memcachedCache) Get(ctx context.Context, key string) (value interface{}, err error) {
+	defer c.trace(ctx, "get", key, time.Now())
+
+	err = c.do(ctx, key, func(cn *memcachedConn) error {
+		if err := cn.writeLine("get", key); err != nil {
+			return err
+		}
+		data, _, found, err := cn.readValue()
+		if err != nil {
+			return err
+		}
+		if !found {
+			atomic.AddInt64(&c.misses, 1)
+			return ErrNotFound
+		}
+		atomic.AddInt64(&c.hits, 1)
+
+		value, err = deserialize(data)
+		return err
+	})
+	return value, err
+}
+
+func (c *memcachedCache) Set(ctx context.Context, key string, value interface{}, expireSeconds int) error {
+	defer c.trace(ctx, "set", key, time.Now())
+
+	return c.store(ctx, "set", key, value, expireSeconds, ErrNotFound)
+}
+
+func (c *memcachedCache) Del(ctx context.Context, key string) error {
+	defer c.trace(ctx, "del", key, time.Now())
+
+	return c.do(ctx, key, func(cn *memcachedConn) error {
+		if err := cn.writeLine("delete", key); err != nil {
+			return err
+		}
+		return cn.expect("DELETED", ErrNotFound)
+	})
+}
+
+func (c *memcachedCache) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	defer c.trace(ctx, "incr", key, time.Now())
+
+	return c.incr(ctx, key, delta)
+}
+
+func (c *memcachedCache) Decr(ctx context.Context, key string, delta int64) (int64, error) {
+	defer c.trace(ctx, "decr", key, time.Now())
+
+	return c.incr(ctx, key, -delta)
+}
+
+func (c *memcachedCache) SetNX(ctx context.Context, key string, value interface{}, expireSeconds int) (bool, error) {
+	defer c.trace(ctx, "setnx", key, time.Now())
+
+	err := c.store(ctx, "add", key, value, expireSeconds, errNotStored)
+	if err == errNotStored {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (c *memcachedCache) TTL(ctx context.Context, key string) (ttl int, err error) {
+	defer c.trace(ctx, "ttl", key, time.Now())
+
+	err = c.do(ctx, key, func(cn *memcachedConn) error {
+		if err := cn.writeLine("mg", key, "t"); err != nil {
+			return err
+		}
+		meta, err := cn.readMeta()
+		if err != nil {
+			return err
+		}
+		if meta.status == "EN" {
+			return ErrNotFound
+		}
+
+		ttl = meta.ttl
+		return nil
+	})
+	return ttl, err
+}
+
+func (c *memcachedCache) Touch(ctx context.Context, key string, expireSeconds int) error {
+	defer c.trace(ctx, "touch", key, time.Now())
+
+	return c.do(ctx, key, func(cn *memcachedConn) error {
+		if err := cn.writeLine("touch", key, strconv.Itoa(memcachedExptime(expireSeconds))); err != nil {
+			return err
+		}
+		return cn.expect("TOUCHED", ErrNotFound)
+	})
+}
+
+func (c *memcachedCache) Stats() Stats {
+	hits, misses := atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+	return Stats{
+		Hits:    hits,
+		Misses:  misses,
+		HitRate: hitRate(hits, misses),
+		Latency: c.timing.snapshot(),
+	}
+}
+
+func (c *memcachedCache) trace(ctx context.Context, cmd, key string, start time.Time) {
+	c.timing.trace(ctx, c.logger, cmd, key, start)
+}
+
+// errNotStored add 时键已存在
+var errNotStored = errors.New("cache: memcached not stored")
+
+func (c *memcachedCache) store(ctx context.Context, cmd, key string, value interface{}, expireSeconds int, notStored error) error {
+	data, err := serialize(value)
+	if err != nil {
+		return err
+	}
+
+	return c.do(ctx, key, func(cn *memcachedConn) error {
+		err := cn.writeLine(cmd, key, "0", strconv.Itoa(memcachedExptime(expireSeconds)), strconv.Itoa(len(data)))
+		if err == nil {
+			err = cn.writeData(data)
+		}
+		if err != nil {
+			return err
+		}
+		return cn.expect("STORED", notStored)
+	})
+}
+
+// incr 读取值、CAS 和剩余 TTL，计算后用 CAS 写回；键不存在时以 add 模式写入
+func (c *memcachedCache) incr(ctx context.Context, key string, delta int64) (n int64, err error) {
+	for i := 0; i < memcachedCASRetries; i++ {
+		var stored bool
+		err = c.do(ctx, key, func(cn *memcachedConn) error {
+			if err := cn.writeLine("mg", key, "v", "c", "t"); err != nil {
+				return err
+			}
+			meta, err := cn.readMeta()
+			if err != nil {
+				return err
+			}
+
+			var args []string
+			if meta.status == "EN" {
+				n = delta
+				args = []string{"ME"}
+			} else {
+				cur, err := decodeCounter(meta.value)
+				if err != nil {
+					return err
+				}
+				n = cur + delta
+				args = []string{"C" + strconv.FormatUint(meta.cas, 10), "T" + strconv.Itoa(memcachedExptime(meta.ttl))}
+			}
+
+			data := encodeCounter(n)
+			err = cn.writeLine(append([]string{"ms", key, strconv.Itoa(len(data))}, args...)...)
+			if err == nil {
+				err = cn.writeData(data)
+			}
+			if err != nil {
+				return err
+			}
+			meta, err = cn.readMeta()
+			if err != nil {
+				return err
+			}
+
+			// HD 写入成功，EX/NS/NF 表示被并发修改，重试
+			stored = meta.status == "HD"
+			return nil
+		})
+		if err != nil || stored {
+			return n, err
+		}
+
+		// 冲突时随机退避，避免并发写同一个键时反复冲突
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(time.Duration(rand.Int63n(int64(i+1) * int64(time.Millisecond)))):
+		}
+	}
+
+	return 0, ErrMemcachedCAS
+}
+
+func (c *memcachedCache) do(ctx context.Context, key string, fn func(cn *memcachedConn) error) error {
+	if !validMemcachedKey(key) {
+		return ErrMemcachedKey
+	}
+	pool := c.pick(key)
+	if pool == nil {
+		return ErrMemcachedNoServers
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.timeout)
+	}
+	cn, err := pool.get(ctx, deadline)
+	if err != nil {
+		return err
+	}
+
+	err = fn(cn)
+	pool.put(cn, err)
+
+	return err
+}
+
+func (c *memcachedCache) pick(key string) *memcachedPool {
+	if len(c.ring) == 0 {
+		return nil
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i] >= h })
+	if i == len(c.ring) {
+		i = 0
+	}
+
+	return c.nodes[c.ring[i]]
+}
+
+func validMemcachedKey(key string) bool {
+	if len(key) == 0 || len(key) > 250 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// memcachedExptime 超过 30 天的相对时间会被 memcached 当作 unix 时间戳
+func memcachedExptime(expireSeconds int) int {
+	if expireSeconds <= 0 {
+		return 0
+	}
+	if expireSeconds > 30*24*3600 {
+		return int(time.Now().Unix()) + expireSeconds
+	}
+	return expireSeconds
+}
+
+type memcachedPool struct {
+	addr string
+	idle chan *memcachedConn
+}
+
+func (p *memcachedPool) get(ctx context.Context, deadline time.Time) (*memcachedConn, error) {
+	var cn *memcachedConn
+	select {
+	case cn = <-p.idle:
+	default:
+		d := net.Dialer{Deadline: deadline}
+		nc, err := d.DialContext(ctx, "tcp", p.addr)
+		if err != nil {
+			return nil, err
+		}
+		cn = &memcachedConn{
+			nc: nc,
+			rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
+		}
+	}
+
+	if err := cn.nc.SetDeadline(deadline); err != nil {
+		_ = cn.nc.Close()
+		return nil, err
+	}
+
+	return cn, nil
+}
+
+// put 连接出现网络或协议错误时关闭，业务结果（如未命中）不影响连接复用
+func (p *memcachedPool) put(cn *memcachedConn, err error) {
+	if err != nil && !isMemcachedResult(err) {
+		_ = cn.nc.Close()
+		return
+	}
+
+	select {
+	case p.idle <- cn:
+	default:
+		_ = cn.nc.Close()
+	}
+}
+
+func isMemcachedResult(err error) bool {
+	switch err {
+	case ErrNotFound, ErrNotCounter, errNotStored:
+		return true
+	}
+	return false
+}
+
+type memcachedConn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+func (cn *memcachedConn) writeLine(args ...string) error {
+	_, _ = cn.rw.WriteString(strings.Join(args, " "))
+	_, _ = cn.rw.WriteString("\r\n")
+	return cn.rw.Flush()
+}
+
+func (cn *memcachedConn) writeData(data []byte) error {
+	_, _ = cn.rw.Write(data)
+	_, _ = cn.rw.WriteString("\r\n")
+	return cn.rw.Flush()
+}
+
+func (cn *memcachedConn) readLine() (string, error) {
+	line, err := cn.rw.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+		return "", fmt.Errorf("memcached: %s", line)
+	}
+
+	return line, nil
+}
+
+// expect 读取一行响应，等于 ok 时返回 nil，其余合法响应返回 other
+func (cn *memcachedConn) expect(ok string, other error) error {
+	line, err := cn.readLine()
+	if err != nil {
+		return err
+	}
+
+	switch line {
+	case ok:
+		return nil
+	case "NOT_FOUND", "NOT_STORED", "EXISTS":
+		return other
+	}
+
+	return fmt.Errorf("memcached: unexpected response %q", line)
+}
+
+// readValue 读取 get 的响应 "VALUE <key> <flags> <bytes>\r\n<data>\r\nEND\r\n"
+func (cn *memcachedConn) readValue() ([]byte, uint32, bool, error) {
+	line, err := cn.readLine()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if line == "END" {
+		return nil, 0, false, nil
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "VALUE" {
+		return nil, 0, false, fmt.Errorf("memcached: unexpected response %q", line)
+	}
+	flags, _ := strconv.ParseUint(fields[2], 10, 32)
+	size, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("memcached: unexpected response %q", line)
+	}
+
+	data, err := cn.readData(size)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if line, err = cn.readLine(); err != nil {
+		return nil, 0, false, err
+	}
+	if line != "END" {
+		return nil, 0, false, fmt.Errorf("memcached: unexpected response %q", line)
+	}
+
+	return data, uint32(flags), true, nil
+}
+
+func (cn *memcachedConn) readData(size int) ([]byte, error) {
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(cn.rw, data); err != nil {
+		return nil, err
+	}
+	return data[:size], nil
+}
+
+// memcachedMeta meta 命令的响应
+type memcachedMeta struct {
+	status string // VA|HD|EN|EX|NS|NF
+	value  []byte
+	cas    uint64
+	ttl    int // 0 表示永不过期
+}
+
+// readMeta 读取 meta 命令的响应 "<status> [size] <flags>*"
+func (cn *memcachedConn) readMeta() (memcachedMeta, error) {
+	var meta memcachedMeta
+
+	line, err := cn.readLine()
+	if err != nil {
+		return meta, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return meta, fmt.Errorf("memcached: unexpected response %q", line)
+	}
+
+	meta.status = fields[0]
+	flags := fields[1:]
+	if meta.status == "VA" {
+		if len(flags) == 0 {
+			return meta, fmt.Errorf("memcached: unexpected response %q", line)
+		}
+		size, err := strconv.Atoi(flags[0])
+		if err != nil {
+			return meta, fmt.Errorf("memcached: unexpected response %q", line)
+		}
+		if meta.value, err = cn.readData(size); err != nil {
+			return meta, err
+		}
+		flags = flags[1:]
+	}
+
+	for _, f := range flags {
+		if len(f) < 2 {
+			continue
+		}
+		switch f[0] {
+		case 'c':
+			meta.cas, _ = strconv.ParseUint(f[1:], 10, 64)
+		case 't':
+			meta.ttl, _ = strconv.Atoi(f[1:])
+			if meta.ttl < 0 {
+				meta.ttl = 0
+			}
+		}
+	}
+
+	return meta, nil
+}
@@ -0,0 +1,288 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestMemcachedCache(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx := hctx.GetContext(context.Background(), "")
+
+	s1, s2 := newFakeMemcached(t), newFakeMemcached(t)
+	cache := NewCache(Config{Driver: DriverMemcached, Memcached: MemcachedConfig{Servers: []string{s1.addr, s2.addr}}}, logger)
+
+	value := FreeCacheConfig{CacheSizeMB: 1, GCPercent: 20}
+	assert.Nil(t, cache.Set(ctx, "config", value, 60))
+	val, err := cache.Get(ctx, "config")
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	assert.Nil(t, cache.Del(ctx, "config"))
+	_, err = cache.Get(ctx, "config")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, cache.Del(ctx, "config"))
+
+	testCounter(t, ctx, cache)
+
+	// 值不是计数器
+	assert.Nil(t, cache.Set(ctx, "config", value, 60))
+	_, err = cache.Incr(ctx, "config", 1)
+	assert.Equal(t, ErrNotCounter, err)
+
+	// 剩余时间超过 30 天的计数器 Incr 后仍保留过期时间
+	_, err = cache.Incr(ctx, "views", 1)
+	assert.Nil(t, err)
+	assert.Nil(t, cache.Touch(ctx, "views", 40*24*3600))
+	n, err := cache.Incr(ctx, "views", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	ttl, err := cache.TTL(ctx, "views")
+	assert.Nil(t, err)
+	assert.InDelta(t, 40*24*3600, ttl, 2)
+
+	// 计数器可以为负，并发 Incr 通过 CAS 保证不丢失
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, err := cache.Decr(ctx, "balance", 1)
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	val, err = cache.Get(ctx, "balance")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-80), val)
+
+	// 一致性哈希把键分布到多台服务器
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, cache.Set(ctx, fmt.Sprintf("book:%d", i), i, 60))
+	}
+	assert.True(t, s1.len() > 0)
+	assert.True(t, s2.len() > 0)
+
+	_, err = cache.Get(ctx, "bad key")
+	assert.Equal(t, ErrMemcachedKey, err)
+
+	stats := cache.Stats()
+	assert.True(t, stats.Hits > 0)
+	assert.True(t, stats.Misses > 0)
+	assert.NotEmpty(t, stats.Latency["get"])
+}
+
+func TestMemcachedRing(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	c := newMemcachedCache(MemcachedConfig{Servers: []string{"a:11211", "b:11211", "c:11211"}}, logger)
+	d := newMemcachedCache(MemcachedConfig{Servers: []string{"a:11211", "b:11211"}}, logger)
+
+	// 去掉一台服务器后，原本不在该服务器上的键不迁移
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("book:%d", i)
+		from, to := c.pick(key).addr, d.pick(key).addr
+		if from != "c:11211" && from != to {
+			moved++
+		}
+	}
+	assert.Equal(t, 0, moved)
+
+	_, err := newMemcachedCache(MemcachedConfig{}, logger).Get(context.Background(), "key")
+	assert.Equal(t, ErrMemcachedNoServers, err)
+}
+
+// fakeMemcached 进程内的 memcached，支持 get、set、add、delete、touch 以及 mg、ms 的部分标志
+type fakeMemcached struct {
+	addr  string
+	mu    sync.Mutex
+	items map[string]*fakeMemcachedItem
+	cas   uint64
+}
+
+type fakeMemcachedItem struct {
+	value    []byte
+	cas      uint64
+	expireAt time.Time
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	s := &fakeMemcached{addr: ln.Addr().String(), items: make(map[string]*fakeMemcachedItem)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeMemcached) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
+
+func (s *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) < 2 {
+			_, _ = w.WriteString("ERROR\r\n")
+			_ = w.Flush()
+			continue
+		}
+
+		var data []byte
+		switch args[0] {
+		case "set", "add", "ms":
+			// set <key> <flags> <exptime> <bytes>，ms <key> <datalen> <flags>*
+			size := args[len(args)-1]
+			if args[0] == "ms" {
+				size = args[2]
+			}
+			n, _ := strconv.Atoi(size)
+			data = make([]byte, n+2)
+			if _, err = io.ReadFull(r, data); err != nil {
+				return
+			}
+			data = data[:n]
+		}
+
+		_, _ = w.WriteString(s.handle(args, data))
+		_ = w.Flush()
+	}
+}
+
+func (s *fakeMemcached) handle(args []string, data []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := args[1]
+	item, ok := s.items[key]
+	if ok && !item.expireAt.IsZero() && !time.Now().Before(item.expireAt) {
+		delete(s.items, key)
+		item, ok = nil, false
+	}
+
+	switch args[0] {
+	case "get":
+		if !ok {
+			return "END\r\n"
+		}
+		return fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\nEND\r\n", key, len(item.value), item.value)
+	case "set", "add":
+		if args[0] == "add" && ok {
+			return "NOT_STORED\r\n"
+		}
+		exptime, _ := strconv.Atoi(args[3])
+		s.store(key, data, exptime)
+		return "STORED\r\n"
+	case "delete":
+		if !ok {
+			return "NOT_FOUND\r\n"
+		}
+		delete(s.items, key)
+		return "DELETED\r\n"
+	case "touch":
+		if !ok {
+			return "NOT_FOUND\r\n"
+		}
+		exptime, _ := strconv.Atoi(args[2])
+		item.expireAt = fakeExpireAt(exptime)
+		return "TOUCHED\r\n"
+	case "mg":
+		if !ok {
+			return "EN\r\n"
+		}
+		var flags []string
+		withValue := false
+		for _, f := range args[2:] {
+			switch f {
+			case "v":
+				withValue = true
+			case "c":
+				flags = append(flags, "c"+strconv.FormatUint(item.cas, 10))
+			case "t":
+				ttl := -1
+				if !item.expireAt.IsZero() {
+					ttl = int(time.Until(item.expireAt).Round(time.Second) / time.Second)
+				}
+				flags = append(flags, "t"+strconv.Itoa(ttl))
+			}
+		}
+		if withValue {
+			return fmt.Sprintf("VA %d %s\r\n%s\r\n", len(item.value), strings.Join(flags, " "), item.value)
+		}
+		return strings.TrimSpace("HD "+strings.Join(flags, " ")) + "\r\n"
+	case "ms":
+		exptime := 0
+		for _, f := range args[3:] {
+			switch {
+			case f == "ME":
+				if ok {
+					return "NS\r\n"
+				}
+			case f[0] == 'C':
+				if !ok {
+					return "NF\r\n"
+				}
+				if cas, _ := strconv.ParseUint(f[1:], 10, 64); cas != item.cas {
+					return "EX\r\n"
+				}
+			case f[0] == 'T':
+				exptime, _ = strconv.Atoi(f[1:])
+			}
+		}
+		s.store(key, data, exptime)
+		return "HD\r\n"
+	}
+
+	return "ERROR\r\n"
+}
+
+func (s *fakeMemcached) store(key string, data []byte, exptime int) {
+	s.cas++
+	s.items[key] = &fakeMemcachedItem{value: data, cas: s.cas, expireAt: fakeExpireAt(exptime)}
+}
+
+func fakeExpireAt(exptime int) time.Time {
+	if exptime <= 0 {
+		return time.Time{}
+	}
+	// 与 memcached 相同，超过 30 天按 unix 时间戳处理
+	if exptime > 30*24*3600 {
+		return time.Unix(int64(exptime), 0)
+	}
+	return time.Now().Add(time.Duration(exptime) * time.Second)
+}
@@ -0,0 +1,445 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+const (
+	defaultMemoryShards = 16
+	// 每个条目在 map、链表中的大致额外开销，单位字节
+	memoryEntryOverhead = 96
+)
+
+type MemoryCacheConfig struct {
+	// 分片数，默认 16
+	Shards int `yaml:"shards"`
+	// 最大条目数，0 表示不限制
+	MaxEntries int `yaml:"maxEntries"`
+	// 最大内存，单位：MB，按值的大小估算，0 表示不限制
+	MaxSizeMB int `yaml:"maxSizeMB"`
+}
+
+// Sizer 由值实现，返回占用内存的字节数，用于 memory 驱动的内存估算
+type Sizer interface {
+	Size() int
+}
+
+// memoryCache 直接保存 Go 值的进程内缓存，没有序列化开销
+// Get 返回的值与 Set 传入的值共享底层数据，调用方不应修改。
+// 每个分片是一个 LRU，条目数或估算内存超出分片配额时淘汰最久未访问的条目。
+type memoryCache struct {
+	shards []*memoryShard
+	logger *log.Logger
+	tags   *tagIndex
+	timing *latencies
+}
+
+type memoryShard struct {
+	mu         sync.Mutex
+	items      map[string]*list.Element
+	lru        *list.List
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+
+	hits        int64
+	misses      int64
+	evictions   int64
+	expirations int64
+}
+
+type memoryEntry struct {
+	key      string
+	value    interface{}
+	expireAt int64 // unix 秒，0 表示永不过期
+	size     int64
+}
+
+func newMemoryCache(cnf MemoryCacheConfig, log *log.Logger) *memoryCache {
+	n := cnf.Shards
+	if n <= 0 {
+		n = defaultMemoryShards
+	}
+
+	c := &memoryCache{
+		shards: make([]*memoryShard, n),
+		logger: log,
+		timing: newLatencies(),
+	}
+	c.tags = newTagIndex(c.exists)
+	for i := range c.shards {
+		c.shards[i] = &memoryShard{
+			items:      make(map[string]*list.Element),
+			lru:        list.New(),
+			maxEntries: ceilDiv(cnf.MaxEntries, n),
+			maxBytes:   int64(ceilDiv(cnf.MaxSizeMB*1024*1024, n)),
+		}
+	}
+
+	return c
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) (interface{}, error) {
+	defer c.trace(ctx, "get", key, time.Now())
+
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.get(key, time.Now().Unix())
+	if e == nil {
+		s.misses++
+		return nil, ErrNotFound
+	}
+	s.hits++
+
+	return e.value, nil
+}
+
+func (c *memoryCache) Set(ctx context.Context, key string, value interface{}, expireSeconds int) error {
+	defer c.trace(ctx, "set", key, time.Now())
+
+	c.tags.remove(key)
+	c.set(key, value, expireSeconds)
+	return nil
+}
+
+func (c *memoryCache) Del(ctx context.Context, key string) error {
+	defer c.trace(ctx, "del", key, time.Now())
+
+	c.tags.remove(key)
+	if !c.del(key) {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (c *memoryCache) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	defer c.trace(ctx, "incr", key, time.Now())
+
+	c.tags.remove(key)
+	return c.incr(key, delta)
+}
+
+func (c *memoryCache) Decr(ctx context.Context, key string, delta int64) (int64, error) {
+	defer c.trace(ctx, "decr", key, time.Now())
+
+	c.tags.remove(key)
+	return c.incr(key, -delta)
+}
+
+func (c *memoryCache) SetNX(ctx context.Context, key string, value interface{}, expireSeconds int) (bool, error) {
+	defer c.trace(ctx, "setnx", key, time.Now())
+
+	now := time.Now().Unix()
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.get(key, now) != nil {
+		return false, nil
+	}
+	s.set(key, value, expireAt(now, expireSeconds))
+
+	return true, nil
+}
+
+func (c *memoryCache) TTL(ctx context.Context, key string) (int, error) {
+	defer c.trace(ctx, "ttl", key, time.Now())
+
+	now := time.Now().Unix()
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.peek(key, now)
+	if e == nil {
+		return 0, ErrNotFound
+	}
+	if e.expireAt == 0 {
+		return 0, nil
+	}
+
+	return int(e.expireAt - now), nil
+}
+
+func (c *memoryCache) Touch(ctx context.Context, key string, expireSeconds int) error {
+	defer c.trace(ctx, "touch", key, time.Now())
+
+	now := time.Now().Unix()
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.peek(key, now)
+	if e == nil {
+		return ErrNotFound
+	}
+	e.expireAt = expireAt(now, expireSeconds)
+
+	return nil
+}
+
+func (c *memoryCache) SetWithTags(ctx context.Context, key string, value interface{}, expireSeconds int, tags ...string) error {
+	defer c.trace(ctx, "setwithtags", key, time.Now())
+
+	return c.tags.set(key, tags, func() error {
+		c.set(key, value, expireSeconds)
+		return nil
+	})
+}
+
+func (c *memoryCache) InvalidateTags(ctx context.Context, tags ...string) error {
+	defer c.trace(ctx, "invalidatetags", strings.Join(tags, ","), time.Now())
+
+	c.tags.invalidate(tags, func(key string) {
+		c.del(key)
+	})
+
+	return nil
+}
+
+func (c *memoryCache) Stats() Stats {
+	stats := Stats{Latency: c.timing.snapshot()}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Hits += s.hits
+		stats.Misses += s.misses
+		stats.Entries += int64(len(s.items))
+		stats.Evictions += s.evictions
+		stats.Expirations += s.expirations
+		stats.BytesUsed += s.bytes
+		s.mu.Unlock()
+	}
+	stats.HitRate = hitRate(stats.Hits, stats.Misses)
+
+	return stats
+}
+
+func (c *memoryCache) trace(ctx context.Context, cmd, key string, start time.Time) {
+	c.timing.trace(ctx, c.logger, cmd, key, start)
+}
+
+// rangeEntries 快照时将值编码后输出，无法编码的值跳过
+func (c *memoryCache) rangeEntries(fn func(key, value []byte, expireAt int64) error) error {
+	now := time.Now().Unix()
+	for _, s := range c.shards {
+		s.mu.Lock()
+		entries := make([]memoryEntry, 0, len(s.items))
+		for el := s.lru.Front(); el != nil; el = el.Next() {
+			e := el.Value.(*memoryEntry)
+			if e.expireAt == 0 || e.expireAt > now {
+				entries = append(entries, *e)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, e := range entries {
+			valueBytes, err := serialize(e.value)
+			if err != nil {
+				continue
+			}
+			if err = fn([]byte(e.key), valueBytes, e.expireAt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *memoryCache) loadEntry(key, value []byte, expireSeconds int) error {
+	v, err := deserialize(value)
+	if err != nil {
+		return err
+	}
+
+	c.set(string(key), v, expireSeconds)
+	return nil
+}
+
+func (c *memoryCache) set(key string, value interface{}, expireSeconds int) {
+	s := c.shard(key)
+	s.mu.Lock()
+	s.set(key, value, expireAt(time.Now().Unix(), expireSeconds))
+	s.mu.Unlock()
+}
+
+func (c *memoryCache) del(key string) bool {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	s.remove(el)
+
+	return true
+}
+
+func (c *memoryCache) incr(key string, delta int64) (int64, error) {
+	now := time.Now().Unix()
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.peek(key, now)
+	if e == nil {
+		s.set(key, delta, 0)
+		return delta, nil
+	}
+
+	n, ok := e.value.(int64)
+	if !ok {
+		return 0, ErrNotCounter
+	}
+	e.value = n + delta
+
+	return n + delta, nil
+}
+
+// exists 供标签索引清理使用，不计入命中统计
+func (c *memoryCache) exists(key string) bool {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.peek(key, time.Now().Unix()) != nil
+}
+
+func (c *memoryCache) shard(key string) *memoryShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// get 查找未过期的条目并移到 LRU 头部，调用方持有锁
+func (s *memoryShard) get(key string, now int64) *memoryEntry {
+	e := s.peek(key, now)
+	if e != nil {
+		s.lru.MoveToFront(s.items[key])
+	}
+	return e
+}
+
+// peek 查找未过期的条目，不改变 LRU 顺序，过期条目在此删除
+func (s *memoryShard) peek(key string, now int64) *memoryEntry {
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+
+	e := el.Value.(*memoryEntry)
+	if e.expireAt != 0 && e.expireAt <= now {
+		s.remove(el)
+		s.expirations++
+		return nil
+	}
+
+	return e
+}
+
+func (s *memoryShard) set(key string, value interface{}, expireAt int64) {
+	size := int64(len(key)) + memoryEntryOverhead + sizeOf(value)
+	if el, ok := s.items[key]; ok {
+		e := el.Value.(*memoryEntry)
+		s.bytes += size - e.size
+		e.value, e.expireAt, e.size = value, expireAt, size
+		s.lru.MoveToFront(el)
+	} else {
+		s.items[key] = s.lru.PushFront(&memoryEntry{
+			key:      key,
+			value:    value,
+			expireAt: expireAt,
+			size:     size,
+		})
+		s.bytes += size
+	}
+
+	s.evict()
+}
+
+// evict 淘汰最久未访问的条目直到满足配额，至少保留刚写入的条目
+func (s *memoryShard) evict() {
+	for s.lru.Len() > 1 &&
+		((s.maxEntries > 0 && s.lru.Len() > s.maxEntries) || (s.maxBytes > 0 && s.bytes > s.maxBytes)) {
+		s.remove(s.lru.Back())
+		s.evictions++
+	}
+}
+
+func (s *memoryShard) remove(el *list.Element) {
+	e := el.Value.(*memoryEntry)
+	s.lru.Remove(el)
+	delete(s.items, e.key)
+	s.bytes -= e.size
+}
+
+func expireAt(now int64, expireSeconds int) int64 {
+	if expireSeconds <= 0 {
+		return 0
+	}
+	return now + int64(expireSeconds)
+}
+
+func ceilDiv(a, b int) int {
+	if a <= 0 {
+		return 0
+	}
+	return (a + b - 1) / b
+}
+
+// sizeOf 估算值占用的内存，只计算顶层以及一层字符串、切片字段
+func sizeOf(value interface{}) int64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case Sizer:
+		return int64(v.Size())
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	}
+
+	rv := reflect.ValueOf(value)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return int64(rv.Type().Size())
+		}
+		rv = rv.Elem()
+	}
+
+	size := int64(rv.Type().Size())
+	switch rv.Kind() {
+	case reflect.String:
+		size += int64(rv.Len())
+	case reflect.Slice:
+		size += int64(rv.Len()) * int64(rv.Type().Elem().Size())
+	case reflect.Map:
+		size += int64(rv.Len()) * int64(rv.Type().Key().Size()+rv.Type().Elem().Size())
+	case reflect.Struct:
+		for i := 0; i < rv.NumField(); i++ {
+			f := rv.Field(i)
+			switch f.Kind() {
+			case reflect.String:
+				size += int64(f.Len())
+			case reflect.Slice:
+				size += int64(f.Len()) * int64(f.Type().Elem().Size())
+			}
+		}
+	}
+
+	return size
+}
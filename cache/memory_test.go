@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestMemoryCache(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx := hctx.GetContext(context.Background(), "")
+	cache := NewCache(Config{Driver: DriverMemory, Memory: MemoryCacheConfig{Shards: 1, MaxEntries: 3}}, logger)
+
+	// 直接保存值，不经过序列化
+	value := &FreeCacheConfig{CacheSizeMB: 1}
+	assert.Nil(t, cache.Set(ctx, "config", value, 60))
+	val, err := cache.Get(ctx, "config")
+	assert.Nil(t, err)
+	assert.True(t, val == value)
+
+	testCounter(t, ctx, cache)
+	testTags(t, ctx, cache)
+
+	// LRU 淘汰
+	lru := NewCache(Config{Driver: DriverMemory, Memory: MemoryCacheConfig{Shards: 1, MaxEntries: 3}}, logger)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, lru.Set(ctx, fmt.Sprintf("book:%d", i), i, 60))
+	}
+	_, err = lru.Get(ctx, "book:0")
+	assert.Nil(t, err)
+	assert.Nil(t, lru.Set(ctx, "book:3", 3, 60))
+	_, err = lru.Get(ctx, "book:1")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = lru.Get(ctx, "book:0")
+	assert.Nil(t, err)
+
+	stats := lru.Stats()
+	assert.Equal(t, int64(3), stats.Entries)
+	assert.Equal(t, int64(1), stats.Evictions)
+	assert.Equal(t, int64(2), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.True(t, stats.BytesUsed > 0)
+
+	// 内存配额
+	small := NewCache(Config{Driver: DriverMemory, Memory: MemoryCacheConfig{Shards: 1, MaxSizeMB: 1}}, logger)
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, small.Set(ctx, fmt.Sprintf("chapter:%d", i), make([]byte, 300*1024), 60))
+	}
+	assert.Equal(t, int64(3), small.Stats().Entries)
+
+	// 快照
+	buf := bytes.Buffer{}
+	n, err := Dump(ctx, lru, &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	restored := NewCache(Config{Driver: DriverMemory}, logger)
+	n, err = Load(ctx, restored, &buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	val, err = restored.Get(ctx, "book:3")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, val)
+}
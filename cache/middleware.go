@@ -0,0 +1,407 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+var (
+	// ErrReadOnly 只读模式下拒绝写操作
+	ErrReadOnly = errors.New("cache: read only")
+	// ErrCircuitOpen 熔断器打开，直接失败
+	ErrCircuitOpen = errors.New("cache: circuit breaker open")
+)
+
+// Interceptor 拦截一次缓存操作，op 为操作名（get、set 等），call 执行下一层
+type Interceptor func(ctx context.Context, op, key string, call func(ctx context.Context) error) error
+
+// Middleware 包装一个 Cache
+type Middleware func(Cache) Cache
+
+// Chain 依次用 mws 包装 c，mws[0] 位于最外层
+func Chain(c Cache, mws ...Middleware) Cache {
+	for i := len(mws) - 1; i >= 0; i-- {
+		c = mws[i](c)
+	}
+	return c
+}
+
+// Intercept 将 Interceptor 转换为 Middleware
+func Intercept(ic Interceptor) Middleware {
+	return func(c Cache) Cache {
+		return &decorated{Cache: c, intercept: ic}
+	}
+}
+
+type MiddlewareConfig struct {
+	// 日志，为空时不记录
+	Logging *LoggingConfig `yaml:"logging"`
+	// 记录各操作的耗时和错误数，通过 Stats 输出
+	Metrics bool `yaml:"metrics"`
+	// 热点键统计和 L1 提升，为空时不启用
+	HotKeys *HotKeyConfig `yaml:"hotKeys"`
+	// 单次操作超时时间，0 表示不限制
+	Timeout time.Duration `yaml:"timeout"`
+	// 熔断，为空时不启用
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuitBreaker"`
+	// 只读模式，拒绝所有写操作
+	ReadOnly bool `yaml:"readOnly"`
+}
+
+// Middlewares 按配置组装中间件，由外到内依次为日志、统计、热点键、只读、熔断、超时
+func (cnf MiddlewareConfig) Middlewares(logger *log.Logger) []Middleware {
+	var mws []Middleware
+	if cnf.Logging != nil {
+		mws = append(mws, WithLogging(logger, *cnf.Logging))
+	}
+	if cnf.Metrics {
+		mws = append(mws, WithMetrics())
+	}
+	if cnf.HotKeys != nil {
+		mws = append(mws, WithHotKeys(logger, *cnf.HotKeys))
+	}
+	if cnf.ReadOnly {
+		mws = append(mws, ReadOnly())
+	}
+	if cnf.CircuitBreaker != nil {
+		mws = append(mws, WithCircuitBreaker(*cnf.CircuitBreaker))
+	}
+	if cnf.Timeout > 0 {
+		mws = append(mws, WithTimeout(cnf.Timeout))
+	}
+	return mws
+}
+
+type LoggingConfig struct {
+	// 正常操作的采样比例，0 表示不记录，1 表示全部记录
+	SampleRate float64 `yaml:"sampleRate"`
+	// 超过该耗时的操作以 Warn 级别记录，0 表示不区分
+	SlowThreshold time.Duration `yaml:"slowThreshold"`
+}
+
+// WithLogging 慢操作记录 Warn，失败记录 Error，其余按比例采样记录 Info
+func WithLogging(logger *log.Logger, cnf LoggingConfig) Middleware {
+	return Intercept(func(ctx context.Context, op, key string, call func(ctx context.Context) error) error {
+		start := time.Now()
+		err := call(ctx)
+		use := time.Since(start)
+
+		fields := []log.Field{
+			log.String("cmd", op),
+			log.String("key", key),
+			log.Duration("time", use),
+		}
+		switch {
+		case isFailure(err):
+			logger.Error(ctx, "Cache", append(fields, log.ErrorType("err", err))...)
+		case cnf.SlowThreshold > 0 && use >= cnf.SlowThreshold:
+			logger.Warn(ctx, "Cache slow", fields...)
+		case cnf.SampleRate >= 1 || (cnf.SampleRate > 0 && rand.Float64() < cnf.SampleRate):
+			logger.Info(ctx, "Cache", fields...)
+		}
+
+		return err
+	})
+}
+
+// WithMetrics 在包装层记录各操作耗时和失败次数，Stats 的 Latency、Errors 取自包装层
+func WithMetrics() Middleware {
+	return func(c Cache) Cache {
+		m := &metricsCache{
+			timing: newLatencies(),
+			errors: make(map[string]*int64),
+		}
+		m.decorated = decorated{Cache: c, intercept: m.intercept}
+		return m
+	}
+}
+
+// WithTimeout 为每次操作设置超时，依赖后端响应 ctx；进程内缓存不会阻塞，超时只对远程后端生效
+func WithTimeout(timeout time.Duration) Middleware {
+	return Intercept(func(ctx context.Context, op, key string, call func(ctx context.Context) error) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		err := call(ctx)
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return err
+	})
+}
+
+// ReadOnly 拒绝所有写操作
+func ReadOnly() Middleware {
+	return Intercept(func(ctx context.Context, op, key string, call func(ctx context.Context) error) error {
+		if isWriteOp(op) {
+			return ErrReadOnly
+		}
+		return call(ctx)
+	})
+}
+
+type CircuitBreakerConfig struct {
+	// 连续失败多少次后熔断，默认 5
+	FailureThreshold int `yaml:"failureThreshold"`
+	// 熔断持续时间，之后放行一次试探请求，默认 10s
+	OpenTimeout time.Duration `yaml:"openTimeout"`
+}
+
+// WithCircuitBreaker 后端连续失败时熔断，熔断期间直接返回 ErrCircuitOpen
+// ErrNotFound 等业务结果不计为失败
+func WithCircuitBreaker(cnf CircuitBreakerConfig) Middleware {
+	if cnf.FailureThreshold <= 0 {
+		cnf.FailureThreshold = 5
+	}
+	if cnf.OpenTimeout <= 0 {
+		cnf.OpenTimeout = 10 * time.Second
+	}
+
+	b := &breaker{cnf: cnf}
+	return Intercept(func(ctx context.Context, op, key string, call func(ctx context.Context) error) error {
+		if !b.allow() {
+			return ErrCircuitOpen
+		}
+
+		err := call(ctx)
+		b.done(isFailure(err))
+		return err
+	})
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type breaker struct {
+	cnf      CircuitBreakerConfig
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cnf.OpenTimeout {
+			return false
+		}
+		// 放行一次试探请求
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+func (b *breaker) done(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.state, b.failures = breakerClosed, 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.cnf.FailureThreshold {
+		b.state, b.openedAt = breakerOpen, time.Now()
+	}
+}
+
+// isFailure 判断是否为后端故障，未命中等正常结果不算
+func isFailure(err error) bool {
+	switch err {
+	case nil, ErrNotFound, ErrNotCounter, ErrTagsNotSupported, ErrReadOnly, ErrCircuitOpen, context.Canceled:
+		return false
+	}
+	return true
+}
+
+func isWriteOp(op string) bool {
+	switch op {
+	case "get", "ttl":
+		return false
+	}
+	return true
+}
+
+type metricsCache struct {
+	decorated
+	timing *latencies
+	mu     sync.RWMutex
+	errors map[string]*int64
+}
+
+func (m *metricsCache) intercept(ctx context.Context, op, key string, call func(ctx context.Context) error) error {
+	start := time.Now()
+	err := call(ctx)
+	m.timing.observe(op, time.Since(start))
+
+	if isFailure(err) {
+		m.mu.RLock()
+		n, ok := m.errors[op]
+		m.mu.RUnlock()
+		if !ok {
+			m.mu.Lock()
+			if n, ok = m.errors[op]; !ok {
+				n = new(int64)
+				m.errors[op] = n
+			}
+			m.mu.Unlock()
+		}
+		atomic.AddInt64(n, 1)
+	}
+
+	return err
+}
+
+func (m *metricsCache) Stats() Stats {
+	stats := m.Cache.Stats()
+	stats.Latency = m.timing.snapshot()
+
+	m.mu.RLock()
+	stats.Errors = make(map[string]int64, len(m.errors))
+	for op, n := range m.errors {
+		stats.Errors[op] = atomic.LoadInt64(n)
+	}
+	m.mu.RUnlock()
+
+	return stats
+}
+
+// decorated 将所有操作交给 intercept 处理
+type decorated struct {
+	Cache
+	intercept Interceptor
+}
+
+func (d *decorated) Get(ctx context.Context, key string) (value interface{}, err error) {
+	err = d.intercept(ctx, "get", key, func(ctx context.Context) (err error) {
+		value, err = d.Cache.Get(ctx, key)
+		return err
+	})
+	return value, err
+}
+
+func (d *decorated) Set(ctx context.Context, key string, value interface{}, expireSeconds int) error {
+	return d.intercept(ctx, "set", key, func(ctx context.Context) error {
+		return d.Cache.Set(ctx, key, value, expireSeconds)
+	})
+}
+
+func (d *decorated) Del(ctx context.Context, key string) error {
+	return d.intercept(ctx, "del", key, func(ctx context.Context) error {
+		return d.Cache.Del(ctx, key)
+	})
+}
+
+func (d *decorated) Incr(ctx context.Context, key string, delta int64) (n int64, err error) {
+	err = d.intercept(ctx, "incr", key, func(ctx context.Context) (err error) {
+		n, err = d.Cache.Incr(ctx, key, delta)
+		return err
+	})
+	return n, err
+}
+
+func (d *decorated) Decr(ctx context.Context, key string, delta int64) (n int64, err error) {
+	err = d.intercept(ctx, "decr", key, func(ctx context.Context) (err error) {
+		n, err = d.Cache.Decr(ctx, key, delta)
+		return err
+	})
+	return n, err
+}
+
+func (d *decorated) SetNX(ctx context.Context, key string, value interface{}, expireSeconds int) (ok bool, err error) {
+	err = d.intercept(ctx, "setnx", key, func(ctx context.Context) (err error) {
+		ok, err = d.Cache.SetNX(ctx, key, value, expireSeconds)
+		return err
+	})
+	return ok, err
+}
+
+func (d *decorated) TTL(ctx context.Context, key string) (ttl int, err error) {
+	err = d.intercept(ctx, "ttl", key, func(ctx context.Context) (err error) {
+		ttl, err = d.Cache.TTL(ctx, key)
+		return err
+	})
+	return ttl, err
+}
+
+func (d *decorated) Touch(ctx context.Context, key string, expireSeconds int) error {
+	return d.intercept(ctx, "touch", key, func(ctx context.Context) error {
+		return d.Cache.Touch(ctx, key, expireSeconds)
+	})
+}
+
+func (d *decorated) SetWithTags(ctx context.Context, key string, value interface{}, expireSeconds int, tags ...string) error {
+	return d.intercept(ctx, "setwithtags", key, func(ctx context.Context) error {
+		return SetWithTags(ctx, d.Cache, key, value, expireSeconds, tags...)
+	})
+}
+
+func (d *decorated) InvalidateTags(ctx context.Context, tags ...string) error {
+	return d.intercept(ctx, "invalidatetags", strings.Join(tags, ","), func(ctx context.Context) error {
+		return InvalidateTags(ctx, d.Cache, tags...)
+	})
+}
+
+// InvalidateNamespace 内层需要自行处理命名空间失效（如广播）时交给内层，否则经过本层的 Get、Incr 完成
+func (d *decorated) InvalidateNamespace(ctx context.Context, name string) error {
+	inv, ok := d.Cache.(namespaceInvalidator)
+	if !ok {
+		return bumpGeneration(ctx, d, name)
+	}
+
+	return d.intercept(ctx, "invalidatenamespace", name, func(ctx context.Context) error {
+		return inv.InvalidateNamespace(ctx, name)
+	})
+}
+
+// DelNamespaced 内层需要广播命名空间内的删除时交给内层，否则按普通 Del 处理
+func (d *decorated) DelNamespaced(ctx context.Context, name, key string) error {
+	del, ok := d.Cache.(namespaceDeleter)
+	if !ok {
+		return d.Del(ctx, key)
+	}
+
+	return d.intercept(ctx, "del", key, func(ctx context.Context) error {
+		return del.DelNamespaced(ctx, name, key)
+	})
+}
+
+// 快照直接访问内层
+func (d *decorated) rangeEntries(fn func(key, value []byte, expireAt int64) error) error {
+	s, ok := d.Cache.(snapshotter)
+	if !ok {
+		return ErrSnapshotNotSupported
+	}
+	return s.rangeEntries(fn)
+}
+
+func (d *decorated) loadEntry(key, value []byte, expireSeconds int) error {
+	s, ok := d.Cache.(snapshotter)
+	if !ok {
+		return ErrSnapshotNotSupported
+	}
+	return s.loadEntry(key, value, expireSeconds)
+}
+
+// 旧版 freecache 统计直接访问内层
+func (d *decorated) freeCacheStats() (FreeCacheStats, bool) {
+	return FreeCacheStatsOf(d.Cache)
+}
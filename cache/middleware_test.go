@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+var errBackend = errors.New("backend down")
+
+// flakyCache Get 在 fail 为 true 时失败，或阻塞到 ctx 结束
+type flakyCache struct {
+	Cache
+	fail  bool
+	block bool
+}
+
+func (c *flakyCache) Get(ctx context.Context, key string) (interface{}, error) {
+	if c.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if c.fail {
+		return nil, errBackend
+	}
+	return c.Cache.Get(ctx, key)
+}
+
+func newTestMemoryCache() Cache {
+	return NewCache(Config{Driver: DriverMemory}, log.New(os.Stdout, log.InfoLevel))
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	inner := newTestMemoryCache()
+	assert.Nil(t, inner.Set(ctx, "book:42", "hachi", 60))
+
+	c := Chain(inner, ReadOnly())
+	assert.Equal(t, ErrReadOnly, c.Set(ctx, "book:42", "hachi2", 60))
+	assert.Equal(t, ErrReadOnly, c.Del(ctx, "book:42"))
+	_, err := c.Incr(ctx, "views", 1)
+	assert.Equal(t, ErrReadOnly, err)
+	val, err := c.Get(ctx, "book:42")
+	assert.Nil(t, err)
+	assert.Equal(t, "hachi", val)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	flaky := &flakyCache{Cache: newTestMemoryCache(), fail: true}
+	c := Chain(flaky, WithMetrics(), WithCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: 50 * time.Millisecond}))
+
+	// 未命中不计为失败
+	flaky.fail = false
+	for i := 0; i < 3; i++ {
+		_, err := c.Get(ctx, "missing")
+		assert.Equal(t, ErrNotFound, err)
+	}
+
+	flaky.fail = true
+	for i := 0; i < 2; i++ {
+		_, err := c.Get(ctx, "book:42")
+		assert.Equal(t, errBackend, err)
+	}
+	_, err := c.Get(ctx, "book:42")
+	assert.Equal(t, ErrCircuitOpen, err)
+
+	// 试探失败后重新熔断
+	time.Sleep(60 * time.Millisecond)
+	_, err = c.Get(ctx, "book:42")
+	assert.Equal(t, errBackend, err)
+	_, err = c.Get(ctx, "book:42")
+	assert.Equal(t, ErrCircuitOpen, err)
+
+	// 试探成功后恢复
+	time.Sleep(60 * time.Millisecond)
+	flaky.fail = false
+	_, err = c.Get(ctx, "book:42")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = c.Get(ctx, "book:42")
+	assert.Equal(t, ErrNotFound, err)
+
+	stats := c.Stats()
+	assert.Equal(t, int64(3), stats.Errors["get"])
+	assert.Equal(t, uint64(10), stats.Latency["get"].Count)
+}
+
+func TestCircuitBreakerDelMiss(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	for _, driver := range []string{DriverFreeCache, DriverMemory} {
+		inner := NewCache(Config{Driver: driver, Cache: FreeCacheConfig{CacheSizeMB: 1, GCPercent: 100}}, log.New(os.Stdout, log.InfoLevel))
+		c := Chain(inner, WithMetrics(), WithCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 3, OpenTimeout: time.Minute}))
+
+		// 删除不存在的键不计为失败
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, ErrNotFound, c.Del(ctx, "missing"), driver)
+		}
+		_, err := c.Get(ctx, "missing")
+		assert.Equal(t, ErrNotFound, err, driver)
+		assert.Equal(t, int64(0), c.Stats().Errors["del"], driver)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	c := Chain(&flakyCache{Cache: newTestMemoryCache(), block: true}, WithTimeout(20*time.Millisecond))
+
+	start := time.Now()
+	_, err := c.Get(ctx, "book:42")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestLogging(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, log.InfoLevel)
+	flaky := &flakyCache{Cache: newTestMemoryCache()}
+	c := Chain(flaky, WithLogging(logger, LoggingConfig{SampleRate: 0}))
+
+	assert.Nil(t, c.Set(ctx, "book:42", "hachi", 60))
+	_, _ = c.Get(ctx, "book:42")
+	assert.Equal(t, "", buf.String())
+
+	flaky.fail = true
+	_, _ = c.Get(ctx, "book:42")
+	assert.True(t, strings.Contains(buf.String(), `"level":"error"`))
+	assert.True(t, strings.Contains(buf.String(), "backend down"))
+
+	buf.Reset()
+	c = Chain(newTestMemoryCache(), WithLogging(logger, LoggingConfig{SampleRate: 1}))
+	_, _ = c.Get(ctx, "book:42")
+	assert.True(t, strings.Contains(buf.String(), `"cmd":"get"`))
+}
+
+func TestMiddlewareConfig(t *testing.T) {
+	dir, _ := os.Getwd()
+	config, err := ConfigWithPath(dir + "/cache_config_sample.yml")
+	assert.Nil(t, err)
+	assert.Equal(t, 100*time.Millisecond, config.Middleware.Timeout)
+	assert.Equal(t, 10*time.Millisecond, config.Middleware.Logging.SlowThreshold)
+	assert.Equal(t, 5, len(config.Middleware.Middlewares(log.Default())))
+
+	// 中间件保留标签和命名空间能力
+	ctx := hctx.GetContext(context.Background(), "")
+	c := NewCache(Config{Driver: DriverMemory, Middleware: config.Middleware}, log.Default())
+	testTags(t, ctx, c)
+	ns := Namespace(c, "book")
+	assert.Nil(t, ns.Set(ctx, "title", "hachi", 60))
+	assert.Nil(t, ns.InvalidateNamespace(ctx))
+	_, err = ns.Get(ctx, "title")
+	assert.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,271 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 本地缓存 generation 的默认时间
+const defaultGenerationTTL = time.Second
+
+// namespaceEpochs 命名空间名 => 本进程内 generation 被加一的次数
+// 本进程内的失效（包括收到广播）立即使各 NamespaceCache 本地缓存的 generation 过期。
+var namespaceEpochs sync.Map
+
+func namespaceEpoch(name string) *int64 {
+	v, _ := namespaceEpochs.LoadOrStore(name, new(int64))
+	return v.(*int64)
+}
+
+// NamespaceCache 带命名空间的缓存
+// 实际写入的键为 "ns:{name}:{generation}:{key}"，InvalidateNamespace 将 generation 加一，
+// 旧 generation 下的键不再可见，等待过期或被驱逐。
+// generation 在本地缓存 GenerationTTL，其他进程不经广播的失效最多延迟这么久可见。
+type NamespaceCache struct {
+	cache  Cache
+	store  Cache
+	name   string
+	prefix string
+	ttl    time.Duration
+	epoch  *int64
+	cached atomic.Value // *cachedGeneration
+}
+
+type cachedGeneration struct {
+	gen     int64
+	epoch   int64
+	expires time.Time
+}
+
+type NamespaceOption func(*NamespaceCache)
+
+// WithGenerationStore 指定保存 generation 的缓存，默认与数据使用同一个缓存
+// 数据在本地 freecache、generation 在 redis 时，所有实例看到同一个 generation
+func WithGenerationStore(store Cache) NamespaceOption {
+	return func(n *NamespaceCache) {
+		n.store = store
+	}
+}
+
+// WithGenerationTTL 本地缓存 generation 的时间，默认 1s，0 表示每次操作都从存储读取
+func WithGenerationTTL(ttl time.Duration) NamespaceOption {
+	return func(n *NamespaceCache) {
+		n.ttl = ttl
+	}
+}
+
+// Namespace 返回名为 name 的命名空间缓存
+func Namespace(c Cache, name string, opts ...NamespaceOption) *NamespaceCache {
+	n := &NamespaceCache{
+		cache:  c,
+		store:  c,
+		name:   name,
+		prefix: namespacePrefix(name),
+		ttl:    defaultGenerationTTL,
+		epoch:  namespaceEpoch(name),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+
+	return n
+}
+
+// Name 返回命名空间名称
+func (n *NamespaceCache) Name() string {
+	return n.name
+}
+
+// InvalidateNamespace 使命名空间内的所有键同时失效
+func (n *NamespaceCache) InvalidateNamespace(ctx context.Context) error {
+	// 存储层自己负责失效（例如需要广播给其他实例）时交给存储层处理
+	if inv, ok := n.store.(namespaceInvalidator); ok {
+		return inv.InvalidateNamespace(ctx, n.name)
+	}
+
+	return bumpGeneration(ctx, n.store, n.name)
+}
+
+func (n *NamespaceCache) Get(ctx context.Context, key string) (interface{}, error) {
+	k, err := n.key(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return n.cache.Get(ctx, k)
+}
+
+func (n *NamespaceCache) Set(ctx context.Context, key string, value interface{}, expireSeconds int) error {
+	k, err := n.key(ctx, key)
+	if err != nil {
+		return err
+	}
+	return n.cache.Set(ctx, k, value, expireSeconds)
+}
+
+func (n *NamespaceCache) Del(ctx context.Context, key string) error {
+	k, err := n.key(ctx, key)
+	if err != nil {
+		return err
+	}
+	// 需要广播删除时交给数据缓存，其他实例按各自的 generation 删除
+	if del, ok := n.cache.(namespaceDeleter); ok {
+		return del.DelNamespaced(ctx, n.name, k)
+	}
+	return n.cache.Del(ctx, k)
+}
+
+func (n *NamespaceCache) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	k, err := n.key(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return n.cache.Incr(ctx, k, delta)
+}
+
+func (n *NamespaceCache) Decr(ctx context.Context, key string, delta int64) (int64, error) {
+	k, err := n.key(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return n.cache.Decr(ctx, k, delta)
+}
+
+func (n *NamespaceCache) SetNX(ctx context.Context, key string, value interface{}, expireSeconds int) (bool, error) {
+	k, err := n.key(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return n.cache.SetNX(ctx, k, value, expireSeconds)
+}
+
+func (n *NamespaceCache) TTL(ctx context.Context, key string) (int, error) {
+	k, err := n.key(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return n.cache.TTL(ctx, k)
+}
+
+func (n *NamespaceCache) Touch(ctx context.Context, key string, expireSeconds int) error {
+	k, err := n.key(ctx, key)
+	if err != nil {
+		return err
+	}
+	return n.cache.Touch(ctx, k, expireSeconds)
+}
+
+// SetWithTags 标签同样限定在命名空间内，底层缓存不支持标签时返回 ErrTagsNotSupported
+func (n *NamespaceCache) SetWithTags(ctx context.Context, key string, value interface{}, expireSeconds int, tags ...string) error {
+	k, err := n.key(ctx, key)
+	if err != nil {
+		return err
+	}
+	return SetWithTags(ctx, n.cache, k, value, expireSeconds, n.tags(tags)...)
+}
+
+func (n *NamespaceCache) InvalidateTags(ctx context.Context, tags ...string) error {
+	return InvalidateTags(ctx, n.cache, n.tags(tags)...)
+}
+
+func (n *NamespaceCache) Stats() Stats {
+	return n.cache.Stats()
+}
+
+func (n *NamespaceCache) key(ctx context.Context, key string) (string, error) {
+	gen, err := n.generation(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return namespaceKey(n.name, gen, key), nil
+}
+
+// generation 优先使用本地缓存，过期或本进程内失效过时重新读取
+func (n *NamespaceCache) generation(ctx context.Context) (int64, error) {
+	// 先取 epoch 再读取，读取期间发生的失效使这次缓存的结果立即过期
+	epoch := atomic.LoadInt64(n.epoch)
+	if c, ok := n.cached.Load().(*cachedGeneration); ok && c.epoch == epoch && time.Now().Before(c.expires) {
+		return c.gen, nil
+	}
+
+	gen, err := generation(ctx, n.store, n.name)
+	if err != nil {
+		return 0, err
+	}
+	if n.ttl > 0 {
+		n.cached.Store(&cachedGeneration{gen: gen, epoch: epoch, expires: time.Now().Add(n.ttl)})
+	}
+	return gen, nil
+}
+
+func (n *NamespaceCache) tags(tags []string) []string {
+	nsTags := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		nsTags = append(nsTags, n.prefix+tag)
+	}
+	return nsTags
+}
+
+// namespaceInvalidator 由需要自行处理命名空间失效的缓存实现
+type namespaceInvalidator interface {
+	InvalidateNamespace(ctx context.Context, name string) error
+}
+
+// namespaceDeleter 由需要自行处理命名空间内删除的缓存实现
+type namespaceDeleter interface {
+	DelNamespaced(ctx context.Context, name, key string) error
+}
+
+func namespacePrefix(name string) string {
+	return "ns:" + name + ":"
+}
+
+func namespaceKey(name string, gen int64, key string) string {
+	return namespacePrefix(name) + strconv.FormatInt(gen, 10) + ":" + key
+}
+
+func generationKey(name string) string {
+	return namespacePrefix(name) + "gen"
+}
+
+// generation 读取命名空间当前的 generation
+// generation 不存在（首次使用或被驱逐）时以当前纳秒时间初始化，避免重新使用旧 generation 下残留的键
+func generation(ctx context.Context, store Cache, name string) (int64, error) {
+	key := generationKey(name)
+	for i := 0; i < 2; i++ {
+		val, err := store.Get(ctx, key)
+		if err == nil {
+			gen, ok := val.(int64)
+			if !ok {
+				return 0, ErrNotCounter
+			}
+			return gen, nil
+		}
+		if err != ErrNotFound {
+			return 0, err
+		}
+
+		_, err = store.SetNX(ctx, key, time.Now().UnixNano(), 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return 0, ErrNotFound
+}
+
+func bumpGeneration(ctx context.Context, store Cache, name string) error {
+	if _, err := generation(ctx, store, name); err != nil {
+		return err
+	}
+
+	_, err := store.Incr(ctx, generationKey(name), 1)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(namespaceEpoch(name), 1)
+	return nil
+}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestNamespace(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx := hctx.GetContext(context.Background(), "")
+	local := NewCache(Config{Cache: FreeCacheConfig{CacheSizeMB: 1, GCPercent: 100}}, logger)
+	store := NewCache(Config{Driver: DriverRedis, Redis: newTestRedisConfig(t)}, logger)
+
+	book := Namespace(local, "book:42", WithGenerationStore(store))
+	ranking := Namespace(local, "ranking")
+
+	assert.Nil(t, book.Set(ctx, "title", "hachi", 60))
+	assert.Nil(t, ranking.Set(ctx, "title", "top", 60))
+
+	val, err := book.Get(ctx, "title")
+	assert.Nil(t, err)
+	assert.Equal(t, "hachi", val)
+
+	// 不同命名空间互不影响
+	assert.Nil(t, book.InvalidateNamespace(ctx))
+	_, err = book.Get(ctx, "title")
+	assert.Equal(t, ErrNotFound, err)
+	val, err = ranking.Get(ctx, "title")
+	assert.Nil(t, err)
+	assert.Equal(t, "top", val)
+
+	// 另一个实例共享 redis 中的 generation
+	other := Namespace(local, "book:42", WithGenerationStore(store))
+	assert.Nil(t, other.Set(ctx, "title", "hachi2", 60))
+	val, err = book.Get(ctx, "title")
+	assert.Nil(t, err)
+	assert.Equal(t, "hachi2", val)
+
+	assert.Nil(t, ranking.InvalidateNamespace(ctx))
+	_, err = ranking.Get(ctx, "title")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestNamespaceGenerationTTL(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx := hctx.GetContext(context.Background(), "")
+	local := NewCache(Config{Cache: FreeCacheConfig{CacheSizeMB: 1, GCPercent: 100}}, logger)
+	store := NewCache(Config{Driver: DriverRedis, Redis: newTestRedisConfig(t)}, logger)
+
+	cached := Namespace(local, "chapter", WithGenerationStore(store), WithGenerationTTL(time.Hour))
+	uncached := Namespace(local, "chapter", WithGenerationStore(store), WithGenerationTTL(0))
+	assert.Nil(t, cached.Set(ctx, "title", "hachi", 60))
+	gets := store.Stats().Latency["get"].Count
+
+	// 缓存期内不再读取 generation
+	for i := 0; i < 3; i++ {
+		val, err := cached.Get(ctx, "title")
+		assert.Nil(t, err)
+		assert.Equal(t, "hachi", val)
+	}
+	assert.Equal(t, gets, store.Stats().Latency["get"].Count)
+
+	// 其他进程直接修改 generation，缓存期内不可见
+	_, err := store.Incr(ctx, generationKey("chapter"), 1)
+	assert.Nil(t, err)
+	_, err = cached.Get(ctx, "title")
+	assert.Nil(t, err)
+	_, err = uncached.Get(ctx, "title")
+	assert.Equal(t, ErrNotFound, err)
+
+	// 本进程内的失效立即可见
+	assert.Nil(t, uncached.InvalidateNamespace(ctx))
+	_, err = cached.Get(ctx, "title")
+	assert.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,374 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	goRedis "github.com/go-redis/redis/v8"
+)
+
+// Stats 查询 redis 服务端统计的超时时间
+const redisStatsTimeout = time.Second
+
+// 标签以 set 保存，键为 "tag:{tag}"，过期时间不短于其中最晚过期的键
+const redisTagPrefix = "tag:"
+
+// 键的标签以 set 保存，键为 "tags:{key}"，与键同时过期
+// 覆盖或删除键时据此把键从原标签中移除，避免标签 set 无限增长、误删已不带该标签的键。
+const redisKeyTagsPrefix = "tags:"
+
+type redisCache struct {
+	client *db.Redis
+	logger *log.Logger
+	hits   int64
+	misses int64
+	timing *latencies
+}
+
+// NewRedisCache 基于 db.Redis 创建缓存，值的编码与 freecache 相同
+func NewRedisCache(client *db.Redis, log *log.Logger) TagCache {
+	return &redisCache{
+		client: client,
+		logger: log,
+		timing: newLatencies(),
+	}
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) (interface{}, error) {
+	defer c.trace(ctx, "get", key, time.Now())
+
+	valueBytes, err := c.client.Get(ctx, key).Bytes()
+	if err != nil {
+		if err == goRedis.Nil {
+			atomic.AddInt64(&c.misses, 1)
+		}
+		return nil, redisErr(err)
+	}
+	atomic.AddInt64(&c.hits, 1)
+
+	return deserialize(valueBytes)
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value interface{}, expireSeconds int) error {
+	defer c.trace(ctx, "set", key, time.Now())
+
+	valueBytes, err := serialize(value)
+	if err != nil {
+		return err
+	}
+
+	return c.writeUntagged(ctx, key, func(pipe goRedis.Pipeliner) {
+		pipe.Set(ctx, key, valueBytes, expiration(expireSeconds))
+	})
+}
+
+func (c *redisCache) Del(ctx context.Context, key string) error {
+	defer c.trace(ctx, "del", key, time.Now())
+
+	return c.writeUntagged(ctx, key, func(pipe goRedis.Pipeliner) {
+		pipe.Del(ctx, key)
+	})
+}
+
+// writeUntagged 写入或删除键，同时取出并清除键原有的标签
+// 与写入在同一个 pipeline 中，键没有标签时只有一次往返。
+func (c *redisCache) writeUntagged(ctx context.Context, key string, write func(pipe goRedis.Pipeliner)) error {
+	var tags *goRedis.StringSliceCmd
+	_, err := c.client.Pipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		write(pipe)
+		tags = pipe.SMembers(ctx, redisKeyTagsPrefix+key)
+		pipe.Del(ctx, redisKeyTagsPrefix+key)
+		return nil
+	})
+	if err != nil || len(tags.Val()) == 0 {
+		return err
+	}
+
+	_, err = c.client.Pipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		for _, tag := range tags.Val() {
+			pipe.SRem(ctx, redisTagPrefix+tag, key)
+		}
+		return nil
+	})
+	return err
+}
+
+func (c *redisCache) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	defer c.trace(ctx, "incr", key, time.Now())
+
+	return counterResult(c.client.IncrBy(ctx, key, delta).Result())
+}
+
+func (c *redisCache) Decr(ctx context.Context, key string, delta int64) (int64, error) {
+	defer c.trace(ctx, "decr", key, time.Now())
+
+	return counterResult(c.client.DecrBy(ctx, key, delta).Result())
+}
+
+// counterResult 值不是整数时与其他驱动一样返回 ErrNotCounter
+func counterResult(n int64, err error) (int64, error) {
+	if err != nil && strings.HasPrefix(err.Error(), "ERR value is not an integer") {
+		return 0, ErrNotCounter
+	}
+	return n, err
+}
+
+func (c *redisCache) SetNX(ctx context.Context, key string, value interface{}, expireSeconds int) (bool, error) {
+	defer c.trace(ctx, "setnx", key, time.Now())
+
+	valueBytes, err := serialize(value)
+	if err != nil {
+		return false, err
+	}
+
+	return c.client.SetNX(ctx, key, valueBytes, expiration(expireSeconds)).Result()
+}
+
+func (c *redisCache) TTL(ctx context.Context, key string) (int, error) {
+	defer c.trace(ctx, "ttl", key, time.Now())
+
+	ttl, err := c.client.TTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// go-redis 将 -2（键不存在）和 -1（永不过期）原样返回
+	switch ttl {
+	case -2:
+		return 0, ErrNotFound
+	case -1:
+		return 0, nil
+	}
+
+	return int(ttl / time.Second), nil
+}
+
+func (c *redisCache) Touch(ctx context.Context, key string, expireSeconds int) error {
+	defer c.trace(ctx, "touch", key, time.Now())
+
+	var (
+		ok  bool
+		err error
+	)
+	if expireSeconds > 0 {
+		ok, err = c.client.Expire(ctx, key, expiration(expireSeconds)).Result()
+	} else {
+		// PERSIST 对没有过期时间的键同样返回 0，需要额外判断键是否存在
+		var n int64
+		n, err = c.client.Exists(ctx, key).Result()
+		if err == nil && n > 0 {
+			_, err = c.client.Persist(ctx, key).Result()
+			ok = err == nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SetWithTags 键、标签 set 可能位于不同的 slot，逐条命令写入而不使用脚本，集群模式下同样可用
+func (c *redisCache) SetWithTags(ctx context.Context, key string, value interface{}, expireSeconds int, tags ...string) error {
+	if len(tags) == 0 {
+		return c.Set(ctx, key, value, expireSeconds)
+	}
+	defer c.trace(ctx, "setwithtags", key, time.Now())
+
+	valueBytes, err := serialize(value)
+	if err != nil {
+		return err
+	}
+
+	// 先取出原有的标签和各标签 set 的剩余过期时间
+	var old *goRedis.StringSliceCmd
+	ttls := make([]*goRedis.DurationCmd, len(tags))
+	_, err = c.client.Pipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		old = pipe.SMembers(ctx, redisKeyTagsPrefix+key)
+		for i, tag := range tags {
+			ttls[i] = pipe.TTL(ctx, redisTagPrefix+tag)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	exp := expiration(expireSeconds)
+	keep := make(map[string]bool, len(tags))
+	members := make([]interface{}, 0, len(tags))
+	for _, tag := range tags {
+		keep[tag] = true
+		members = append(members, tag)
+	}
+
+	_, err = c.client.Pipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		pipe.Set(ctx, key, valueBytes, exp)
+		pipe.Del(ctx, redisKeyTagsPrefix+key)
+		pipe.SAdd(ctx, redisKeyTagsPrefix+key, members...)
+		if exp > 0 {
+			pipe.Expire(ctx, redisKeyTagsPrefix+key, exp)
+		}
+
+		for _, tag := range old.Val() {
+			if !keep[tag] {
+				pipe.SRem(ctx, redisTagPrefix+tag, key)
+			}
+		}
+		for i, tag := range tags {
+			pipe.SAdd(ctx, redisTagPrefix+tag, key)
+			// 标签 set 不早于其中的键过期，不过期的键使标签 set 也不过期
+			left := ttls[i].Val()
+			if exp <= 0 {
+				pipe.Persist(ctx, redisTagPrefix+tag)
+			} else if left != -1 && left < exp {
+				pipe.Expire(ctx, redisTagPrefix+tag, exp)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// InvalidateTags 删除标签下的键，并把这些键从它们的所有标签中移除
+// 只移除读到的成员而不删除标签 set，失效过程中并发写入的键保留在标签中。
+func (c *redisCache) InvalidateTags(ctx context.Context, tags ...string) error {
+	defer c.trace(ctx, "invalidatetags", strings.Join(tags, ","), time.Now())
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	members := make([]*goRedis.StringSliceCmd, len(tags))
+	_, err := c.client.Pipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		for i, tag := range tags {
+			members[i] = pipe.SMembers(ctx, redisTagPrefix+tag)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	for _, cmd := range members {
+		for _, key := range cmd.Val() {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	keyTags := make([]*goRedis.StringSliceCmd, len(keys))
+	_, err = c.client.Pipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		for i, key := range keys {
+			keyTags[i] = pipe.SMembers(ctx, redisKeyTagsPrefix+key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 逐个键删除，集群模式下由客户端路由到各自的节点
+	_, err = c.client.Pipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		for i, key := range keys {
+			pipe.Del(ctx, key)
+			pipe.Del(ctx, redisKeyTagsPrefix+key)
+			for _, tag := range keyTags[i].Val() {
+				pipe.SRem(ctx, redisTagPrefix+tag, key)
+			}
+		}
+		for i, tag := range tags {
+			if vals := members[i].Val(); len(vals) > 0 {
+				args := make([]interface{}, len(vals))
+				for j, v := range vals {
+					args[j] = v
+				}
+				pipe.SRem(ctx, redisTagPrefix+tag, args...)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Stats 命中统计来自本实例，条目数、驱逐、过期和内存来自 redis 服务端，获取失败时为 0 并记录 Warn
+// Entries 为整个 db 的键数（DBSIZE），与其他数据共用 db 时包括非缓存的键。
+func (c *redisCache) Stats() Stats {
+	hits, misses := atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+	stats := Stats{
+		Hits:    hits,
+		Misses:  misses,
+		HitRate: hitRate(hits, misses),
+		Latency: c.timing.snapshot(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisStatsTimeout)
+	defer cancel()
+
+	n, err := c.client.DBSize(ctx).Result()
+	if err != nil {
+		c.logger.Warn(ctx, "cache redis stats", log.String("cmd", "dbsize"), log.ErrorType("err", err))
+	}
+	stats.Entries = n
+	// redis 7 之前 INFO 只接受一个 section
+	fields := c.info(ctx, "stats")
+	stats.Evictions, _ = strconv.ParseInt(fields["evicted_keys"], 10, 64)
+	stats.Expirations, _ = strconv.ParseInt(fields["expired_keys"], 10, 64)
+	fields = c.info(ctx, "memory")
+	stats.BytesUsed, _ = strconv.ParseInt(fields["used_memory"], 10, 64)
+
+	return stats
+}
+
+func (c *redisCache) info(ctx context.Context, section string) map[string]string {
+	info, err := c.client.Info(ctx, section).Result()
+	if err != nil {
+		c.logger.Warn(ctx, "cache redis stats", log.String("cmd", "info "+section), log.ErrorType("err", err))
+		return nil
+	}
+	return parseRedisInfo(info)
+}
+
+func (c *redisCache) trace(ctx context.Context, cmd, key string, start time.Time) {
+	c.timing.trace(ctx, c.logger, cmd, key, start)
+}
+
+// parseRedisInfo 解析 INFO 命令返回的 "key:value" 行
+func parseRedisInfo(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if i := strings.IndexByte(line, ':'); i > 0 && line[0] != '#' {
+			fields[line[:i]] = line[i+1:]
+		}
+	}
+	return fields
+}
+
+func redisErr(err error) error {
+	if err == goRedis.Nil {
+		return ErrNotFound
+	}
+	return err
+}
+
+func expiration(expireSeconds int) time.Duration {
+	if expireSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(expireSeconds) * time.Second
+}
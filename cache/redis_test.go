@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func newTestRedisConfig(t *testing.T) *db.RedisConfig {
+	s := miniredis.RunT(t)
+	host, port, _ := net.SplitHostPort(s.Addr())
+	p, _ := strconv.Atoi(port)
+	return &db.RedisConfig{Host: host, Port: p, PoolSize: 2}
+}
+
+func TestRedisCache(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx := hctx.GetContext(context.Background(), "")
+	cache := NewCache(Config{Driver: DriverRedis, Redis: newTestRedisConfig(t)}, logger)
+
+	err := cache.Set(ctx, "test_key", FreeCacheConfig{CacheSizeMB: 1}, 60)
+	assert.Nil(t, err)
+	val, err := cache.Get(ctx, "test_key")
+	assert.Nil(t, err)
+	assert.Equal(t, FreeCacheConfig{CacheSizeMB: 1}, val)
+
+	err = cache.Del(ctx, "test_key")
+	assert.Nil(t, err)
+	_, err = cache.Get(ctx, "test_key")
+	assert.Equal(t, ErrNotFound, err)
+
+	testCounter(t, ctx, cache)
+}
+
+func TestRedisCacheTagIndex(t *testing.T) {
+	s := miniredis.RunT(t)
+	host, port, _ := net.SplitHostPort(s.Addr())
+	p, _ := strconv.Atoi(port)
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx := hctx.GetContext(context.Background(), "")
+	cache := NewCache(Config{Driver: DriverRedis, Redis: &db.RedisConfig{Host: host, Port: p}}, logger)
+
+	assert.Nil(t, SetWithTags(ctx, cache, "book:42", "b42", 60, "author:7", "shelf:1"))
+	assert.Nil(t, SetWithTags(ctx, cache, "book:43", "b43", 60, "author:7"))
+	members, _ := s.Members("tag:author:7")
+	assert.Equal(t, []string{"book:42", "book:43"}, members)
+
+	// 重新写入时换掉的标签、不带标签覆盖和删除都会从标签中移除
+	assert.Nil(t, SetWithTags(ctx, cache, "book:42", "b42", 60, "author:7"))
+	assert.False(t, s.Exists("tag:shelf:1"))
+	assert.Nil(t, cache.Set(ctx, "book:43", "b43", 60))
+	assert.Nil(t, cache.Del(ctx, "book:42"))
+	assert.False(t, s.Exists("tag:author:7"))
+	assert.False(t, s.Exists("tags:book:42"))
+
+	// 不再带标签的键不受失效影响
+	assert.Nil(t, InvalidateTags(ctx, cache, "author:7"))
+	val, err := cache.Get(ctx, "book:43")
+	assert.Nil(t, err)
+	assert.Equal(t, "b43", val)
+
+	// 失效时从键的其他标签中移除
+	assert.Nil(t, SetWithTags(ctx, cache, "book:44", "b44", 60, "author:8", "shelf:2"))
+	assert.Nil(t, InvalidateTags(ctx, cache, "author:8"))
+	assert.Equal(t, []string{"book:43"}, s.Keys())
+}
@@ -0,0 +1,249 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+// 快照文件格式（整数均为大端）：
+//
+//	magic "GCSNAP" | version uint16 | 创建时间 int64
+//	条目：1 | keyLen uvarint | key | valueLen uvarint | value | expireAt varint（unix 秒，0 表示永不过期）
+//	结束：0 | 条目数 uint64 | crc32（IEEE，覆盖之前的所有字节）uint32
+const (
+	snapshotMagic   = "GCSNAP"
+	snapshotVersion = 1
+)
+
+var (
+	// ErrSnapshotNotSupported 缓存不支持快照
+	ErrSnapshotNotSupported = errors.New("cache: snapshot not supported")
+	// ErrSnapshotFormat 快照文件格式或版本不正确
+	ErrSnapshotFormat = errors.New("cache: invalid snapshot format")
+	// ErrSnapshotChecksum 快照文件校验失败
+	ErrSnapshotChecksum = errors.New("cache: snapshot checksum mismatch")
+)
+
+// snapshotter 由支持快照的缓存实现，value 为编码后的值
+type snapshotter interface {
+	rangeEntries(fn func(key, value []byte, expireAt int64) error) error
+	loadEntry(key, value []byte, expireSeconds int) error
+}
+
+// Dump 将缓存中未过期的条目及剩余过期时间写入 w，返回写入的条目数
+func Dump(ctx context.Context, c Cache, w io.Writer) (int, error) {
+	s, ok := c.(snapshotter)
+	if !ok {
+		return 0, ErrSnapshotNotSupported
+	}
+
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	var header [len(snapshotMagic) + 2 + 8]byte
+	copy(header[:], snapshotMagic)
+	binary.BigEndian.PutUint16(header[len(snapshotMagic):], snapshotVersion)
+	binary.BigEndian.PutUint64(header[len(snapshotMagic)+2:], uint64(time.Now().Unix()))
+	if _, err := bw.Write(header[:]); err != nil {
+		return 0, err
+	}
+
+	var (
+		n   int
+		buf [binary.MaxVarintLen64]byte
+	)
+	err := s.rangeEntries(func(key, value []byte, expireAt int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		_ = bw.WriteByte(1)
+		_, _ = bw.Write(buf[:binary.PutUvarint(buf[:], uint64(len(key)))])
+		_, _ = bw.Write(key)
+		_, _ = bw.Write(buf[:binary.PutUvarint(buf[:], uint64(len(value)))])
+		_, _ = bw.Write(value)
+		_, err := bw.Write(buf[:binary.PutVarint(buf[:], expireAt)])
+		n++
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+
+	_ = bw.WriteByte(0)
+	binary.BigEndian.PutUint64(buf[:8], uint64(n))
+	_, _ = bw.Write(buf[:8])
+	if err = bw.Flush(); err != nil {
+		return n, err
+	}
+
+	binary.BigEndian.PutUint32(buf[:4], crc.Sum32())
+	_, err = w.Write(buf[:4])
+	return n, err
+}
+
+// Load 从 r 读取快照写入缓存，跳过已过期的条目，maxEntries > 0 时最多写入 maxEntries 条
+// 整个快照校验通过后才开始写入，返回写入的条目数
+func Load(ctx context.Context, c Cache, r io.Reader, maxEntries int) (int, error) {
+	s, ok := c.(snapshotter)
+	if !ok {
+		return 0, ErrSnapshotNotSupported
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	headerLen := len(snapshotMagic) + 2 + 8
+	if len(data) < headerLen+1+8+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, ErrSnapshotFormat
+	}
+	if binary.BigEndian.Uint16(data[len(snapshotMagic):]) != snapshotVersion {
+		return 0, ErrSnapshotFormat
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return 0, ErrSnapshotChecksum
+	}
+
+	now := time.Now().Unix()
+	rd := bytes.NewReader(body[headerLen:])
+	loaded, total := 0, uint64(0)
+	for {
+		if err = ctx.Err(); err != nil {
+			return loaded, err
+		}
+
+		flag, err := rd.ReadByte()
+		if err != nil {
+			return loaded, ErrSnapshotFormat
+		}
+		if flag == 0 {
+			break
+		}
+
+		key, err := readSnapshotBytes(rd)
+		if err != nil {
+			return loaded, err
+		}
+		value, err := readSnapshotBytes(rd)
+		if err != nil {
+			return loaded, err
+		}
+		expireAt, err := binary.ReadVarint(rd)
+		if err != nil {
+			return loaded, ErrSnapshotFormat
+		}
+		total++
+
+		if maxEntries > 0 && loaded >= maxEntries {
+			continue
+		}
+		expireSeconds := 0
+		if expireAt != 0 {
+			if expireAt <= now {
+				continue
+			}
+			expireSeconds = int(expireAt - now)
+		}
+		if err = s.loadEntry(key, value, expireSeconds); err != nil {
+			return loaded, err
+		}
+		loaded++
+	}
+
+	var count [8]byte
+	if _, err = io.ReadFull(rd, count[:]); err != nil || binary.BigEndian.Uint64(count[:]) != total {
+		return loaded, ErrSnapshotFormat
+	}
+
+	return loaded, nil
+}
+
+// DumpFile 将快照写入 path，先写临时文件再重命名，避免留下不完整的快照
+func DumpFile(ctx context.Context, c Cache, path string) (int, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := Dump(ctx, c, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return n, err
+	}
+
+	return n, os.Rename(f.Name(), path)
+}
+
+// LoadFile 从 path 加载快照，文件不存在时返回 0, nil
+func LoadFile(ctx context.Context, c Cache, path string, maxEntries int) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return Load(ctx, c, f, maxEntries)
+}
+
+// DumpPeriodically 每隔 interval 将快照写入 path，ctx 结束（如服务关闭）时再写入一次后返回
+func DumpPeriodically(ctx context.Context, c Cache, path string, interval time.Duration, logger *log.Logger) {
+	dump := func(ctx context.Context) {
+		start := time.Now()
+		n, err := DumpFile(ctx, c, path)
+		if err != nil {
+			logger.Error(ctx, "cache snapshot dump", log.String("path", path), log.ErrorType("err", err))
+			return
+		}
+		logger.Info(ctx, "cache snapshot dump",
+			log.String("path", path),
+			log.Int("entries", n),
+			log.Duration("time", time.Since(start)),
+		)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			dump(context.Background())
+			return
+		case <-ticker.C:
+			dump(ctx)
+		}
+	}
+}
+
+func readSnapshotBytes(rd *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil || n > uint64(rd.Len()) {
+		return nil, ErrSnapshotFormat
+	}
+
+	b := make([]byte, n)
+	_, _ = rd.Read(b)
+	return b, nil
+}
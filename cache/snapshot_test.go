@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestSnapshot(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx := hctx.GetContext(context.Background(), "")
+	newCache := func() Cache {
+		return NewCache(Config{Cache: FreeCacheConfig{CacheSizeMB: 1, GCPercent: 100}}, logger)
+	}
+
+	src := newCache()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, src.Set(ctx, fmt.Sprintf("book:%d", i), fmt.Sprintf("title %d", i), 600))
+	}
+	assert.Nil(t, src.Set(ctx, "forever", "hachi", 0))
+	_, err := src.Incr(ctx, "views", 7)
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	n, err := DumpFile(ctx, src, path)
+	assert.Nil(t, err)
+	assert.Equal(t, 12, n)
+
+	dst := newCache()
+	n, err = LoadFile(ctx, dst, path, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 12, n)
+
+	val, err := dst.Get(ctx, "book:3")
+	assert.Nil(t, err)
+	assert.Equal(t, "title 3", val)
+	val, err = dst.Get(ctx, "views")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), val)
+	ttl, err := dst.TTL(ctx, "book:3")
+	assert.Nil(t, err)
+	assert.True(t, ttl > 590 && ttl <= 600)
+	ttl, err = dst.TTL(ctx, "forever")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, ttl)
+
+	// 限制加载条数
+	n, err = LoadFile(ctx, newCache(), path, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+
+	// 文件不存在
+	n, err = LoadFile(ctx, newCache(), path+".missing", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// 校验失败
+	data, _ := os.ReadFile(path)
+	data[len(data)/2] ^= 0xff
+	_, err = Load(ctx, newCache(), bytes.NewReader(data), 0)
+	assert.Equal(t, ErrSnapshotChecksum, err)
+
+	_, err = Load(ctx, newCache(), bytes.NewReader([]byte("hachi")), 0)
+	assert.Equal(t, ErrSnapshotFormat, err)
+}
@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	"git.zhwenxue.com/zhgo/gocontrib/metrics"
+)
+
+// Stats 各驱动通用的缓存统计
+type Stats struct {
+	// 在缓存中找到键的次数
+	Hits int64 `json:"hits"`
+	// 缓存中发生未命中的次数
+	Misses int64 `json:"misses"`
+	// 命中与查找的比率
+	HitRate float64 `json:"hit_rate"`
+	// 当前缓存中的条目数，redis 为整个 db 的键数
+	Entries int64 `json:"entries"`
+	// 因空间不足被驱逐的次数
+	Evictions int64 `json:"evictions"`
+	// 过期发生的次数
+	Expirations int64 `json:"expirations"`
+	// 占用的内存，单位字节；freecache 启动时预分配，为配置的缓存大小而不是实际使用量
+	BytesUsed int64 `json:"bytes_used"`
+	// 各操作的耗时分布，键为操作名，如 get、set
+	Latency map[string]metrics.HistogramSnapshot `json:"latency"`
+	// 各操作的失败次数，启用 WithMetrics 时才有
+	Errors map[string]int64 `json:"errors,omitempty"`
+	// 访问最多的键，按次数从高到低，启用 WithHotKeys 时才有
+	HotKeys []HotKey `json:"hot_keys,omitempty"`
+}
+
+func hitRate(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// latencies 按操作记录耗时，由各驱动的 trace 调用
+type latencies struct {
+	mu  sync.RWMutex
+	ops map[string]*metrics.Histogram
+}
+
+func newLatencies() *latencies {
+	return &latencies{ops: make(map[string]*metrics.Histogram)}
+}
+
+func (l *latencies) observe(op string, d time.Duration) {
+	l.mu.RLock()
+	h, ok := l.ops[op]
+	l.mu.RUnlock()
+
+	if !ok {
+		l.mu.Lock()
+		if h, ok = l.ops[op]; !ok {
+			h = metrics.NewHistogram(nil)
+			l.ops[op] = h
+		}
+		l.mu.Unlock()
+	}
+
+	h.Observe(d)
+}
+
+// trace 记录一次操作的耗时，各驱动共用的日志策略
+// 缓存操作处于热点路径，这里只记录 Debug；需要按慢操作、失败或采样记录时使用 WithLogging 中间件。
+func (l *latencies) trace(ctx context.Context, logger *log.Logger, cmd, key string, start time.Time) {
+	use := time.Since(start)
+	l.observe(cmd, use)
+	logger.Debug(ctx, "Cache",
+		log.String("cmd", cmd),
+		log.String("key", key),
+		log.Duration("time", use),
+	)
+}
+
+func (l *latencies) snapshot() map[string]metrics.HistogramSnapshot {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	s := make(map[string]metrics.HistogramSnapshot, len(l.ops))
+	for op, h := range l.ops {
+		s[op] = h.Snapshot()
+	}
+	return s
+}
+
+// Collector 以 Prometheus 文本格式输出已注册缓存的统计，标签 cache 为注册时的名称
+type Collector struct {
+	mu     sync.RWMutex
+	caches map[string]Cache
+}
+
+func NewCollector() *Collector {
+	return &Collector{caches: make(map[string]Cache)}
+}
+
+// Register 注册缓存，同名缓存会被替换
+func (c *Collector) Register(name string, cache Cache) {
+	c.mu.Lock()
+	c.caches[name] = cache
+	c.mu.Unlock()
+}
+
+// Unregister 取消注册
+func (c *Collector) Unregister(name string) {
+	c.mu.Lock()
+	delete(c.caches, name)
+	c.mu.Unlock()
+}
+
+type namedStats struct {
+	name  string
+	stats Stats
+}
+
+// WriteTo 输出所有已注册缓存的统计
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.RLock()
+	all := make([]namedStats, 0, len(c.caches))
+	for name, cache := range c.caches {
+		all = append(all, namedStats{name: name, stats: cache.Stats()})
+	}
+	c.mu.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+
+	buf := bytes.Buffer{}
+	gauges := []struct {
+		name, help, typ string
+		value           func(s Stats) float64
+	}{
+		{"cache_hits_total", "Number of cache lookups that found the key.", "counter", func(s Stats) float64 { return float64(s.Hits) }},
+		{"cache_misses_total", "Number of cache lookups that missed.", "counter", func(s Stats) float64 { return float64(s.Misses) }},
+		{"cache_hit_rate", "Ratio of hits to lookups.", "gauge", func(s Stats) float64 { return s.HitRate }},
+		{"cache_entries", "Number of entries in the cache.", "gauge", func(s Stats) float64 { return float64(s.Entries) }},
+		{"cache_evictions_total", "Number of entries evicted for space.", "counter", func(s Stats) float64 { return float64(s.Evictions) }},
+		{"cache_expirations_total", "Number of entries expired.", "counter", func(s Stats) float64 { return float64(s.Expirations) }},
+		{"cache_bytes_used", "Memory used by the cache in bytes.", "gauge", func(s Stats) float64 { return float64(s.BytesUsed) }},
+	}
+	for _, g := range gauges {
+		_ = metrics.WriteHeader(&buf, g.name, g.help, g.typ)
+		for _, s := range all {
+			_ = metrics.WriteSample(&buf, g.name, []metrics.Label{{Name: "cache", Value: s.name}}, g.value(s.stats))
+		}
+	}
+
+	_ = metrics.WriteHeader(&buf, "cache_op_errors_total", "Number of failed cache operations.", "counter")
+	for _, s := range all {
+		for _, op := range sortedKeys(s.stats.Errors) {
+			labels := []metrics.Label{{Name: "cache", Value: s.name}, {Name: "op", Value: op}}
+			_ = metrics.WriteSample(&buf, "cache_op_errors_total", labels, float64(s.stats.Errors[op]))
+		}
+	}
+
+	_ = metrics.WriteHeader(&buf, "cache_op_duration_seconds", "Latency of cache operations.", "histogram")
+	for _, s := range all {
+		ops := make([]string, 0, len(s.stats.Latency))
+		for op := range s.stats.Latency {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		for _, op := range ops {
+			labels := []metrics.Label{{Name: "cache", Value: s.name}, {Name: "op", Value: op}}
+			_ = metrics.WriteHistogram(&buf, "cache_op_duration_seconds", labels, s.stats.Latency[op])
+		}
+	}
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP 可直接挂载为 /metrics
+func (c *Collector) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = c.WriteTo(w)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestStats(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx := hctx.GetContext(context.Background(), "")
+
+	local := NewCache(Config{Cache: FreeCacheConfig{CacheSizeMB: 1, GCPercent: 100}}, logger)
+	remote := NewCache(Config{Driver: DriverRedis, Redis: newTestRedisConfig(t)}, logger)
+	for _, c := range []Cache{local, remote} {
+		assert.Nil(t, c.Set(ctx, "book:42", "hachi", 60))
+		_, _ = c.Get(ctx, "book:42")
+		_, _ = c.Get(ctx, "book:43")
+
+		stats := c.Stats()
+		assert.Equal(t, int64(1), stats.Hits)
+		assert.Equal(t, int64(1), stats.Misses)
+		assert.Equal(t, 0.5, stats.HitRate)
+		assert.Equal(t, int64(1), stats.Entries)
+		assert.Equal(t, uint64(2), stats.Latency["get"].Count)
+	}
+
+	collector := NewCollector()
+	collector.Register("local", local)
+	collector.Register("remote", remote)
+	buf := bytes.Buffer{}
+	_, err := collector.WriteTo(&buf)
+	assert.Nil(t, err)
+
+	out := buf.String()
+	assert.True(t, strings.Contains(out, "# TYPE cache_hits_total counter\n"))
+	assert.True(t, strings.Contains(out, `cache_hits_total{cache="local"} 1`+"\n"))
+	assert.True(t, strings.Contains(out, `cache_hit_rate{cache="remote"} 0.5`+"\n"))
+	assert.True(t, strings.Contains(out, `cache_op_duration_seconds_count{cache="local",op="get"} 2`+"\n"))
+}
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrTagsNotSupported 缓存不支持标签
+var ErrTagsNotSupported = errors.New("cache: tags not supported")
+
+// TagCache 支持按标签批量失效的缓存
+// 一个键可以带多个标签（如 author:7、book:42），InvalidateTags 删除带有任一标签的所有键。
+// 标签到键的索引由各驱动自行维护，Set、Incr 等不带标签的写入会清除键原有的标签。
+type TagCache interface {
+	Cache
+	// SetWithTags 写入键值并关联标签
+	SetWithTags(ctx context.Context, key string, value interface{}, expireSeconds int, tags ...string) error
+	// InvalidateTags 删除带有任一标签的所有键
+	InvalidateTags(ctx context.Context, tags ...string) error
+}
+
+// SetWithTags 写入带标签的键值，c 不支持标签时返回 ErrTagsNotSupported
+func SetWithTags(ctx context.Context, c Cache, key string, value interface{}, expireSeconds int, tags ...string) error {
+	tc, ok := c.(TagCache)
+	if !ok {
+		return ErrTagsNotSupported
+	}
+	return tc.SetWithTags(ctx, key, value, expireSeconds, tags...)
+}
+
+// InvalidateTags 使带有任一标签的键失效，c 不支持标签时返回 ErrTagsNotSupported
+func InvalidateTags(ctx context.Context, c Cache, tags ...string) error {
+	tc, ok := c.(TagCache)
+	if !ok {
+		return ErrTagsNotSupported
+	}
+	return tc.InvalidateTags(ctx, tags...)
+}
+
+// 索引中的键数达到该值后才开始清理
+const minTagSweep = 1024
+
+// tagIndex 进程内缓存使用的标签索引
+// 写入带标签的键和按标签失效都在 mu 内完成，保证失效时不会漏掉并发写入的键。
+// 过期或被驱逐的键在索引中的键数翻倍时统一清理，清理的开销分摊到每次带标签的写入。
+type tagIndex struct {
+	mu      sync.Mutex
+	tags    map[string]map[string]struct{} // tag => keys
+	keys    map[string][]string            // key => tags
+	tagged  int64                          // len(keys)，没有带标签的键时 remove 不加锁
+	exists  func(key string) bool          // 键是否仍在缓存中，在 mu 内调用
+	sweepAt int
+}
+
+func newTagIndex(exists func(key string) bool) *tagIndex {
+	return &tagIndex{
+		tags:    make(map[string]map[string]struct{}),
+		keys:    make(map[string][]string),
+		exists:  exists,
+		sweepAt: minTagSweep,
+	}
+}
+
+// set 在索引锁内执行写入，写入成功后更新 key 的标签
+func (x *tagIndex) set(key string, tags []string, write func() error) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := write(); err != nil {
+		return err
+	}
+
+	x.unlink(key)
+	if len(tags) == 0 {
+		return nil
+	}
+	for _, tag := range tags {
+		keys, ok := x.tags[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			x.tags[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	x.keys[key] = append([]string(nil), tags...)
+	atomic.StoreInt64(&x.tagged, int64(len(x.keys)))
+	if len(x.keys) >= x.sweepAt {
+		x.sweep()
+	}
+
+	return nil
+}
+
+// invalidate 在索引锁内删除带有任一标签的键
+func (x *tagIndex) invalidate(tags []string, del func(key string)) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, tag := range tags {
+		for key := range x.tags[tag] {
+			del(key)
+			x.unlink(key)
+		}
+		delete(x.tags, tag)
+	}
+}
+
+// remove 键被删除或不带标签重新写入时清理索引
+func (x *tagIndex) remove(key string) {
+	if atomic.LoadInt64(&x.tagged) == 0 {
+		return
+	}
+	x.mu.Lock()
+	x.unlink(key)
+	x.mu.Unlock()
+}
+
+// sweep 清理已过期或被驱逐的键，调用方持有锁
+func (x *tagIndex) sweep() {
+	for key := range x.keys {
+		if !x.exists(key) {
+			x.unlink(key)
+		}
+	}
+	if x.sweepAt = 2 * len(x.keys); x.sweepAt < minTagSweep {
+		x.sweepAt = minTagSweep
+	}
+}
+
+func (x *tagIndex) unlink(key string) {
+	for _, tag := range x.keys[key] {
+		if keys, ok := x.tags[tag]; ok {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(x.tags, tag)
+			}
+		}
+	}
+	delete(x.keys, key)
+	atomic.StoreInt64(&x.tagged, int64(len(x.keys)))
+}
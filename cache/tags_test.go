@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestTags(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx := hctx.GetContext(context.Background(), "")
+
+	caches := map[string]Cache{
+		"freecache": NewCache(Config{Cache: FreeCacheConfig{CacheSizeMB: 1, GCPercent: 100}}, logger),
+		"redis":     NewCache(Config{Driver: DriverRedis, Redis: newTestRedisConfig(t)}, logger),
+	}
+	for name, c := range caches {
+		t.Run(name, func(t *testing.T) {
+			testTags(t, ctx, c)
+			testTags(t, ctx, Namespace(c, "book"))
+		})
+	}
+}
+
+func testTags(t *testing.T, ctx context.Context, c Cache) {
+	assert.Nil(t, SetWithTags(ctx, c, "book:42", "b42", 60, "author:7", "book:42"))
+	assert.Nil(t, SetWithTags(ctx, c, "book:43", "b43", 60, "author:7"))
+	assert.Nil(t, SetWithTags(ctx, c, "book:44", "b44", 0, "author:8"))
+
+	assert.Nil(t, InvalidateTags(ctx, c, "author:7"))
+	_, err := c.Get(ctx, "book:42")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = c.Get(ctx, "book:43")
+	assert.Equal(t, ErrNotFound, err)
+	val, err := c.Get(ctx, "book:44")
+	assert.Nil(t, err)
+	assert.Equal(t, "b44", val)
+
+	// 不带标签重新写入后不再属于原来的标签
+	assert.Nil(t, SetWithTags(ctx, c, "book:45", "b45", 60, "author:9"))
+	assert.Nil(t, c.Set(ctx, "book:45", "b45v2", 60))
+	assert.Nil(t, InvalidateTags(ctx, c, "author:9"))
+	val, err = c.Get(ctx, "book:45")
+	assert.Nil(t, err)
+	assert.Equal(t, "b45v2", val)
+
+	// 并发写入与失效
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("chapter:%d", i)
+			assert.Nil(t, SetWithTags(ctx, c, key, i, 60, "book:44"))
+			assert.Nil(t, InvalidateTags(ctx, c, "book:44"))
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 8; i++ {
+		_, err = c.Get(ctx, fmt.Sprintf("chapter:%d", i))
+		assert.Equal(t, ErrNotFound, err)
+	}
+}
+
+func TestTagIndexSweep(t *testing.T) {
+	live := make(map[string]bool)
+	x := newTagIndex(func(key string) bool { return live[key] })
+	write := func() error { return nil }
+
+	// 只有第一个键仍在缓存中，其余已过期或被驱逐
+	for i := 0; i < minTagSweep-1; i++ {
+		key := fmt.Sprintf("book:%d", i)
+		live[key] = i == 0
+		assert.Nil(t, x.set(key, []string{"author:7"}, write))
+	}
+	assert.Equal(t, minTagSweep-1, len(x.keys))
+
+	live["book:new"] = true
+	assert.Nil(t, x.set("book:new", []string{"author:8"}, write))
+	assert.Equal(t, 2, len(x.keys))
+	assert.Equal(t, 1, len(x.tags["author:7"]))
+	assert.Equal(t, minTagSweep, x.sweepAt)
+}
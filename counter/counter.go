@@ -0,0 +1,296 @@
+// counter 包在 redis hash 中累加计数，定期合并写入 mysql
+package counter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	goRedis "github.com/go-redis/redis/v8"
+	guuid "github.com/google/uuid"
+	"xorm.io/xorm"
+)
+
+const (
+	defaultInterval    = 10 * time.Second
+	defaultBatchSize   = 500
+	defaultKeyColumn   = "id"
+	defaultLedgerTable = "counter_flush"
+	defaultRetention   = 7 * 24 * time.Hour
+	// Run 清理批次记录表的间隔
+	pruneInterval = time.Hour
+	// Run 退出前最后一次写入的超时时间
+	finalFlushTimeout = 10 * time.Second
+)
+
+var (
+	// ErrUnknownColumn Incr 的列不在 Columns 中
+	ErrUnknownColumn = errors.New("counter: unknown column")
+	// ErrInvalidConfig 配置缺少必填项或表名、列名不合法
+	ErrInvalidConfig = errors.New("counter: invalid config")
+)
+
+var identRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type Config struct {
+	// 计数器名称，用于 redis 键
+	Name string `yaml:"name"`
+	// 写入的表，KeyColumn 需要是主键或唯一索引
+	Table string `yaml:"table"`
+	// 行的键所在的列，默认 id
+	KeyColumn string `yaml:"keyColumn"`
+	// 计数列，如 views、likes，写入时累加到原值上
+	Columns []string `yaml:"columns"`
+	// 写入 mysql 的间隔，默认 10s
+	Interval time.Duration `yaml:"interval"`
+	// 每个事务写入的行数，默认 500
+	BatchSize int `yaml:"batchSize"`
+	// 记录已写入批次的表，默认 counter_flush，表结构见 LedgerDDL
+	LedgerTable string `yaml:"ledgerTable"`
+	// 批次记录的保留时间，默认 7 天，需要长于写入失败后可能重试的时间
+	LedgerRetention time.Duration `yaml:"ledgerRetention"`
+}
+
+// Counter 在 redis hash 中累加计数，定期用 RENAME 原子地取出并写入 mysql
+// 取出的计数按键排序分批，每批与 (取出 ID, 键) 的记录在同一事务中写入，已记录的键跳过，
+// 因此写入失败或进程退出后重试不会重复累加，重试前修改 BatchSize 也不影响。
+type Counter struct {
+	client *db.Redis
+	store  store
+	cnf    Config
+	log    *log.Logger
+	cols   map[string]bool
+}
+
+// NewCounter engine 可以是 *xorm.Engine 或 *xorm.EngineGroup，写入使用主库
+func NewCounter(client *db.Redis, engine xorm.EngineInterface, cnf Config, logger *log.Logger) (*Counter, error) {
+	if cnf.KeyColumn == "" {
+		cnf.KeyColumn = defaultKeyColumn
+	}
+	if cnf.LedgerTable == "" {
+		cnf.LedgerTable = defaultLedgerTable
+	}
+	if err := validate(cnf); err != nil {
+		return nil, err
+	}
+	return newCounter(client, &xormStore{engine: engine, cnf: cnf}, cnf, logger), nil
+}
+
+func newCounter(client *db.Redis, s store, cnf Config, logger *log.Logger) *Counter {
+	if cnf.Interval <= 0 {
+		cnf.Interval = defaultInterval
+	}
+	if cnf.BatchSize <= 0 {
+		cnf.BatchSize = defaultBatchSize
+	}
+	if cnf.LedgerRetention <= 0 {
+		cnf.LedgerRetention = defaultRetention
+	}
+
+	cols := make(map[string]bool, len(cnf.Columns))
+	for _, col := range cnf.Columns {
+		cols[col] = true
+	}
+	return &Counter{client: client, store: s, cnf: cnf, log: logger, cols: cols}
+}
+
+func validate(cnf Config) error {
+	if cnf.Name == "" || len(cnf.Columns) == 0 {
+		return fmt.Errorf("%w: name and columns are required", ErrInvalidConfig)
+	}
+	idents := append([]string{cnf.Table, cnf.KeyColumn, cnf.LedgerTable}, cnf.Columns...)
+	for _, ident := range idents {
+		if !identRe.MatchString(ident) {
+			return fmt.Errorf("%w: bad identifier %q", ErrInvalidConfig, ident)
+		}
+	}
+	return nil
+}
+
+// 同一计数器的键使用相同的 hash tag，集群模式下在同一个槽中
+func (c *Counter) pendingKey() string {
+	return "counter:{" + c.cnf.Name + "}:pending"
+}
+
+func (c *Counter) flushingKey() string {
+	return "counter:{" + c.cnf.Name + "}:flushing"
+}
+
+func (c *Counter) flushKey(flushID string) string {
+	return "counter:{" + c.cnf.Name + "}:flush:" + flushID
+}
+
+// Incr 给 key 行的 column 列加 n
+func (c *Counter) Incr(ctx context.Context, key, column string, n int64) error {
+	if !c.cols[column] {
+		return fmt.Errorf("%w: %s", ErrUnknownColumn, column)
+	}
+	return c.client.HIncrBy(ctx, c.pendingKey(), key+":"+column, n).Err()
+}
+
+// Run 每隔 Interval 写入一次，每小时清理过期的批次记录，ctx 结束时再写入一次后返回
+func (c *Counter) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cnf.Interval)
+	defer ticker.Stop()
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(hctx.GetContext(context.Background(), ""), finalFlushTimeout)
+			_ = c.Flush(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			_ = c.Flush(ctx)
+		case <-prune.C:
+			_, _ = c.Prune(ctx)
+		}
+	}
+}
+
+// Prune 删除超过 LedgerRetention 的批次记录，返回删除的行数
+func (c *Counter) Prune(ctx context.Context) (int64, error) {
+	n, err := c.store.prune(ctx, time.Now().Add(-c.cnf.LedgerRetention))
+	if err != nil {
+		c.log.Error(ctx, "counter prune", log.String("name", c.cnf.Name), log.Int64("rows", n), log.ErrorType("err", err))
+		return n, err
+	}
+	c.log.Info(ctx, "counter prune", log.String("name", c.cnf.Name), log.Int64("rows", n))
+	return n, nil
+}
+
+// 取出累加中的计数并登记批次 ID，没有计数时返回 0
+var drainScript = goRedis.NewScript(`
+if redis.call("exists", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("rename", KEYS[1], KEYS[2])
+redis.call("sadd", KEYS[3], ARGV[1])
+return 1
+`)
+
+// Flush 先重试之前未完成的写入，再取出当前的计数写入 mysql
+// 出错时未完成的部分保留在 redis 中，下次 Flush 时重试。
+func (c *Counter) Flush(ctx context.Context) error {
+	ids, err := c.client.SMembers(ctx, c.flushingKey()).Result()
+	if err != nil {
+		c.log.Error(ctx, "counter flush", log.String("name", c.cnf.Name), log.ErrorType("err", err))
+		return err
+	}
+	sort.Strings(ids)
+
+	flushID := newFlushID()
+	drained, err := drainScript.Run(ctx, c.client, []string{c.pendingKey(), c.flushKey(flushID), c.flushingKey()}, flushID).Int()
+	if err != nil {
+		c.log.Error(ctx, "counter flush", log.String("name", c.cnf.Name), log.ErrorType("err", err))
+		return err
+	}
+	if drained == 1 {
+		ids = append(ids, flushID)
+	}
+
+	for _, id := range ids {
+		if err = c.apply(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newFlushID 按时间排序，重试时先处理较早的
+func newFlushID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + guuid.New().String()[:8]
+}
+
+// apply 分批写入一次取出的计数，全部写入后删除
+func (c *Counter) apply(ctx context.Context, flushID string) error {
+	start := time.Now()
+	key := c.flushKey(flushID)
+	fields := []log.Field{log.String("name", c.cnf.Name), log.String("flush_id", flushID)}
+
+	values, err := c.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		c.log.Error(ctx, "counter flush", append(fields, log.ErrorType("err", err))...)
+		return err
+	}
+	rows := c.rows(ctx, values)
+
+	// 记录按键登记，与分批方式无关，重试时已写入的键被跳过
+	ledgerID := c.cnf.Name + ":" + flushID
+	var batches, applied int
+	for i := 0; i < len(rows); i += c.cnf.BatchSize {
+		end := i + c.cnf.BatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		n, err := c.store.apply(ctx, ledgerID, rows[i:end])
+		if err != nil {
+			c.log.Error(ctx, "counter flush", append(fields,
+				log.Int("batch", i/c.cnf.BatchSize),
+				log.Int("rows", len(rows)),
+				log.ErrorType("err", err),
+			)...)
+			return err
+		}
+		batches++
+		applied += n
+	}
+
+	_, err = c.client.TxPipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.SRem(ctx, c.flushingKey(), flushID)
+		return nil
+	})
+	if err != nil {
+		c.log.Error(ctx, "counter flush", append(fields, log.ErrorType("err", err))...)
+		return err
+	}
+
+	c.log.Info(ctx, "counter flush", append(fields,
+		log.Int("rows", len(rows)),
+		log.Int("batches", batches),
+		log.Int("skipped", len(rows)-applied),
+		log.Duration("time", time.Since(start)),
+	)...)
+	return nil
+}
+
+// row 一行的各列增量
+type row struct {
+	key    string
+	counts map[string]int64
+}
+
+// rows 按行合并 hash 中的 "键:列" 字段，按键排序，保证重试时分批相同
+func (c *Counter) rows(ctx context.Context, values map[string]string) []row {
+	byKey := make(map[string]map[string]int64)
+	for field, value := range values {
+		i := strings.LastIndex(field, ":")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if i < 0 || !c.cols[field[i+1:]] || err != nil {
+			c.log.Warn(ctx, "counter skip field", log.String("name", c.cnf.Name), log.String("field", field), log.String("value", value))
+			continue
+		}
+		key, col := field[:i], field[i+1:]
+		if byKey[key] == nil {
+			byKey[key] = make(map[string]int64, len(c.cnf.Columns))
+		}
+		byKey[key][col] += n
+	}
+
+	rows := make([]row, 0, len(byKey))
+	for key, counts := range byKey {
+		rows = append(rows, row{key: key, counts: counts})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].key < rows[j].key })
+	return rows
+}
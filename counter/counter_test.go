@@ -0,0 +1,179 @@
+package counter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+// fakeStore 模拟 mysql 表和批次记录表，failAt 次调用时返回错误
+type fakeStore struct {
+	mu     sync.Mutex
+	ledger map[string]time.Time
+	table  map[string]map[string]int64
+	calls  int
+	failAt int
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{ledger: make(map[string]time.Time), table: make(map[string]map[string]int64)}
+}
+
+func (s *fakeStore) apply(_ context.Context, flushID string, rows []row) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	if s.calls == s.failAt {
+		return 0, errors.New("mysql gone away")
+	}
+	applied := 0
+	for _, r := range rows {
+		if _, ok := s.ledger[flushID+"|"+r.key]; ok {
+			continue
+		}
+		s.ledger[flushID+"|"+r.key] = time.Now()
+		applied++
+		if s.table[r.key] == nil {
+			s.table[r.key] = make(map[string]int64)
+		}
+		for col, n := range r.counts {
+			s.table[r.key][col] += n
+		}
+	}
+	return applied, nil
+}
+
+func (s *fakeStore) prune(_ context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for id, at := range s.ledger {
+		if at.Before(before) {
+			delete(s.ledger, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func newTestCounter(t *testing.T, s store, cnf Config) (*Counter, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	host, port, _ := net.SplitHostPort(mr.Addr())
+	p, _ := strconv.Atoi(port)
+	logger := log.New(os.Stdout, log.InfoLevel)
+	client, err := db.NewRedis(&db.RedisConfig{Host: host, Port: p, LogLevel: db.LogOff}, *logger)
+	assert.Nil(t, err)
+	return newCounter(client, s, cnf, logger), mr
+}
+
+func TestCounter(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	s := newFakeStore()
+	c, mr := newTestCounter(t, s, Config{Name: "book", Columns: []string{"views", "likes"}, BatchSize: 2})
+
+	for i := 0; i < 5; i++ {
+		for j := 0; j <= i; j++ {
+			assert.Nil(t, c.Incr(ctx, fmt.Sprintf("book:%d", i), "views", 1))
+		}
+	}
+	assert.Nil(t, c.Incr(ctx, "book:0", "likes", 3))
+	assert.True(t, errors.Is(c.Incr(ctx, "book:0", "shares", 1), ErrUnknownColumn))
+
+	// 第二批写入失败，已写入的第一批在重试时跳过，重试前修改 BatchSize 不会重复累加
+	s.failAt = 2
+	assert.NotNil(t, c.Flush(ctx))
+	assert.Equal(t, 2, len(s.table))
+	assert.False(t, mr.Exists(c.pendingKey()))
+	c.cnf.BatchSize = 3
+
+	// 失败后新增的计数进入新的批次
+	assert.Nil(t, c.Incr(ctx, "book:0", "views", 10))
+	assert.Nil(t, c.Flush(ctx))
+	assert.Equal(t, map[string]map[string]int64{
+		"book:0": {"views": 11, "likes": 3},
+		"book:1": {"views": 2},
+		"book:2": {"views": 3},
+		"book:3": {"views": 4},
+		"book:4": {"views": 5},
+	}, s.table)
+	assert.Equal(t, []string{}, mr.Keys())
+
+	// 没有计数时不写入
+	calls := s.calls
+	assert.Nil(t, c.Flush(ctx))
+	assert.Equal(t, calls, s.calls)
+
+	// 清理过期的批次记录
+	n, err := c.Prune(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+	c.cnf.LedgerRetention = time.Nanosecond
+	n, err = c.Prune(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), n)
+	assert.Equal(t, 0, len(s.ledger))
+}
+
+func TestCounterRun(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	s := newFakeStore()
+	c, _ := newTestCounter(t, s, Config{Name: "book", Columns: []string{"views"}, Interval: time.Hour})
+
+	assert.Nil(t, c.Incr(ctx, "book:42", "views", 1))
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		c.Run(runCtx)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	// 退出前写入剩余的计数
+	assert.Equal(t, int64(1), s.table["book:42"]["views"])
+}
+
+func TestNewCounter(t *testing.T) {
+	for _, cnf := range []Config{
+		{Table: "book_stats", Columns: []string{"views"}},
+		{Name: "book", Table: "book_stats"},
+		{Name: "book", Table: "book_stats; drop table book", Columns: []string{"views"}},
+		{Name: "book", Table: "book_stats", Columns: []string{"views`"}},
+	} {
+		_, err := NewCounter(nil, nil, cnf, log.Default())
+		assert.True(t, errors.Is(err, ErrInvalidConfig), "%+v", cnf)
+	}
+
+	args := ledgerSQL(Config{LedgerTable: "counter_flush"}, "book:1", []row{{key: "1"}, {key: "2"}}, time.Unix(0, 0))
+	assert.Equal(t, []interface{}{
+		"INSERT INTO `counter_flush` (`flush_id`, `row_key`, `created_at`) VALUES (?, ?, ?), (?, ?, ?)",
+		"book:1", "1", time.Unix(0, 0),
+		"book:1", "2", time.Unix(0, 0),
+	}, args)
+
+	args = upsertSQL(Config{Table: "book_stats", KeyColumn: "book_id", Columns: []string{"views", "likes"}}, []row{
+		{key: "1", counts: map[string]int64{"views": 2}},
+		{key: "2", counts: map[string]int64{"views": 1, "likes": 5}},
+	})
+	assert.Equal(t, []interface{}{
+		"INSERT INTO `book_stats` (`book_id`, `views`, `likes`) VALUES (?, ?, ?), (?, ?, ?)" +
+			" ON DUPLICATE KEY UPDATE `views` = `views` + VALUES(`views`), `likes` = `likes` + VALUES(`likes`)",
+		"1", int64(2), int64(0),
+		"2", int64(1), int64(5),
+	}, args)
+}
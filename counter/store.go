@@ -0,0 +1,152 @@
+package counter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"xorm.io/xorm"
+)
+
+// LedgerDDL 批次记录表的建表语句，%s 为 LedgerTable
+// 每行记录一次取出（flush_id）中已写入的一个键，与分批大小无关。
+const LedgerDDL = "CREATE TABLE IF NOT EXISTS `%s` (\n" +
+	"  `flush_id` varchar(128) NOT NULL,\n" +
+	"  `row_key` varchar(191) NOT NULL,\n" +
+	"  `created_at` datetime NOT NULL,\n" +
+	"  PRIMARY KEY (`flush_id`, `row_key`),\n" +
+	"  KEY `idx_created_at` (`created_at`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// 每次清理记录表删除的行数，避免长时间锁表
+const pruneBatchSize = 1000
+
+// store 写入一批计数，已写入过的键跳过，返回本次写入的行数
+type store interface {
+	apply(ctx context.Context, flushID string, rows []row) (int, error)
+	// prune 删除 before 之前的批次记录
+	prune(ctx context.Context, before time.Time) (int64, error)
+}
+
+type xormStore struct {
+	engine xorm.EngineInterface
+	cnf    Config
+}
+
+func (s *xormStore) apply(ctx context.Context, flushID string, rows []row) (applied int, err error) {
+	session := s.engine.NewSession()
+	defer session.Close()
+	session = session.Context(ctx)
+
+	if err = session.Begin(); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if applied == 0 || err != nil {
+			_ = session.Rollback()
+		}
+	}()
+
+	// 先查出已写入的键，之前的事务已提交
+	query := "SELECT `row_key` FROM `" + s.cnf.LedgerTable + "` WHERE `flush_id` = ? AND `row_key` IN (?" + strings.Repeat(", ?", len(rows)-1) + ") FOR UPDATE"
+	args := make([]interface{}, 0, 1+len(rows))
+	args = append(args, flushID)
+	for _, r := range rows {
+		args = append(args, r.key)
+	}
+	done, err := session.QueryString(append([]interface{}{query}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	skip := make(map[string]bool, len(done))
+	for _, d := range done {
+		skip[d["row_key"]] = true
+	}
+	todo := make([]row, 0, len(rows))
+	for _, r := range rows {
+		if !skip[r.key] {
+			todo = append(todo, r)
+		}
+	}
+	if len(todo) == 0 {
+		return 0, nil
+	}
+
+	// 并发写入同一批时主键冲突，事务回滚，下次 Flush 重试
+	if _, err = session.Exec(ledgerSQL(s.cnf, flushID, todo, time.Now())...); err != nil {
+		return 0, err
+	}
+	if _, err = session.Exec(upsertSQL(s.cnf, todo)...); err != nil {
+		return 0, err
+	}
+	if err = session.Commit(); err != nil {
+		return 0, err
+	}
+	return len(todo), nil
+}
+
+func (s *xormStore) prune(ctx context.Context, before time.Time) (int64, error) {
+	var total int64
+	for {
+		res, err := s.engine.Context(ctx).Exec("DELETE FROM `"+s.cnf.LedgerTable+"` WHERE `created_at` < ? LIMIT "+strconv.Itoa(pruneBatchSize), before)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < pruneBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// ledgerSQL 生成登记一批键的 INSERT，返回值第一个元素为 SQL
+func ledgerSQL(cnf Config, flushID string, rows []row, now time.Time) []interface{} {
+	args := make([]interface{}, 1, 1+len(rows)*3)
+	args[0] = "INSERT INTO `" + cnf.LedgerTable + "` (`flush_id`, `row_key`, `created_at`) VALUES (?, ?, ?)" +
+		strings.Repeat(", (?, ?, ?)", len(rows)-1)
+	for _, r := range rows {
+		args = append(args, flushID, r.key, now)
+	}
+	return args
+}
+
+// upsertSQL 生成 INSERT ... ON DUPLICATE KEY UPDATE，计数列累加到原值上
+// 返回值第一个元素为 SQL，之后为参数，可直接传给 Exec。
+func upsertSQL(cnf Config, rows []row) []interface{} {
+	var b strings.Builder
+	fmt.Fprintf(&b, "INSERT INTO `%s` (`%s`", cnf.Table, cnf.KeyColumn)
+	for _, col := range cnf.Columns {
+		fmt.Fprintf(&b, ", `%s`", col)
+	}
+	b.WriteString(") VALUES ")
+
+	placeholder := "(?" + strings.Repeat(", ?", len(cnf.Columns)) + ")"
+	args := make([]interface{}, 1, 1+len(rows)*(1+len(cnf.Columns)))
+	for i, r := range rows {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(placeholder)
+		args = append(args, r.key)
+		for _, col := range cnf.Columns {
+			args = append(args, r.counts[col])
+		}
+	}
+
+	b.WriteString(" ON DUPLICATE KEY UPDATE ")
+	for i, col := range cnf.Columns {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "`%s` = `%s` + VALUES(`%s`)", col, col, col)
+	}
+
+	args[0] = b.String()
+	return args
+}
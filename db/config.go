@@ -12,15 +12,75 @@ type Config struct {
 }
 
 type RedisConfig struct {
-	Host         string        `yaml:"host"`
-	Port         int           `yaml:"port"`
-	Password     string        `yaml:"password"`
-	DB           int           `yaml:"db"`
-	PoolSize     int           `yaml:"pool_size"`
-	IdleSize     int           `yaml:"idle_size"`
-	PoolTimeout  time.Duration `yaml:"pool_timeout"`
-	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// tcp|unix，默认 tcp；unix 时 Host 为 socket 文件路径
+	Network  string `yaml:"network"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Password string `yaml:"password"`
+	// ACL 用户名（redis 6.0），为空时只用密码认证
+	Username string `yaml:"username"`
+	DB       int    `yaml:"db"`
+	PoolSize int    `yaml:"pool_size"`
+	// 最少保持的空闲连接数
+	IdleSize    int           `yaml:"idle_size"`
+	PoolTimeout time.Duration `yaml:"pool_timeout"`
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// 连接的最长使用时间，超过后关闭重建，默认不限制
+	MaxConnAge time.Duration `yaml:"max_conn_age"`
+
+	// 建立连接的超时时间，默认 5s
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	// 读写超时时间，默认 3s，-1 表示不超时
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// 失败命令的最大重试次数，默认 3，-1 表示不重试
+	MaxRetries int `yaml:"max_retries"`
+	// 重试的退避时间范围，默认 8ms 到 512ms，-1 表示不等待
+	MinRetryBackoff time.Duration `yaml:"min_retry_backoff"`
+	MaxRetryBackoff time.Duration `yaml:"max_retry_backoff"`
+	// TLS 连接，为空时不使用 TLS
+	TLS *RedisTLSConfig `yaml:"tls"`
+
+	// 慢命令阈值，单位毫秒，超过时以 Warn 级别记录，默认 100
+	ExecSlowMs int `yaml:"exec_slow_ms"`
+	// Deprecated: 使用 ExecSlowMs，ExecSlowMs 未设置时才生效。
+	// yaml 中需要写带单位的时长（如 100ms），裸数字按纳秒处理。
 	ExecSlowTime time.Duration `yaml:"exec_slow_time"`
+	// 正常命令的日志级别：debug|info|warn|off，默认 info
+	LogLevel LogLevel `yaml:"log_level"`
+	// 日志中单个参数的最大长度，超出部分截断，默认 256
+	LogArgMaxLen int `yaml:"log_arg_max_len"`
+
+	// 部署模式：single|sentinel|cluster，默认 single
+	Mode string `yaml:"mode"`
+	// sentinel 模式的主节点名
+	MasterName string `yaml:"master_name"`
+	// sentinel 节点地址，host:port
+	SentinelAddrs []string `yaml:"sentinel_addrs"`
+	// sentinel 节点的 ACL 用户名和密码，为空时不认证
+	SentinelUsername string `yaml:"sentinel_username"`
+	SentinelPassword string `yaml:"sentinel_password"`
+	// cluster 模式的种子节点，host:port
+	ClusterAddrs []string `yaml:"cluster_addrs"`
+	// 只读命令的路由：master|replica|latency|random，默认 master
+	// replica 只用于 cluster 模式；sentinel 模式使用 latency、random 时不支持 db 参数
+	ReadFrom string `yaml:"read_from"`
+
+	// 键前缀，多个应用共用一个 db 时用于隔离，加在已知命令的每个键参数之前
+	KeyPrefix string `yaml:"key_prefix"`
+}
+
+// RedisTLSConfig redis 的 TLS 配置，文件均为 PEM 格式
+type RedisTLSConfig struct {
+	// 校验服务端证书的 CA，为空时使用系统根证书
+	CAFile string `yaml:"ca_file"`
+	// 客户端证书和私钥，服务端要求双向认证时配置
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// 校验证书使用的服务端名称，默认为连接的主机名
+	ServerName string `yaml:"server_name"`
+	// 不校验服务端证书，只用于测试
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
 }
 
 // RedisServerOption redis配置
@@ -51,6 +111,22 @@ type RedisServerOption struct {
 	// Log 日志对象
 	Log log.Logger
 
-	// LogLevel 日志级别
+	// LogLevel 正常命令的日志级别，默认 LogInfo；慢命令记录 Warn，失败的命令记录 Error
 	LogLevel LogLevel
 }
+
+// redisConfig 转换为 RedisConfig，IdleCheckFrequency 使用 go-redis 的默认值
+func (o *RedisServerOption) redisConfig() *RedisConfig {
+	return &RedisConfig{
+		Host:         o.Host,
+		Port:         o.Port,
+		Password:     o.Pwd,
+		DB:           o.DB,
+		PoolSize:     o.PoolSize,
+		IdleSize:     o.IdlePoolSize,
+		PoolTimeout:  o.PoolTimeout,
+		IdleTimeout:  o.IdleTimeout,
+		ExecSlowTime: o.ExecSlowTime,
+		LogLevel:     o.LogLevel,
+	}
+}
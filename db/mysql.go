@@ -9,20 +9,20 @@
 package db
 
 import (
-	"context"
 	"git.zhwenxue.com/zhgo/gocontrib/log"
 	_ "github.com/go-sql-driver/mysql"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
-	"time"
-	"xorm.io/builder"
 	"xorm.io/xorm"
-	"xorm.io/xorm/contexts"
 )
 
 type MysqlGroupConfig struct {
 	MysqlMaster MysqlConfig   `yaml:"mysqlMaster"`
 	MysqlSlaves []MysqlConfig `yaml:"mysqlSlaves"`
+	// 从库选择策略：random|weightRandom|roundRobin|leastConn，默认 random
+	Policy string `yaml:"policy"`
+	// 从库健康检查，为空时不检查
+	HealthCheck *MysqlHealthCheckConfig `yaml:"healthCheck"`
 }
 
 func MysqlConfigWithPath(path string) (MysqlGroupConfig, error) {
@@ -45,32 +45,45 @@ type MysqlConfig struct {
 	DataSource   string `yaml:"dataSource"`   // mysql账号密码地址 root:123@localhost/test?charset=utf8
 	MaxIdleConns int    `yaml:"maxIdleConns"` // 连接池的空闲数大小
 	MaxOpenConns int    `yaml:"maxOpenConns"` // 最大打开连接数
+	Weight       int    `yaml:"weight"`       // 从库权重，用于 weightRandom 策略，默认 1
 }
 
 // NewMysqlClient
 // @Description: 初始化单一的mysql客户端
 // @param config
+// @param opts SQL 日志的选项，见 TracingOption
 // @return *xorm.Engine
 // @return error
-func NewMysqlClient(config MysqlGroupConfig, log log.Logger) (*xorm.Engine, error) {
+func NewMysqlClient(config MysqlGroupConfig, log log.Logger, opts ...TracingOption) (*xorm.Engine, error) {
 	engine, err := xorm.NewEngine("mysql", config.MysqlMaster.DataSource)
 	if err != nil {
 		return nil, err
 	}
 
 	setMysqlConfig(engine, config.MysqlMaster)
-	engine.AddHook(NewTracingHook(log))
+	engine.AddHook(NewTracingHook(log, opts...))
 	return engine, nil
 }
 
-func NewMysqlGroup(config MysqlGroupConfig, log log.Logger) (*xorm.EngineGroup, error) {
+// NewMysqlGroup
+// @Description: 初始化主从 mysql 客户端，按 Policy 选择从库，配置了 HealthCheck 时在后台检查从库
+// @param config
+// @param opts SQL 日志的选项，见 TracingOption
+// @return *MysqlGroup 内嵌 *xorm.EngineGroup，之前返回 *xorm.EngineGroup 的调用方使用 g.EngineGroup
+// @return error
+func NewMysqlGroup(config MysqlGroupConfig, log log.Logger, opts ...TracingOption) (*MysqlGroup, error) {
+	policy, err := newMysqlPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+
 	master, err := xorm.NewEngine("mysql", config.MysqlMaster.DataSource)
 	if err != nil {
 		return nil, err
 	}
 
 	setMysqlConfig(master, config.MysqlMaster)
-	master.AddHook(NewTracingHook(log))
+	master.AddHook(NewTracingHook(log, opts...))
 
 	var slaves []*xorm.Engine
 	slaveNum := len(config.MysqlSlaves)
@@ -81,12 +94,11 @@ func NewMysqlGroup(config MysqlGroupConfig, log log.Logger) (*xorm.EngineGroup,
 		}
 
 		setMysqlConfig(slave, config.MysqlSlaves[i])
-		slave.AddHook(NewTracingHook(log))
+		slave.AddHook(NewTracingHook(log, opts...))
 		slaves = append(slaves, slave)
 	}
 
-	eg, err := xorm.NewEngineGroup(master, slaves)
-	return eg, err
+	return newMysqlGroup(master, slaves, config, policy, log)
 }
 
 func setMysqlConfig(engine *xorm.Engine, config MysqlConfig) {
@@ -98,52 +110,3 @@ func setMysqlConfig(engine *xorm.Engine, config MysqlConfig) {
 		engine.SetMaxOpenConns(config.MaxOpenConns)
 	}
 }
-
-type TracingHook struct {
-	// 注意Hook伴随DB实例的生命周期，所以我们不能在Hook里面寄存span变量
-	// 否则就会发生并发问题
-	Log    log.Logger
-	before func(c *contexts.ContextHook) (context.Context, error)
-	after  func(c *contexts.ContextHook) error
-}
-
-// xorm的hook接口需要满足BeforeProcess和AfterProcess函数
-func (h *TracingHook) BeforeProcess(c *contexts.ContextHook) (context.Context, error) {
-	c.Ctx = context.WithValue(c.Ctx, startKey, time.Now())
-	return h.before(c)
-}
-
-func (h *TracingHook) AfterProcess(c *contexts.ContextHook) error {
-	sql, _ := builder.ConvertToBoundSQL(c.SQL, c.Args)
-	use := time.Since(c.Ctx.Value(startKey).(time.Time))
-	h.Log.Info(c.Ctx, "SQL",
-		log.String("sql", sql),
-		log.Any("args", c.Args),
-		log.Duration("time", use),
-	)
-	return h.after(c)
-}
-
-// 让编译器知道这个是xorm的Hook，防止编译器无法检查到异常
-var _ contexts.Hook = &TracingHook{}
-
-// 使用新定义类型
-// context.WithValue方法中注释写到
-// 提供的键需要可比性，而且不能是字符串或者任意内建类型，避免不同包之间
-// 调用到相同的上下文Key发生碰撞，context的key具体类型通常为struct{}，
-// 或者作为外部静态变量（即开头字母为大写）,类型应该是一个指针或者interface类型
-func before(c *contexts.ContextHook) (context.Context, error) {
-	return c.Ctx, nil
-}
-
-func after(c *contexts.ContextHook) error {
-	return nil
-}
-
-func NewTracingHook(log log.Logger) *TracingHook {
-	return &TracingHook{
-		Log:    log,
-		before: before,
-		after:  after,
-	}
-}
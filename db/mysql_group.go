@@ -0,0 +1,432 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	"github.com/go-sql-driver/mysql"
+	"xorm.io/xorm"
+)
+
+const (
+	// MysqlPolicyRandom 随机选择从库，默认
+	MysqlPolicyRandom = "random"
+	// MysqlPolicyWeightRandom 按 Weight 加权随机选择从库
+	MysqlPolicyWeightRandom = "weightRandom"
+	// MysqlPolicyRoundRobin 轮流选择从库
+	MysqlPolicyRoundRobin = "roundRobin"
+	// MysqlPolicyLeastConn 选择正在使用的连接最少的从库
+	MysqlPolicyLeastConn = "leastConn"
+)
+
+const (
+	defaultHealthInterval  = 5 * time.Second
+	defaultHealthTimeout   = time.Second
+	defaultHealthFailures  = 2
+	defaultHealthSuccesses = 2
+)
+
+// errReplicationStopped 从库的复制线程未运行，复制延迟为 NULL
+var errReplicationStopped = errors.New("mysql: replication stopped")
+
+type MysqlHealthCheckConfig struct {
+	// 检查间隔，默认 5s
+	Interval time.Duration `yaml:"interval"`
+	// 单次检查的超时时间，默认 1s
+	Timeout time.Duration `yaml:"timeout"`
+	// 复制延迟超过该值时摘除，0 表示不检查延迟
+	MaxLag time.Duration `yaml:"maxLag"`
+	// 连续失败多少次后摘除，默认 2
+	Failures int `yaml:"failures"`
+	// 摘除后连续成功多少次恢复，默认 2
+	Successes int `yaml:"successes"`
+}
+
+// MysqlReplicaStatus 从库的健康状态
+type MysqlReplicaStatus struct {
+	// 地址和库名，不含账号密码
+	Name    string        `json:"name"`
+	Healthy bool          `json:"healthy"`
+	Lag     time.Duration `json:"lag"`
+}
+
+// MysqlGroup 主从 mysql 客户端，Close 时停止健康检查
+type MysqlGroup struct {
+	*xorm.EngineGroup
+	policy *mysqlPolicy
+	slaves []*xorm.Engine
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Slaves 返回配置的从库，不包括只有一个从库时为启用策略追加的 engine
+func (g *MysqlGroup) Slaves() []*xorm.Engine {
+	return g.slaves
+}
+
+// Replicas 返回各从库的健康状态，顺序与配置相同
+func (g *MysqlGroup) Replicas() []MysqlReplicaStatus {
+	status := make([]MysqlReplicaStatus, 0, len(g.policy.replicas))
+	for _, r := range g.policy.replicas {
+		status = append(status, MysqlReplicaStatus{
+			Name:    r.name,
+			Healthy: r.isHealthy(),
+			Lag:     time.Duration(atomic.LoadInt64(&r.lag)),
+		})
+	}
+	return status
+}
+
+// Close 停止健康检查并关闭所有连接
+func (g *MysqlGroup) Close() error {
+	if g.cancel != nil {
+		g.cancel()
+		<-g.done
+	}
+	return g.EngineGroup.Close()
+}
+
+func newMysqlGroup(master *xorm.Engine, slaves []*xorm.Engine, config MysqlGroupConfig, policy *mysqlPolicy, logger log.Logger) (*MysqlGroup, error) {
+	for i, slave := range slaves {
+		policy.replicas[i].engine = slave
+	}
+
+	// xorm 只有一个从库时直接返回该从库而不经过策略，从库不可用时无法切到主库。
+	// 此时追加一个与该从库共用连接池的 engine 使策略生效：策略只返回已登记的从库或主库，
+	// 追加的 engine 不会被选中，Ping、SetMaxOpenConns 等作用于同一个连接池，Slaves 也不返回它。
+	groupSlaves := slaves
+	if len(slaves) == 1 {
+		standby, err := xorm.NewEngineWithDB("mysql", config.MysqlSlaves[0].DataSource, slaves[0].DB())
+		if err != nil {
+			return nil, err
+		}
+		groupSlaves = []*xorm.Engine{slaves[0], standby}
+	}
+	eg, err := xorm.NewEngineGroup(master, groupSlaves, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &MysqlGroup{EngineGroup: eg, policy: policy, slaves: slaves}
+	if config.HealthCheck != nil && len(slaves) > 0 {
+		checker := newMysqlHealthChecker(*config.HealthCheck, policy.replicas, logger)
+		ctx, cancel := context.WithCancel(context.Background())
+		g.cancel = cancel
+		g.done = make(chan struct{})
+		go func() {
+			defer close(g.done)
+			checker.run(ctx)
+		}()
+	}
+	return g, nil
+}
+
+type mysqlReplica struct {
+	engine  *xorm.Engine
+	name    string
+	weight  int
+	healthy int32 // 1 健康
+	lag     int64 // 最近一次检查的复制延迟，纳秒
+
+	// 只由健康检查的 goroutine 访问
+	fails int
+	oks   int
+	// 读取复制状态失败，与从库是否可用分开记录
+	probeFailing bool
+	// 服务端不支持 SHOW REPLICA STATUS（8.0.22 之前），改用 SHOW SLAVE STATUS
+	legacyStatus bool
+}
+
+func (r *mysqlReplica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+// mysqlPolicy 只在健康的从库中选择，全部不可用时返回主库
+type mysqlPolicy struct {
+	policy   string
+	replicas []*mysqlReplica
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+	pos int
+}
+
+func newMysqlPolicy(config MysqlGroupConfig) (*mysqlPolicy, error) {
+	p := &mysqlPolicy{
+		policy:   config.Policy,
+		replicas: make([]*mysqlReplica, 0, len(config.MysqlSlaves)),
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	switch p.policy {
+	case "":
+		p.policy = MysqlPolicyRandom
+	case MysqlPolicyRandom, MysqlPolicyWeightRandom, MysqlPolicyRoundRobin, MysqlPolicyLeastConn:
+	default:
+		return nil, fmt.Errorf("mysql: unknown policy %q", config.Policy)
+	}
+
+	for i, slave := range config.MysqlSlaves {
+		weight := slave.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("mysql: negative weight for slave %d", i)
+		}
+		p.replicas = append(p.replicas, &mysqlReplica{
+			name:    replicaName(i, slave.DataSource),
+			weight:  weight,
+			healthy: 1,
+		})
+	}
+	return p, nil
+}
+
+// replicaName 日志中的从库名，去掉 DSN 中的账号密码
+func replicaName(i int, dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "slave-" + strconv.Itoa(i)
+	}
+	return cfg.Addr + "/" + cfg.DBName
+}
+
+// Slave 实现 xorm.GroupPolicy
+func (p *mysqlPolicy) Slave(g *xorm.EngineGroup) *xorm.Engine {
+	healthy := make([]*mysqlReplica, 0, len(p.replicas))
+	for _, r := range p.replicas {
+		if r.isHealthy() {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return g.Master()
+	}
+
+	switch p.policy {
+	case MysqlPolicyWeightRandom:
+		total := 0
+		for _, r := range healthy {
+			total += r.weight
+		}
+		if total == 0 {
+			return g.Master()
+		}
+		p.mu.Lock()
+		n := p.rnd.Intn(total)
+		p.mu.Unlock()
+		for _, r := range healthy {
+			if n -= r.weight; n < 0 {
+				return r.engine
+			}
+		}
+	case MysqlPolicyRoundRobin:
+		p.mu.Lock()
+		p.pos = (p.pos + 1) % len(healthy)
+		r := healthy[p.pos]
+		p.mu.Unlock()
+		return r.engine
+	case MysqlPolicyLeastConn:
+		best := healthy[0]
+		inUse := best.engine.DB().Stats().InUse
+		for _, r := range healthy[1:] {
+			if n := r.engine.DB().Stats().InUse; n < inUse {
+				best, inUse = r, n
+			}
+		}
+		return best.engine
+	}
+
+	p.mu.Lock()
+	r := healthy[p.rnd.Intn(len(healthy))]
+	p.mu.Unlock()
+	return r.engine
+}
+
+var _ xorm.GroupPolicy = &mysqlPolicy{}
+
+// mysqlHealthChecker 定期检查从库的连通性和复制延迟
+// 连续失败 Failures 次摘除，摘除后连续成功 Successes 次恢复。
+type mysqlHealthChecker struct {
+	cnf      MysqlHealthCheckConfig
+	replicas []*mysqlReplica
+	log      log.Logger
+	probe    func(ctx context.Context, r *mysqlReplica) (time.Duration, error)
+}
+
+func newMysqlHealthChecker(cnf MysqlHealthCheckConfig, replicas []*mysqlReplica, logger log.Logger) *mysqlHealthChecker {
+	if cnf.Interval <= 0 {
+		cnf.Interval = defaultHealthInterval
+	}
+	if cnf.Timeout <= 0 {
+		cnf.Timeout = defaultHealthTimeout
+	}
+	if cnf.Failures <= 0 {
+		cnf.Failures = defaultHealthFailures
+	}
+	if cnf.Successes <= 0 {
+		cnf.Successes = defaultHealthSuccesses
+	}
+	return &mysqlHealthChecker{cnf: cnf, replicas: replicas, log: logger, probe: probeReplica}
+}
+
+func (c *mysqlHealthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(c.cnf.Interval)
+	defer ticker.Stop()
+	for {
+		c.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *mysqlHealthChecker) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, r := range c.replicas {
+		wg.Add(1)
+		go func(r *mysqlReplica) {
+			defer wg.Done()
+			c.check(ctx, r)
+		}(r)
+	}
+	wg.Wait()
+}
+
+func (c *mysqlHealthChecker) check(ctx context.Context, r *mysqlReplica) {
+	probeCtx, cancel := context.WithTimeout(ctx, c.cnf.Timeout)
+	lag, err := c.probe(probeCtx, r)
+	cancel()
+	if ctx.Err() != nil {
+		return
+	}
+
+	// 从库可以连接但读不到复制状态（如缺少 REPLICATION CLIENT 权限），不摘除，只在状态变化时记录
+	var statusErr *replicaStatusError
+	if errors.As(err, &statusErr) {
+		if !r.probeFailing {
+			c.log.Warn(ctx, "mysql replica probe failed", log.String("replica", r.name), log.ErrorType("err", statusErr.err))
+		}
+		r.probeFailing = true
+		lag, err = 0, nil
+	} else if err == nil && r.probeFailing {
+		r.probeFailing = false
+		c.log.Info(ctx, "mysql replica probe recovered", log.String("replica", r.name))
+	}
+
+	atomic.StoreInt64(&r.lag, int64(lag))
+	if err == nil && c.cnf.MaxLag > 0 && lag > c.cnf.MaxLag {
+		err = fmt.Errorf("mysql: replication lag %s exceeds %s", lag, c.cnf.MaxLag)
+	}
+
+	if err != nil {
+		r.oks = 0
+		r.fails++
+		if r.isHealthy() && r.fails >= c.cnf.Failures {
+			atomic.StoreInt32(&r.healthy, 0)
+			c.log.Warn(ctx, "mysql replica down",
+				log.String("replica", r.name),
+				log.Duration("lag", lag),
+				log.ErrorType("err", err),
+			)
+		}
+		return
+	}
+
+	r.fails = 0
+	r.oks++
+	if !r.isHealthy() && r.oks >= c.cnf.Successes {
+		atomic.StoreInt32(&r.healthy, 1)
+		c.log.Info(ctx, "mysql replica up", log.String("replica", r.name), log.Duration("lag", lag))
+	}
+}
+
+// replicaStatusError 读取复制状态失败，从库本身可以连接
+type replicaStatusError struct {
+	err error
+}
+
+func (e *replicaStatusError) Error() string {
+	return "mysql: read replica status: " + e.err.Error()
+}
+
+// mysql 语法错误，旧版本不支持 SHOW REPLICA STATUS
+const mysqlErrParse = 1064
+
+// probeReplica ping 从库并读取复制延迟，不是从库时延迟为 0
+// 直接使用 database/sql，检查的 SQL 不经过 TracingHook。
+func probeReplica(ctx context.Context, r *mysqlReplica) (time.Duration, error) {
+	db := r.engine.DB().DB
+	if err := db.PingContext(ctx); err != nil {
+		return 0, err
+	}
+
+	if !r.legacyStatus {
+		lag, err := replicaLag(ctx, db, "SHOW REPLICA STATUS", "Seconds_Behind_Source")
+		var myErr *mysql.MySQLError
+		if !errors.As(err, &myErr) || myErr.Number != mysqlErrParse {
+			return lag, err
+		}
+		r.legacyStatus = true
+	}
+	return replicaLag(ctx, db, "SHOW SLAVE STATUS", "Seconds_Behind_Master")
+}
+
+// replicaLag 执行 query 读取 column 列的秒数，NULL 表示复制已停止
+func replicaLag(ctx context.Context, db *sql.DB, query, column string) (time.Duration, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, statusErr(err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, statusErr(err)
+	}
+	if !rows.Next() {
+		return 0, statusErr(rows.Err())
+	}
+	values := make([]sql.RawBytes, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err = rows.Scan(dest...); err != nil {
+		return 0, statusErr(err)
+	}
+
+	for i, col := range cols {
+		if col != column {
+			continue
+		}
+		if values[i] == nil {
+			return 0, errReplicationStopped
+		}
+		seconds, err := strconv.ParseInt(string(values[i]), 10, 64)
+		if err != nil {
+			return 0, statusErr(err)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, nil
+}
+
+// statusErr 超时、断连等连接错误按从库不可用处理，其余为读取状态失败
+func statusErr(err error) error {
+	var myErr *mysql.MySQLError
+	if err == nil || !errors.As(err, &myErr) {
+		return err
+	}
+	return &replicaStatusError{err: err}
+}
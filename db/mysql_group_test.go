@@ -0,0 +1,160 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"xorm.io/xorm"
+)
+
+func newTestMysqlGroup(t *testing.T, config MysqlGroupConfig) *MysqlGroup {
+	g, err := NewMysqlGroup(config, *log.New(os.Stdout, log.InfoLevel))
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = g.Close() })
+	return g
+}
+
+func testMysqlSlaves(weights ...int) []MysqlConfig {
+	slaves := make([]MysqlConfig, 0, len(weights))
+	for i, w := range weights {
+		slaves = append(slaves, MysqlConfig{DataSource: "root:123456@tcp(slave" + string(rune('a'+i)) + ":3306)/test", Weight: w})
+	}
+	return slaves
+}
+
+func TestMysqlGroupPolicy(t *testing.T) {
+	master := MysqlConfig{DataSource: "root:123456@tcp(master:3306)/test"}
+
+	_, err := NewMysqlGroup(MysqlGroupConfig{MysqlMaster: master, Policy: "first"}, *log.Default())
+	assert.NotNil(t, err)
+	_, err = NewMysqlGroup(MysqlGroupConfig{MysqlMaster: master, MysqlSlaves: testMysqlSlaves(-1)}, *log.Default())
+	assert.NotNil(t, err)
+
+	// 轮询，摘除的从库不参与，全部摘除时使用主库
+	g := newTestMysqlGroup(t, MysqlGroupConfig{MysqlMaster: master, MysqlSlaves: testMysqlSlaves(1, 1, 1), Policy: MysqlPolicyRoundRobin})
+	slaves := g.Slaves()
+	assert.Equal(t, []MysqlReplicaStatus{
+		{Name: "slavea:3306/test", Healthy: true},
+		{Name: "slaveb:3306/test", Healthy: true},
+		{Name: "slavec:3306/test", Healthy: true},
+	}, g.Replicas())
+	picked := map[*xorm.Engine]int{}
+	for i := 0; i < 6; i++ {
+		picked[g.Slave()]++
+	}
+	assert.Equal(t, map[*xorm.Engine]int{slaves[0]: 2, slaves[1]: 2, slaves[2]: 2}, picked)
+
+	g.policy.replicas[1].healthy = 0
+	for i := 0; i < 4; i++ {
+		assert.NotEqual(t, slaves[1], g.Slave())
+	}
+	for _, r := range g.policy.replicas {
+		r.healthy = 0
+	}
+	assert.Equal(t, g.Master(), g.Slave())
+
+	// 加权随机
+	g = newTestMysqlGroup(t, MysqlGroupConfig{MysqlMaster: master, MysqlSlaves: testMysqlSlaves(3, 1), Policy: MysqlPolicyWeightRandom})
+	slaves = g.Slaves()
+	picked = map[*xorm.Engine]int{}
+	for i := 0; i < 4000; i++ {
+		picked[g.Slave()]++
+	}
+	assert.Equal(t, 2, len(picked))
+	assert.InDelta(t, 3000, picked[slaves[0]], 200)
+
+	// 只有一个从库时也经过策略，摘除后使用主库
+	g = newTestMysqlGroup(t, MysqlGroupConfig{MysqlMaster: master, MysqlSlaves: testMysqlSlaves(1), Policy: MysqlPolicyLeastConn})
+	slave := g.policy.replicas[0].engine
+	assert.Equal(t, []*xorm.Engine{slave}, g.Slaves())
+	assert.Equal(t, 2, len(g.EngineGroup.Slaves()))
+	assert.Equal(t, slave.DB(), g.EngineGroup.Slaves()[1].DB())
+	assert.Equal(t, slave, g.Slave())
+	g.policy.replicas[0].healthy = 0
+	assert.Equal(t, g.Master(), g.Slave())
+}
+
+func TestMysqlHealthChecker(t *testing.T) {
+	ctx := context.Background()
+	replicas := []*mysqlReplica{{name: "a", healthy: 1}, {name: "b", healthy: 1}}
+	checker := newMysqlHealthChecker(MysqlHealthCheckConfig{MaxLag: 10 * time.Second}, replicas, *log.Default())
+
+	results := map[*mysqlReplica]error{}
+	lags := map[*mysqlReplica]time.Duration{}
+	probe := func(r *mysqlReplica) {
+		err, lag := results[r], lags[r]
+		checker.probe = func(context.Context, *mysqlReplica) (time.Duration, error) { return lag, err }
+		checker.check(ctx, r)
+	}
+
+	// 连续失败 2 次摘除
+	results[replicas[0]] = errors.New("connection refused")
+	probe(replicas[0])
+	assert.True(t, replicas[0].isHealthy())
+	probe(replicas[0])
+	assert.False(t, replicas[0].isHealthy())
+
+	// 连续成功 2 次恢复，中间失败重新计数
+	results[replicas[0]] = nil
+	probe(replicas[0])
+	results[replicas[0]] = errors.New("connection refused")
+	probe(replicas[0])
+	results[replicas[0]] = nil
+	probe(replicas[0])
+	assert.False(t, replicas[0].isHealthy())
+	probe(replicas[0])
+	assert.True(t, replicas[0].isHealthy())
+
+	// 复制延迟超过 MaxLag 摘除
+	lags[replicas[1]] = time.Minute
+	probe(replicas[1])
+	probe(replicas[1])
+	assert.False(t, replicas[1].isHealthy())
+	assert.Equal(t, time.Minute, time.Duration(replicas[1].lag))
+
+	// 复制停止
+	results[replicas[1]] = errReplicationStopped
+	lags[replicas[1]] = 0
+	probe(replicas[1])
+	assert.False(t, replicas[1].isHealthy())
+
+	// 读不到复制状态（如没有权限）时不摘除，只记录一次
+	buf := bytes.Buffer{}
+	checker.log = *log.New(&buf, log.InfoLevel)
+	results[replicas[0]] = statusErr(&mysql.MySQLError{Number: 1227, Message: "Access denied; you need the REPLICATION CLIENT privilege"})
+	for i := 0; i < 3; i++ {
+		probe(replicas[0])
+	}
+	assert.True(t, replicas[0].isHealthy())
+	assert.Equal(t, 1, strings.Count(buf.String(), "mysql replica probe failed"))
+	assert.NotContains(t, buf.String(), "mysql replica down")
+	results[replicas[0]] = nil
+	probe(replicas[0])
+	assert.Contains(t, buf.String(), "mysql replica probe recovered")
+
+	// 连接错误仍按从库不可用处理
+	assert.Equal(t, context.DeadlineExceeded, statusErr(context.DeadlineExceeded))
+}
+
+func TestMysqlGroupConfigWithPath(t *testing.T) {
+	dir, _ := os.Getwd()
+	config, err := MysqlConfigWithPath(dir + "/mysql_config_sample.yml")
+	assert.Nil(t, err)
+	assert.Equal(t, MysqlPolicyWeightRandom, config.Policy)
+	assert.Equal(t, 2, config.MysqlSlaves[0].Weight)
+	assert.Equal(t, &MysqlHealthCheckConfig{
+		Interval:  5 * time.Second,
+		Timeout:   time.Second,
+		MaxLag:    10 * time.Second,
+		Failures:  2,
+		Successes: 2,
+	}, config.HealthCheck)
+}
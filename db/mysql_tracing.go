@@ -0,0 +1,337 @@
+package db
+
+import (
+	"context"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	"xorm.io/builder"
+	"xorm.io/xorm/contexts"
+)
+
+// 脱敏后的参数
+const maskedArg = "***"
+
+type TracingHook struct {
+	// 注意Hook伴随DB实例的生命周期，所以我们不能在Hook里面寄存span变量
+	// 否则就会发生并发问题
+	Log log.Logger
+
+	slow         time.Duration
+	sampleRate   float64
+	maxSQLLength int
+	maskColumns  map[string]bool
+	maskPatterns []*regexp.Regexp
+	before       []func(c *contexts.ContextHook) (context.Context, error)
+	after        []func(c *contexts.ContextHook) error
+}
+
+type TracingOption func(*TracingHook)
+
+// WithSlowThreshold 耗时不少于 d 的 SQL 以 Warn 级别记录为 SQL_slow，不受采样影响
+func WithSlowThreshold(d time.Duration) TracingOption {
+	return func(h *TracingHook) {
+		h.slow = d
+	}
+}
+
+// WithSampleRate 正常 SQL 的记录比例，取值 0~1，默认 1 全部记录
+// 慢查询和出错的 SQL 总是记录。
+func WithSampleRate(rate float64) TracingOption {
+	return func(h *TracingHook) {
+		h.sampleRate = rate
+	}
+}
+
+// WithMaxSQLLength 绑定参数后的 SQL 超过 n 字节时截断，0 不截断
+// 同时限制 args：最多记录 64 个参数，每个字符串参数最多 n 字节。
+func WithMaxSQLLength(n int) TracingOption {
+	return func(h *TracingHook) {
+		h.maxSQLLength = n
+	}
+}
+
+// WithMaskColumns 对应这些列（不区分大小写）的参数记录为 ***，如 password、id_card
+// 支持 col = ?、col IN (?, ?) 和 INSERT 的列表形式。
+func WithMaskColumns(columns ...string) TracingOption {
+	return func(h *TracingHook) {
+		if h.maskColumns == nil {
+			h.maskColumns = make(map[string]bool, len(columns))
+		}
+		for _, col := range columns {
+			h.maskColumns[strings.ToLower(col)] = true
+		}
+	}
+}
+
+// WithMaskPattern 字符串参数中匹配 re 的部分记录为 ***，如手机号、邮箱
+func WithMaskPattern(re *regexp.Regexp) TracingOption {
+	return func(h *TracingHook) {
+		h.maskPatterns = append(h.maskPatterns, re)
+	}
+}
+
+// WithBeforeProcess 添加执行 SQL 前的回调，按添加顺序执行，返回的 context 传给下一个回调
+func WithBeforeProcess(fn func(c *contexts.ContextHook) (context.Context, error)) TracingOption {
+	return func(h *TracingHook) {
+		h.before = append(h.before, fn)
+	}
+}
+
+// WithAfterProcess 添加执行 SQL 后的回调，在记录日志之后按添加顺序执行
+func WithAfterProcess(fn func(c *contexts.ContextHook) error) TracingOption {
+	return func(h *TracingHook) {
+		h.after = append(h.after, fn)
+	}
+}
+
+func NewTracingHook(log log.Logger, opts ...TracingOption) *TracingHook {
+	h := &TracingHook{
+		Log:        log,
+		sampleRate: 1,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// xorm的hook接口需要满足BeforeProcess和AfterProcess函数
+func (h *TracingHook) BeforeProcess(c *contexts.ContextHook) (context.Context, error) {
+	c.Ctx = context.WithValue(c.Ctx, startKey, time.Now())
+	for _, fn := range h.before {
+		ctx, err := fn(c)
+		if err != nil {
+			return ctx, err
+		}
+		// 回调返回 nil 时沿用原来的 context，AfterProcess 需要其中的开始时间
+		if ctx != nil {
+			c.Ctx = ctx
+		}
+	}
+	return c.Ctx, nil
+}
+
+// AfterProcess 出错记录 Error，慢查询记录 Warn，其余按采样比例记录 Info
+func (h *TracingHook) AfterProcess(c *contexts.ContextHook) error {
+	use := time.Since(c.Ctx.Value(startKey).(time.Time))
+	switch {
+	case c.Err != nil:
+		h.Log.Error(c.Ctx, "SQL", append(h.fields(c, use), log.ErrorType("err", c.Err))...)
+	case h.slow > 0 && use >= h.slow:
+		h.Log.Warn(c.Ctx, "SQL_slow", h.fields(c, use)...)
+	case h.sampleRate >= 1 || rand.Float64() < h.sampleRate:
+		h.Log.Info(c.Ctx, "SQL", h.fields(c, use)...)
+	}
+
+	for _, fn := range h.after {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *TracingHook) fields(c *contexts.ContextHook, use time.Duration) []log.Field {
+	args := h.maskArgs(c.SQL, c.Args)
+	sql, _ := builder.ConvertToBoundSQL(c.SQL, args)
+	if h.maxSQLLength > 0 {
+		sql = truncateString(sql, h.maxSQLLength)
+		args = truncateArgs(args, h.maxSQLLength)
+	}
+	return []log.Field{
+		log.String("sql", sql),
+		log.Any("args", args),
+		log.Duration("time", use),
+	}
+}
+
+// truncateString s 超过 n 字节时在字符边界截断，并记录原长度
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	cut := n
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + "...(" + strconv.Itoa(len(s)) + " bytes)"
+}
+
+// truncateArgs 与 redis 日志相同，最多保留 logArgMaxCount 个参数，过长的字符串参数截断
+func truncateArgs(args []interface{}, n int) []interface{} {
+	count := len(args)
+	if count > logArgMaxCount {
+		count = logArgMaxCount
+	}
+	out := make([]interface{}, 0, count+1)
+	for _, arg := range args[:count] {
+		switch v := arg.(type) {
+		case string:
+			arg = truncateString(v, n)
+		case []byte:
+			arg = truncateString(string(v), n)
+		}
+		out = append(out, arg)
+	}
+	if len(args) > count {
+		out = append(out, "...("+strconv.Itoa(len(args)-count)+" more)")
+	}
+	return out
+}
+
+// 让编译器知道这个是xorm的Hook，防止编译器无法检查到异常
+var _ contexts.Hook = &TracingHook{}
+
+// maskArgs 返回脱敏后的参数副本，没有配置脱敏时返回原参数
+func (h *TracingHook) maskArgs(query string, args []interface{}) []interface{} {
+	if len(args) == 0 || (len(h.maskColumns) == 0 && len(h.maskPatterns) == 0) {
+		return args
+	}
+
+	var cols []string
+	if len(h.maskColumns) > 0 {
+		cols = placeholderColumns(query)
+	}
+
+	out := make([]interface{}, len(args))
+	for i, arg := range args {
+		if i < len(cols) && h.maskColumns[cols[i]] {
+			out[i] = maskedArg
+			continue
+		}
+		out[i] = arg
+		if len(h.maskPatterns) == 0 {
+			continue
+		}
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		default:
+			continue
+		}
+		for _, re := range h.maskPatterns {
+			s = re.ReplaceAllString(s, maskedArg)
+		}
+		out[i] = s
+	}
+	return out
+}
+
+var (
+	insertColumnsRe = regexp.MustCompile("(?is)^\\s*(?:insert|replace)\\b.*?\\binto\\s+\\S+?\\s*\\(([^)]*)\\)\\s*values\\b")
+	onDuplicateRe   = regexp.MustCompile(`(?i)\bon\s+duplicate\s+key\s+update\b`)
+)
+
+// placeholderColumns 按顺序返回每个 ? 对应的小写列名，无法判断时为空字符串
+func placeholderColumns(query string) []string {
+	var insertCols []string
+	valuesAt, valuesEnd := -1, len(query)
+	if m := insertColumnsRe.FindStringSubmatchIndex(query); m != nil {
+		for _, col := range strings.Split(query[m[2]:m[3]], ",") {
+			insertCols = append(insertCols, lastIdent(strings.TrimSpace(col)))
+		}
+		valuesAt = m[1]
+		if loc := onDuplicateRe.FindStringIndex(query[valuesAt:]); loc != nil {
+			valuesEnd = valuesAt + loc[0]
+		}
+	}
+
+	var cols []string
+	var quote byte
+	inValues := 0
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		if quote != 0 {
+			if ch == '\\' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch ch {
+		case '\'', '"', '`':
+			quote = ch
+		case '?':
+			if valuesAt >= 0 && i > valuesAt && i < valuesEnd {
+				cols = append(cols, insertCols[inValues%len(insertCols)])
+				inValues++
+			} else {
+				cols = append(cols, columnBefore(query[:i]))
+			}
+		}
+	}
+	return cols
+}
+
+// columnBefore 取 ? 前面比较的列名，支持 col = ?、col LIKE ?、col IN (?, ?)、col BETWEEN ? AND ?
+func columnBefore(s string) string {
+	s = strings.TrimRight(s, " \t\r\n")
+	if strings.HasSuffix(s, "(") || strings.HasSuffix(s, ",") {
+		open := strings.LastIndexByte(s, '(')
+		if open < 0 {
+			return ""
+		}
+		s = strings.TrimRight(s[:open], " \t\r\n")
+		if !hasKeywordSuffix(s, "in") {
+			return ""
+		}
+		s = strings.TrimRight(s[:len(s)-2], " \t\r\n")
+	} else {
+		s = strings.TrimRight(s, "=<>! \t\r\n")
+		if hasKeywordSuffix(s, "like") {
+			s = strings.TrimRight(s[:len(s)-4], " \t\r\n")
+		}
+		if hasKeywordSuffix(s, "and") {
+			s = strings.TrimRight(s[:len(s)-3], " \t\r\n")
+			if !strings.HasSuffix(s, "?") {
+				return ""
+			}
+			s = strings.TrimRight(s[:len(s)-1], " \t\r\n")
+			if !hasKeywordSuffix(s, "between") {
+				return ""
+			}
+		}
+		if hasKeywordSuffix(s, "between") {
+			s = strings.TrimRight(s[:len(s)-7], " \t\r\n")
+		} else if hasKeywordSuffix(s, "set") || hasKeywordSuffix(s, "where") || hasKeywordSuffix(s, "or") {
+			return ""
+		}
+	}
+	if hasKeywordSuffix(s, "not") {
+		s = strings.TrimRight(s[:len(s)-3], " \t\r\n")
+	}
+	return lastIdent(s)
+}
+
+// hasKeywordSuffix s 以单词 kw 结尾，不区分大小写
+func hasKeywordSuffix(s, kw string) bool {
+	n := len(s) - len(kw)
+	return n >= 0 && strings.EqualFold(s[n:], kw) && (n == 0 || !isIdentChar(s[n-1]))
+}
+
+// lastIdent 取 s 末尾的标识符，去掉表名和反引号，转为小写
+func lastIdent(s string) string {
+	i := len(s)
+	for i > 0 && (isIdentChar(s[i-1]) || s[i-1] == '`' || s[i-1] == '.') {
+		i--
+	}
+	ident := s[i:]
+	if dot := strings.LastIndexByte(ident, '.'); dot >= 0 {
+		ident = ident[dot+1:]
+	}
+	return strings.ToLower(strings.Trim(ident, "`"))
+}
+
+func isIdentChar(ch byte) bool {
+	return ch == '_' || ch == '$' || ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	"github.com/stretchr/testify/assert"
+	"xorm.io/xorm/contexts"
+)
+
+// runTracingHook 模拟 xorm 执行一条 SQL，耗时 use
+func runTracingHook(t *testing.T, h *TracingHook, query string, args []interface{}, use time.Duration, err error) {
+	c := contexts.NewContextHook(hctx.GetContext(context.Background(), ""), query, args)
+	ctx, e := h.BeforeProcess(c)
+	assert.Nil(t, e)
+	c.End(context.WithValue(ctx, startKey, time.Now().Add(-use)), nil, err)
+	assert.Nil(t, h.AfterProcess(c))
+}
+
+func TestTracingHook(t *testing.T) {
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, log.InfoLevel)
+
+	var calls []string
+	h := NewTracingHook(*logger,
+		WithSlowThreshold(100*time.Millisecond),
+		WithSampleRate(0),
+		WithMaxSQLLength(60),
+		WithMaskColumns("password"),
+		WithMaskPattern(regexp.MustCompile(`1[3-9]\d{9}`)),
+		WithBeforeProcess(func(c *contexts.ContextHook) (context.Context, error) {
+			calls = append(calls, "before")
+			return c.Ctx, nil
+		}),
+		WithAfterProcess(func(c *contexts.ContextHook) error {
+			calls = append(calls, "after")
+			return nil
+		}),
+	)
+
+	// 正常 SQL 按采样比例 0 不记录，回调照常执行
+	runTracingHook(t, h, "SELECT * FROM `user` WHERE `id` = ?", []interface{}{1}, time.Millisecond, nil)
+	assert.Equal(t, "", buf.String())
+	assert.Equal(t, []string{"before", "after"}, calls)
+
+	// 慢查询记录 Warn，参数脱敏
+	runTracingHook(t, h, "SELECT * FROM `user` WHERE `password` = ? AND `note` = ?", []interface{}{"secret", "call 13800138000"}, time.Second, nil)
+	out := buf.String()
+	assert.Contains(t, out, `"level":"warn"`)
+	assert.Contains(t, out, `"msg":"SQL_slow"`)
+	assert.Contains(t, out, `"args":["***","call ***"]`)
+	assert.NotContains(t, out, "secret")
+	assert.NotContains(t, out, "13800138000")
+
+	// 出错记录 Error，过长的 SQL 和参数都截断
+	buf.Reset()
+	runTracingHook(t, h, "UPDATE `user` SET `name` = ? WHERE `id` = ?", []interface{}{strings.Repeat("a", 100), 1}, time.Millisecond, errors.New("deadlock"))
+	out = buf.String()
+	assert.Contains(t, out, `"level":"error"`)
+	assert.Contains(t, out, `"err":"deadlock"`)
+	assert.Contains(t, out, "...(144 bytes)")
+	assert.Contains(t, out, `"args":["`+strings.Repeat("a", 60)+`...(100 bytes)",1]`)
+	assert.NotContains(t, out, strings.Repeat("a", 61))
+
+	// 批量写入最多记录 64 个参数
+	buf.Reset()
+	bulk := make([]interface{}, 1000)
+	for i := range bulk {
+		bulk[i] = i
+	}
+	runTracingHook(t, h, "INSERT INTO `user` (`id`) VALUES (?)"+strings.Repeat(", (?)", 999), bulk, time.Second, nil)
+	assert.Contains(t, buf.String(), `63,"...(936 more)"]`)
+
+	// 回调返回 nil context 时沿用原来的 context
+	nilCtx := NewTracingHook(*logger, WithBeforeProcess(func(c *contexts.ContextHook) (context.Context, error) {
+		return nil, nil
+	}))
+	runTracingHook(t, nilCtx, "SELECT 1", nil, time.Millisecond, nil)
+
+	// 默认全部记录
+	buf.Reset()
+	runTracingHook(t, NewTracingHook(*logger), "SELECT 1", nil, time.Second, nil)
+	assert.Contains(t, buf.String(), `"level":"info"`)
+}
+
+func TestPlaceholderColumns(t *testing.T) {
+	for query, cols := range map[string][]string{
+		"SELECT * FROM `user` WHERE `user`.`id` = ? AND name LIKE ? AND age>=?":          {"id", "name", "age"},
+		"SELECT * FROM user WHERE id IN (?, ?) AND role NOT IN (?) AND note != '?'":      {"id", "id", "role"},
+		"INSERT INTO `user` (`name`,`password`) VALUES (?,?),(?,?)":                      {"name", "password", "name", "password"},
+		"INSERT INTO user (name, views) VALUES (?, ?) ON DUPLICATE KEY UPDATE views = ?": {"name", "views", "views"},
+		"UPDATE user SET password=?, updated=NOW() WHERE id BETWEEN ? AND ? AND ?":       {"password", "id", "id", ""},
+	} {
+		assert.Equal(t, cols, placeholderColumns(query), query)
+	}
+}
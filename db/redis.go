@@ -2,9 +2,14 @@ package db
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"git.zhwenxue.com/zhgo/gocontrib/log"
@@ -13,10 +18,12 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-
-// Redis redis对象
+// Redis redis对象，单节点、哨兵和集群模式共用
 type Redis struct {
-	*goRedis.Client
+	goRedis.UniversalClient
+	log     log.Logger
+	scripts *scriptRegistry
+	stats   *commandStats
 }
 
 func RedisConfigWithPath(path string) (*RedisConfig, error) {
@@ -32,51 +39,302 @@ func RedisConfigWithPath(path string) (*RedisConfig, error) {
 	return cfg.Redis, nil
 }
 
+const (
+	// RedisModeSingle 单节点，默认模式
+	RedisModeSingle = "single"
+	// RedisModeSentinel 哨兵模式，通过 sentinel 发现主节点并自动切换
+	RedisModeSentinel = "sentinel"
+	// RedisModeCluster 集群模式
+	RedisModeCluster = "cluster"
+)
+
+const (
+	// RedisReadMaster 只读命令发送到主节点，默认
+	RedisReadMaster = "master"
+	// RedisReadReplica 只读命令发送到从节点，只用于 cluster 模式
+	RedisReadReplica = "replica"
+	// RedisReadLatency 只读命令发送到延迟最低的节点
+	RedisReadLatency = "latency"
+	// RedisReadRandom 只读命令随机发送到主节点或从节点
+	RedisReadRandom = "random"
+)
+
 func NewRedis(opt *RedisConfig, log log.Logger) (*Redis, error) {
 	// 去掉参数检测
 	//if err := opt.perfect(); err != nil {
 	//	return nil, err
 	//}
+	scripts := newScriptRegistry(log)
+	registerBuiltinScripts(scripts)
+	prefix := newPrefixHook(opt.KeyPrefix)
+	client, err := newRedisClient(opt, scripts.onConnect, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return newRedis(client, log, opt, scripts, prefix), nil
+}
+
+// NewRedisWithOption 按 RedisServerOption 创建客户端，日志写入 opt.Log，按 opt.LogLevel 记录正常命令
+func NewRedisWithOption(opt *RedisServerOption) (*Redis, error) {
+	return NewRedis(opt.redisConfig(), opt.Log)
+}
+
+// newRedisClient 按 Mode 创建客户端，连接池等参数在各模式下相同
+// 集群模式下 ForEachMaster 等直接使用节点客户端，节点客户端也加上 prefix。
+func newRedisClient(opt *RedisConfig, onConnect func(ctx context.Context, cn *goRedis.Conn) error, prefix *prefixHook) (goRedis.UniversalClient, error) {
+	tlsConfig, err := newRedisTLSConfig(opt.TLS)
+	if err != nil {
+		return nil, err
+	}
+
 	redisOpt := &goRedis.Options{
 		Network:         "tcp",
 		Addr:            net.JoinHostPort(opt.Host, strconv.Itoa(opt.Port)),
+		Username:        opt.Username,
 		Password:        opt.Password,
 		DB:              opt.DB,
-		MaxRetries:      3,
-		MinRetryBackoff: 8 * time.Millisecond,
-		MaxRetryBackoff: 512 * time.Millisecond,
-		DialTimeout:     5 * time.Second,
-		ReadTimeout:     3 * time.Second,
-		WriteTimeout:    3 * time.Second,
+		MaxRetries:      opt.MaxRetries,
+		MinRetryBackoff: durationOr(opt.MinRetryBackoff, 8*time.Millisecond),
+		MaxRetryBackoff: durationOr(opt.MaxRetryBackoff, 512*time.Millisecond),
+		DialTimeout:     durationOr(opt.DialTimeout, 5*time.Second),
+		ReadTimeout:     durationOr(opt.ReadTimeout, 3*time.Second),
+		WriteTimeout:    durationOr(opt.WriteTimeout, 3*time.Second),
 		PoolSize:        opt.PoolSize,
-		//MinIdleConns:       opt.,
-		PoolTimeout: opt.PoolTimeout,
-		IdleTimeout: opt.IdleTimeout,
+		MinIdleConns:    opt.IdleSize,
+		MaxConnAge:      opt.MaxConnAge,
+		PoolTimeout:     opt.PoolTimeout,
+		IdleTimeout:     opt.IdleTimeout,
 		//IdleCheckFrequency: opt.IdleCheckFrequency,
+		TLSConfig: tlsConfig,
+		OnConnect: onConnect,
+	}
+	if redisOpt.MaxRetries == 0 {
+		redisOpt.MaxRetries = 3
+	}
+	switch opt.Network {
+	case "", "tcp":
+	case "unix":
+		redisOpt.Network = "unix"
+		redisOpt.Addr = opt.Host
+	default:
+		return nil, fmt.Errorf("redis: unknown network %q", opt.Network)
+	}
+
+	readFrom := opt.ReadFrom
+	if readFrom == "" {
+		readFrom = RedisReadMaster
 	}
-	return newRedis(goRedis.NewClient(redisOpt), log), nil
+	switch readFrom {
+	case RedisReadMaster, RedisReadReplica, RedisReadLatency, RedisReadRandom:
+	default:
+		return nil, fmt.Errorf("redis: unknown read_from %q", opt.ReadFrom)
+	}
+
+	switch opt.Mode {
+	case "", RedisModeSingle:
+		if readFrom != RedisReadMaster {
+			return nil, fmt.Errorf("redis: read_from %q requires sentinel or cluster mode", readFrom)
+		}
+		return goRedis.NewClient(redisOpt), nil
+	case RedisModeSentinel:
+		if opt.MasterName == "" || len(opt.SentinelAddrs) == 0 {
+			return nil, errors.New("redis: sentinel mode requires master_name and sentinel_addrs")
+		}
+		failoverOpt := &goRedis.FailoverOptions{
+			MasterName:       opt.MasterName,
+			SentinelAddrs:    opt.SentinelAddrs,
+			SentinelUsername: opt.SentinelUsername,
+			SentinelPassword: opt.SentinelPassword,
+			RouteByLatency:   readFrom == RedisReadLatency,
+			RouteRandomly:    readFrom == RedisReadRandom,
+			Username:         redisOpt.Username,
+			Password:         redisOpt.Password,
+			DB:               redisOpt.DB,
+			MaxRetries:       redisOpt.MaxRetries,
+			MinRetryBackoff:  redisOpt.MinRetryBackoff,
+			MaxRetryBackoff:  redisOpt.MaxRetryBackoff,
+			DialTimeout:      redisOpt.DialTimeout,
+			ReadTimeout:      redisOpt.ReadTimeout,
+			WriteTimeout:     redisOpt.WriteTimeout,
+			PoolSize:         redisOpt.PoolSize,
+			MinIdleConns:     redisOpt.MinIdleConns,
+			MaxConnAge:       redisOpt.MaxConnAge,
+			PoolTimeout:      redisOpt.PoolTimeout,
+			IdleTimeout:      redisOpt.IdleTimeout,
+			TLSConfig:        redisOpt.TLSConfig,
+			OnConnect:        redisOpt.OnConnect,
+		}
+		switch readFrom {
+		case RedisReadMaster:
+			return goRedis.NewFailoverClient(failoverOpt), nil
+		case RedisReadReplica:
+			return nil, errors.New("redis: read_from replica requires cluster mode, use latency or random")
+		}
+		// 按延迟或随机路由只读命令需要 cluster 客户端，不支持选择 db
+		if opt.DB != 0 {
+			return nil, fmt.Errorf("redis: read_from %q in sentinel mode requires db 0", readFrom)
+		}
+		return goRedis.NewFailoverClusterClient(failoverOpt), nil
+	case RedisModeCluster:
+		if len(opt.ClusterAddrs) == 0 {
+			return nil, errors.New("redis: cluster mode requires cluster_addrs")
+		}
+		return goRedis.NewClusterClient(&goRedis.ClusterOptions{
+			Addrs:           opt.ClusterAddrs,
+			ReadOnly:        readFrom == RedisReadReplica,
+			RouteByLatency:  readFrom == RedisReadLatency,
+			RouteRandomly:   readFrom == RedisReadRandom,
+			Username:        redisOpt.Username,
+			Password:        redisOpt.Password,
+			MaxRetries:      redisOpt.MaxRetries,
+			MinRetryBackoff: redisOpt.MinRetryBackoff,
+			MaxRetryBackoff: redisOpt.MaxRetryBackoff,
+			DialTimeout:     redisOpt.DialTimeout,
+			ReadTimeout:     redisOpt.ReadTimeout,
+			WriteTimeout:    redisOpt.WriteTimeout,
+			PoolSize:        redisOpt.PoolSize,
+			MinIdleConns:    redisOpt.MinIdleConns,
+			MaxConnAge:      redisOpt.MaxConnAge,
+			PoolTimeout:     redisOpt.PoolTimeout,
+			IdleTimeout:     redisOpt.IdleTimeout,
+			TLSConfig:       redisOpt.TLSConfig,
+			OnConnect:       redisOpt.OnConnect,
+			NewClient: func(opt *goRedis.Options) *goRedis.Client {
+				node := goRedis.NewClient(opt)
+				node.AddHook(prefix)
+				return node
+			},
+		}), nil
+	}
+
+	return nil, fmt.Errorf("redis: unknown mode %q", opt.Mode)
+}
+
+// newRedisTLSConfig 按配置加载证书，cnf 为空时返回 nil
+func newRedisTLSConfig(cnf *RedisTLSConfig) (*tls.Config, error) {
+	if cnf == nil {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cnf.ServerName,
+		InsecureSkipVerify: cnf.InsecureSkipVerify,
+	}
+	if cnf.CAFile != "" {
+		pem, err := ioutil.ReadFile(cnf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("redis: read tls ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("redis: no certificate in %s", cnf.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cnf.CertFile != "" || cnf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cnf.CertFile, cnf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("redis: load tls cert: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
 }
 
-// LogLevel 日志级别
+// durationOr 未配置时使用默认值，负数原样交给 go-redis：超时为不超时，退避为不等待
+func durationOr(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// LogLevel 日志级别，零值为 LogInfo
 type LogLevel int
 
+const (
+	// LogInfo 正常命令以 Info 级别记录，默认
+	LogInfo LogLevel = iota
+	// LogDebug 正常命令以 Debug 级别记录
+	LogDebug
+	// LogWarn 正常命令以 Warn 级别记录
+	LogWarn
+	// LogOff 不记录正常命令，慢命令和失败的命令仍然记录
+	LogOff
+)
+
+// UnmarshalYAML 配置文件中写作 debug|info|warn|off
+func (l *LogLevel) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	switch strings.ToLower(s) {
+	case "", "info":
+		*l = LogInfo
+	case "debug":
+		*l = LogDebug
+	case "warn":
+		*l = LogWarn
+	case "off":
+		*l = LogOff
+	default:
+		return fmt.Errorf("redis: unknown log level %q", s)
+	}
+	return nil
+}
+
+const (
+	defaultExecSlowTime = 100 * time.Millisecond
+	defaultLogArgMaxLen = 256
+	// 单条日志最多记录的参数个数
+	logArgMaxCount = 64
+)
+
 type timeKey string
 
 const (
 	startKey timeKey = "start-time"
 )
 
-func newRedis(client *goRedis.Client, log log.Logger) *Redis {
-	client.AddHook(&hook{
-		log: log,
-	})
-	return &Redis{client}
+func newRedis(client goRedis.UniversalClient, log log.Logger, opt *RedisConfig, scripts *scriptRegistry, prefix *prefixHook) *Redis {
+	// 先加前缀，日志中记录实际的键
+	client.AddHook(prefix)
+	h := newHook(log, opt, scripts)
+	client.AddHook(h)
+	return &Redis{UniversalClient: client, log: log, scripts: scripts, stats: h.stats}
+}
+
+func newHook(log log.Logger, opt *RedisConfig, scripts *scriptRegistry) *hook {
+	h := &hook{
+		log:       log,
+		scripts:   scripts,
+		stats:     newCommandStats(),
+		level:     opt.LogLevel,
+		slow:      opt.ExecSlowTime,
+		argMaxLen: opt.LogArgMaxLen,
+	}
+	if opt.ExecSlowMs > 0 {
+		h.slow = time.Duration(opt.ExecSlowMs) * time.Millisecond
+	}
+	if h.slow <= 0 {
+		h.slow = defaultExecSlowTime
+	}
+	if h.argMaxLen <= 0 {
+		h.argMaxLen = defaultLogArgMaxLen
+	}
+	return h
 }
 
 type hook struct {
-	log   log.Logger
-	level LogLevel //nolint
-	//slow  time.Duration
+	log       log.Logger
+	scripts   *scriptRegistry
+	stats     *commandStats
+	level     LogLevel
+	slow      time.Duration
+	argMaxLen int
 }
 
 func (h *hook) BeforeProcess(ctx context.Context, _ goRedis.Cmder) (context.Context, error) {
@@ -99,13 +357,14 @@ func (h *hook) AfterProcessPipeline(ctx context.Context, cmds []goRedis.Cmder) e
 
 func (h *hook) sweep(ctx context.Context, cmd goRedis.Cmder) {
 	use := time.Since(ctx.Value(startKey).(time.Time))
-	err := cmd.Err()
-	h.log.Info(
-		ctx,
-		"redis_cmd",
-		log.Any("args", cmd.Args()),
+	blocked := isBlocking(cmd)
+	if !blocked {
+		h.stats.observe(cmd.Name(), use)
+	}
+	h.stats.fail(cmd.Name(), cmd.Err())
+	h.write(ctx, "redis_cmd", use, blocked, cmd.Err(),
+		log.Any("args", h.args(cmd.Args())),
 		log.Duration("time", use),
-		log.ErrorType("err", err),
 	)
 }
 
@@ -114,21 +373,97 @@ func (h *hook) sweepPipeline(ctx context.Context, cmds []goRedis.Cmder) {
 	pid := guuid.New().String()
 
 	var firstErr error
+	blocked := false
 	cmdsArgs := make([][]interface{}, 0, len(cmds))
 	for _, cmd := range cmds {
+		blocked = blocked || isBlocking(cmd)
+		h.stats.fail(cmd.Name(), cmd.Err())
 		if firstErr == nil {
 			if err := cmd.Err(); err != nil && err != goRedis.Nil {
 				firstErr = err
 			}
 		}
-		cmdsArgs = append(cmdsArgs, cmd.Args())
+		cmdsArgs = append(cmdsArgs, h.args(cmd.Args()))
 	}
-	h.log.Info(
-		ctx,
-		"redislog",
+	if !blocked {
+		h.stats.observe(pipelineCmd, use)
+	}
+	h.write(ctx, "redislog", use, blocked, firstErr,
 		log.Any("args", cmdsArgs),
 		log.Duration("time", use),
-		log.String("err", firstErr.Error()),
 		log.String("pipeline-id", pid),
 	)
 }
+
+// write 失败（redis.Nil 除外）记录 Error，慢命令记录 Warn，其余按配置的级别记录
+// blocked 为 true 时命令会主动阻塞等待，耗时不代表服务端慢，不按慢命令记录。
+func (h *hook) write(ctx context.Context, msg string, use time.Duration, blocked bool, err error, fields ...log.Field) {
+	if err != nil && err != goRedis.Nil {
+		h.log.Error(ctx, msg, append(fields, log.ErrorType("err", err))...)
+		return
+	}
+	if !blocked && use >= h.slow {
+		h.log.Warn(ctx, msg+"_slow", fields...)
+		return
+	}
+
+	switch h.level {
+	case LogDebug:
+		h.log.Debug(ctx, msg, fields...)
+	case LogInfo:
+		h.log.Info(ctx, msg, fields...)
+	case LogWarn:
+		h.log.Warn(ctx, msg, fields...)
+	}
+}
+
+// isBlocking 判断命令是否会阻塞等待数据：BLPOP 等阻塞命令和带 BLOCK 参数的 XREAD/XREADGROUP
+// 阻塞命令的耗时主要是等待时间，不计入耗时统计，也不按慢命令记录。
+func isBlocking(cmd goRedis.Cmder) bool {
+	switch name := cmd.Name(); name {
+	case "blpop", "brpop", "brpoplpush", "blmove", "blmpop", "bzpopmin", "bzpopmax", "bzmpop":
+		return true
+	case "xread", "xreadgroup":
+		for _, arg := range cmd.Args() {
+			if s, ok := arg.(string); ok && strings.EqualFold(s, "block") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// args 截断过长的参数和过多的参数，避免大值写满日志；已注册的脚本记录脚本名
+func (h *hook) args(args []interface{}) []interface{} {
+	n := len(args)
+	if n > logArgMaxCount {
+		n = logArgMaxCount
+	}
+
+	scriptAt, script := h.scripts.logName(args)
+
+	out := make([]interface{}, 0, n+1)
+	for i, arg := range args[:n] {
+		if i == scriptAt {
+			out = append(out, script)
+			continue
+		}
+		switch v := arg.(type) {
+		case string:
+			if len(v) > h.argMaxLen {
+				arg = v[:h.argMaxLen] + "...(" + strconv.Itoa(len(v)) + " bytes)"
+			}
+		case []byte:
+			if len(v) > h.argMaxLen {
+				arg = string(v[:h.argMaxLen]) + "...(" + strconv.Itoa(len(v)) + " bytes)"
+			} else {
+				arg = string(v)
+			}
+		}
+		out = append(out, arg)
+	}
+	if len(args) > n {
+		out = append(out, "...("+strconv.Itoa(len(args)-n)+" more)")
+	}
+	return out
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+var (
+	// ErrLockNotObtained 锁被其他持有者占用
+	ErrLockNotObtained = errors.New("redis: lock not obtained")
+	// ErrLockNotHeld 锁已过期或被其他持有者获取
+	ErrLockNotHeld = errors.New("redis: lock not held")
+)
+
+const (
+	defaultLockMinBackoff = 10 * time.Millisecond
+	defaultLockMaxBackoff = time.Second
+)
+
+// LockRetry TryLock 的重试策略，零值表示只尝试一次
+type LockRetry struct {
+	// 获取失败后的重试次数
+	Attempts int
+	// 第一次重试前的等待时间，之后每次翻倍，默认 10ms
+	MinBackoff time.Duration
+	// 最长等待时间，默认 1s
+	MaxBackoff time.Duration
+}
+
+// Lock 分布式锁，持有期间每隔 ttl/3 自动续期，ttl <= 0 时锁永不过期
+type Lock struct {
+	client *Redis
+	key    string
+	token  string
+	ttl    time.Duration
+
+	lost     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	lostOnce sync.Once
+}
+
+// Lock 获取锁，被占用时按退避重试直到成功或 ctx 结束
+func (r *Redis) Lock(ctx context.Context, key string, ttl time.Duration) (*Lock, error) {
+	return r.TryLock(ctx, key, ttl, LockRetry{Attempts: -1})
+}
+
+// TryLock 获取锁，被占用时按 retry 重试，Attempts 小于 0 表示一直重试
+// 重试用尽时返回 ErrLockNotObtained，ctx 结束时返回 ctx.Err()。
+func (r *Redis) TryLock(ctx context.Context, key string, ttl time.Duration, retry LockRetry) (*Lock, error) {
+	if retry.MinBackoff <= 0 {
+		retry.MinBackoff = defaultLockMinBackoff
+	}
+	if retry.MaxBackoff <= 0 {
+		retry.MaxBackoff = defaultLockMaxBackoff
+	}
+
+	token := guuid.New().String()
+	wait := retry.MinBackoff
+	for i := 0; ; i++ {
+		ok, err := r.SetNX(ctx, key, token, ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return newLock(r, key, token, ttl), nil
+		}
+		if retry.Attempts >= 0 && i >= retry.Attempts {
+			return nil, ErrLockNotObtained
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		if wait *= 2; wait > retry.MaxBackoff {
+			wait = retry.MaxBackoff
+		}
+	}
+}
+
+func newLock(client *Redis, key, token string, ttl time.Duration) *Lock {
+	l := &Lock{
+		client: client,
+		key:    key,
+		token:  token,
+		ttl:    ttl,
+		lost:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if ttl > 0 {
+		go l.keepAlive()
+	} else {
+		// 永不过期的锁无需续期
+		close(l.done)
+	}
+	return l
+}
+
+// Key 锁的键
+func (l *Lock) Key() string {
+	return l.key
+}
+
+// Token 本次持有的唯一标识，作为锁的值保存
+func (l *Lock) Token() string {
+	return l.token
+}
+
+// Lost 锁丢失（过期或被其他持有者获取）时关闭，Release 不会关闭
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Refresh 手动将过期时间延长为 ttl
+func (l *Lock) Refresh(ctx context.Context, ttl time.Duration) error {
+	n, err := l.client.RunScript(ctx, builtinScriptPrefix+"refresh", []string{l.key}, l.token, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		l.markLost()
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// Release 停止续期并释放锁，锁已不属于自己时返回 ErrLockNotHeld
+func (l *Lock) Release(ctx context.Context) error {
+	l.stopOnce.Do(func() { close(l.stop) })
+	<-l.done
+
+	n, err := l.client.RunScript(ctx, builtinScriptPrefix+"unlock", []string{l.key}, l.token).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// keepAlive 每隔 ttl/3 续期；续期失败持续到锁可能已过期时视为丢失
+func (l *Lock) keepAlive() {
+	defer close(l.done)
+
+	interval := l.ttl / 3
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := l.Refresh(ctx, l.ttl)
+		cancel()
+		switch {
+		case err == nil:
+			renewed = time.Now()
+		case err == ErrLockNotHeld || time.Since(renewed) >= l.ttl:
+			l.markLost()
+			return
+		}
+	}
+}
+
+func (l *Lock) markLost() {
+	l.lostOnce.Do(func() { close(l.lost) })
+}
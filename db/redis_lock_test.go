@@ -0,0 +1,56 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestRedisLock(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	logger := log.New(os.Stdout, log.InfoLevel)
+	redisDB, mr := newTestRedis(t, RedisConfig{LogLevel: LogOff}, logger)
+
+	lock, err := redisDB.TryLock(ctx, "lock:job", 300*time.Millisecond, LockRetry{})
+	assert.Nil(t, err)
+	assert.Equal(t, lock.Token(), redisDB.Get(ctx, "lock:job").Val())
+
+	_, err = redisDB.TryLock(ctx, "lock:job", time.Second, LockRetry{Attempts: 2, MinBackoff: time.Millisecond})
+	assert.Equal(t, ErrLockNotObtained, err)
+
+	// 持有期间自动续期
+	mr.FastForward(200 * time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	mr.FastForward(200 * time.Millisecond)
+	assert.True(t, mr.Exists("lock:job"))
+
+	// 释放后 Lock 可以获取
+	assert.Nil(t, lock.Release(ctx))
+	assert.False(t, mr.Exists("lock:job"))
+	assert.Equal(t, ErrLockNotHeld, lock.Release(ctx))
+
+	lock, err = redisDB.Lock(ctx, "lock:job", 300*time.Millisecond)
+	assert.Nil(t, err)
+
+	// Lock 等待到 ctx 结束
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = redisDB.Lock(waitCtx, "lock:job", time.Second)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// 锁被其他持有者获取后通知丢失，Release 不会删除对方的锁
+	mr.Set("lock:job", "other")
+	select {
+	case <-lock.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lock lost not notified")
+	}
+	assert.Equal(t, ErrLockNotHeld, lock.Release(ctx))
+	assert.True(t, mr.Exists("lock:job"))
+}
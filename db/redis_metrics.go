@@ -0,0 +1,200 @@
+package db
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/metrics"
+	goRedis "github.com/go-redis/redis/v8"
+)
+
+// pipeline 整体的耗时记录在该命令名下
+const pipelineCmd = "pipeline"
+
+// RedisStats 连接池状态和各命令的统计
+type RedisStats struct {
+	// 从连接池取到空闲连接的次数
+	Hits uint32 `json:"hits"`
+	// 连接池中没有空闲连接、新建连接的次数
+	Misses uint32 `json:"misses"`
+	// 等待连接超时的次数，持续增长说明连接池不够用
+	Timeouts uint32 `json:"timeouts"`
+	// 连接总数
+	TotalConns uint32 `json:"total_conns"`
+	// 空闲连接数
+	IdleConns uint32 `json:"idle_conns"`
+	// 因过期被关闭的空闲连接数
+	StaleConns uint32 `json:"stale_conns"`
+	// 各命令的耗时分布，键为小写的命令名，pipeline 整体记录为 pipeline
+	Latency map[string]metrics.HistogramSnapshot `json:"latency"`
+	// 各命令的失败次数，redis.Nil 不算失败
+	Errors map[string]int64 `json:"errors,omitempty"`
+}
+
+// commandStats 由 hook 记录各命令的耗时和失败次数
+type commandStats struct {
+	mu      sync.RWMutex
+	latency map[string]*metrics.Histogram
+	errors  map[string]int64
+}
+
+func newCommandStats() *commandStats {
+	return &commandStats{
+		latency: make(map[string]*metrics.Histogram),
+		errors:  make(map[string]int64),
+	}
+}
+
+func (s *commandStats) observe(cmd string, d time.Duration) {
+	s.mu.RLock()
+	h, ok := s.latency[cmd]
+	s.mu.RUnlock()
+
+	if !ok {
+		s.mu.Lock()
+		if h, ok = s.latency[cmd]; !ok {
+			h = metrics.NewHistogram(nil)
+			s.latency[cmd] = h
+		}
+		s.mu.Unlock()
+	}
+
+	h.Observe(d)
+}
+
+func (s *commandStats) fail(cmd string, err error) {
+	if err == nil || err == goRedis.Nil {
+		return
+	}
+	s.mu.Lock()
+	s.errors[cmd]++
+	s.mu.Unlock()
+}
+
+func (s *commandStats) fill(stats *RedisStats) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats.Latency = make(map[string]metrics.HistogramSnapshot, len(s.latency))
+	for cmd, h := range s.latency {
+		stats.Latency[cmd] = h.Snapshot()
+	}
+	if len(s.errors) > 0 {
+		stats.Errors = make(map[string]int64, len(s.errors))
+		for cmd, n := range s.errors {
+			stats.Errors[cmd] = n
+		}
+	}
+}
+
+// Stats 返回连接池状态和经过 hook 的各命令统计，集群模式下为所有节点的合计
+func (r *Redis) Stats() RedisStats {
+	pool := r.PoolStats()
+	stats := RedisStats{
+		Hits:       pool.Hits,
+		Misses:     pool.Misses,
+		Timeouts:   pool.Timeouts,
+		TotalConns: pool.TotalConns,
+		IdleConns:  pool.IdleConns,
+		StaleConns: pool.StaleConns,
+	}
+	r.stats.fill(&stats)
+	return stats
+}
+
+// RedisCollector 以 Prometheus 文本格式输出已注册客户端的统计，标签 client 为注册时的名称
+type RedisCollector struct {
+	mu      sync.RWMutex
+	clients map[string]*Redis
+}
+
+func NewRedisCollector() *RedisCollector {
+	return &RedisCollector{clients: make(map[string]*Redis)}
+}
+
+// Register 注册客户端，同名客户端会被替换
+func (c *RedisCollector) Register(name string, client *Redis) {
+	c.mu.Lock()
+	c.clients[name] = client
+	c.mu.Unlock()
+}
+
+// Unregister 取消注册
+func (c *RedisCollector) Unregister(name string) {
+	c.mu.Lock()
+	delete(c.clients, name)
+	c.mu.Unlock()
+}
+
+type namedRedisStats struct {
+	name  string
+	stats RedisStats
+}
+
+// WriteTo 输出所有已注册客户端的统计
+func (c *RedisCollector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.RLock()
+	all := make([]namedRedisStats, 0, len(c.clients))
+	for name, client := range c.clients {
+		all = append(all, namedRedisStats{name: name, stats: client.Stats()})
+	}
+	c.mu.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+
+	buf := bytes.Buffer{}
+	pool := []struct {
+		name, help, typ string
+		value           func(s RedisStats) uint32
+	}{
+		{"redis_pool_hits_total", "Number of times an idle connection was found in the pool.", "counter", func(s RedisStats) uint32 { return s.Hits }},
+		{"redis_pool_misses_total", "Number of times a new connection was created.", "counter", func(s RedisStats) uint32 { return s.Misses }},
+		{"redis_pool_timeouts_total", "Number of times waiting for a connection timed out.", "counter", func(s RedisStats) uint32 { return s.Timeouts }},
+		{"redis_pool_total_conns", "Number of connections in the pool.", "gauge", func(s RedisStats) uint32 { return s.TotalConns }},
+		{"redis_pool_idle_conns", "Number of idle connections in the pool.", "gauge", func(s RedisStats) uint32 { return s.IdleConns }},
+		{"redis_pool_stale_conns_total", "Number of stale connections removed from the pool.", "counter", func(s RedisStats) uint32 { return s.StaleConns }},
+	}
+	for _, g := range pool {
+		_ = metrics.WriteHeader(&buf, g.name, g.help, g.typ)
+		for _, s := range all {
+			_ = metrics.WriteSample(&buf, g.name, []metrics.Label{{Name: "client", Value: s.name}}, float64(g.value(s.stats)))
+		}
+	}
+
+	_ = metrics.WriteHeader(&buf, "redis_command_errors_total", "Number of failed redis commands.", "counter")
+	for _, s := range all {
+		cmds := make([]string, 0, len(s.stats.Errors))
+		for cmd := range s.stats.Errors {
+			cmds = append(cmds, cmd)
+		}
+		sort.Strings(cmds)
+		for _, cmd := range cmds {
+			labels := []metrics.Label{{Name: "client", Value: s.name}, {Name: "cmd", Value: cmd}}
+			_ = metrics.WriteSample(&buf, "redis_command_errors_total", labels, float64(s.stats.Errors[cmd]))
+		}
+	}
+
+	_ = metrics.WriteHeader(&buf, "redis_command_duration_seconds", "Latency of redis commands.", "histogram")
+	for _, s := range all {
+		cmds := make([]string, 0, len(s.stats.Latency))
+		for cmd := range s.stats.Latency {
+			cmds = append(cmds, cmd)
+		}
+		sort.Strings(cmds)
+		for _, cmd := range cmds {
+			labels := []metrics.Label{{Name: "client", Value: s.name}, {Name: "cmd", Value: cmd}}
+			_ = metrics.WriteHistogram(&buf, "redis_command_duration_seconds", labels, s.stats.Latency[cmd])
+		}
+	}
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP 可直接挂载为 /metrics
+func (c *RedisCollector) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = c.WriteTo(w)
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	goRedis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestRedisStats(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	logger := log.New(os.Stdout, log.InfoLevel)
+	redisDB, _ := newTestRedis(t, RedisConfig{LogLevel: LogOff}, logger)
+
+	assert.Nil(t, redisDB.Set(ctx, "hachi", "hachi123", 0).Err())
+	assert.Equal(t, "hachi123", redisDB.Get(ctx, "hachi").Val())
+	// redis.Nil 不算失败
+	assert.Equal(t, goRedis.Nil, redisDB.Get(ctx, "missing").Err())
+	assert.NotNil(t, redisDB.Incr(ctx, "hachi").Err())
+	_, err := redisDB.Pipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		pipe.Get(ctx, "hachi")
+		pipe.HGet(ctx, "hachi", "name")
+		return nil
+	})
+	assert.NotNil(t, err)
+
+	stats := redisDB.Stats()
+	assert.Equal(t, uint64(2), stats.Latency["get"].Count)
+	assert.Equal(t, uint64(1), stats.Latency["set"].Count)
+	assert.Equal(t, uint64(1), stats.Latency[pipelineCmd].Count)
+	assert.Equal(t, map[string]int64{"incr": 1, "hget": 1}, stats.Errors)
+	assert.True(t, stats.TotalConns >= 1)
+
+	collector := NewRedisCollector()
+	collector.Register("toruk", redisDB)
+	buf := bytes.Buffer{}
+	_, err = collector.WriteTo(&buf)
+	assert.Nil(t, err)
+
+	out := buf.String()
+	assert.True(t, strings.Contains(out, "# TYPE redis_pool_idle_conns gauge\n"))
+	assert.True(t, strings.Contains(out, `redis_pool_timeouts_total{client="toruk"} 0`+"\n"))
+	assert.True(t, strings.Contains(out, `redis_command_errors_total{client="toruk",cmd="incr"} 1`+"\n"))
+	assert.True(t, strings.Contains(out, `redis_command_duration_seconds_count{client="toruk",cmd="get"} 2`+"\n"))
+
+	rec := httptest.NewRecorder()
+	collector.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+
+	collector.Unregister("toruk")
+	buf.Reset()
+	_, _ = collector.WriteTo(&buf)
+	assert.False(t, strings.Contains(buf.String(), "toruk"))
+}
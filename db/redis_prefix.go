@@ -0,0 +1,249 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	goRedis "github.com/go-redis/redis/v8"
+)
+
+type prefixCtxKey string
+
+const (
+	// 租户前缀
+	tenantPrefixKey prefixCtxKey = "tenant-prefix"
+	// 集群模式下命令先经过集群客户端的 hook，再经过节点客户端的 hook，节点上跳过
+	prefixAppliedKey prefixCtxKey = "prefix-applied"
+	prefixSkipKey    prefixCtxKey = "prefix-skip"
+)
+
+// WithKeyPrefix 返回带租户前缀的 ctx，使用该 ctx 执行的命令的键为 KeyPrefix + prefix + 键
+func WithKeyPrefix(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, tenantPrefixKey, prefix)
+}
+
+func cmdSet(names ...string) map[string]bool {
+	m := make(map[string]bool, len(names))
+	for _, name := range names {
+		m[name] = true
+	}
+	return m
+}
+
+var (
+	// 第一个参数是键
+	firstKeyCmds = cmdSet(
+		"get", "set", "setnx", "setex", "psetex", "getset", "getdel", "getex", "append", "strlen",
+		"incr", "incrby", "incrbyfloat", "decr", "decrby", "getrange", "setrange",
+		"getbit", "setbit", "bitcount", "bitpos", "bitfield",
+		"expire", "pexpire", "expireat", "pexpireat", "ttl", "pttl", "persist", "type", "dump", "restore", "sort",
+		"hget", "hset", "hsetnx", "hmset", "hmget", "hdel", "hexists", "hgetall", "hincrby", "hincrbyfloat",
+		"hkeys", "hvals", "hlen", "hstrlen", "hscan", "hrandfield",
+		"lpush", "rpush", "lpushx", "rpushx", "lpop", "rpop", "llen", "lrange", "lindex", "lset", "lrem",
+		"ltrim", "linsert", "lpos",
+		"sadd", "srem", "smembers", "sismember", "smismember", "scard", "spop", "srandmember", "sscan",
+		"zadd", "zrem", "zscore", "zmscore", "zincrby", "zcard", "zcount", "zlexcount", "zrange", "zrangebyscore",
+		"zrangebylex", "zrevrange", "zrevrangebyscore", "zrevrangebylex", "zrank", "zrevrank",
+		"zremrangebyrank", "zremrangebyscore", "zremrangebylex", "zscan", "zpopmin", "zpopmax", "zrandmember",
+		"pfadd", "geoadd", "geopos", "geodist", "geohash", "georadius_ro", "georadiusbymember_ro", "geosearch",
+		"xadd", "xlen", "xrange", "xrevrange", "xtrim", "xdel", "xack", "xclaim", "xautoclaim", "xpending",
+	)
+	// 第二个参数是键，如 MEMORY USAGE key
+	secondKeyCmds = cmdSet("memory", "object", "xgroup", "xinfo")
+	// 前两个参数是键
+	twoKeysCmds = cmdSet("rename", "renamenx", "rpoplpush", "brpoplpush", "smove", "lmove", "blmove", "copy",
+		"zrangestore", "geosearchstore")
+	// 全部参数都是键
+	allKeysCmds = cmdSet("del", "unlink", "exists", "touch", "mget", "watch",
+		"sinter", "sunion", "sdiff", "sinterstore", "sunionstore", "sdiffstore", "pfcount", "pfmerge")
+	// 除最后一个参数（超时）外都是键
+	blockingCmds = cmdSet("blpop", "brpop", "bzpopmin", "bzpopmax")
+)
+
+// prefixHook 给已知命令的键参数加前缀，从 SCAN 和 KEYS 的结果中去掉前缀
+// 未知命令和 Lua 脚本中拼接出的键不加前缀。
+type prefixHook struct {
+	prefix string
+}
+
+func newPrefixHook(prefix string) *prefixHook {
+	return &prefixHook{prefix: prefix}
+}
+
+// keyPrefix 返回 ctx 对应的完整前缀，ctx 已经处理过时返回空字符串
+func (h *prefixHook) keyPrefix(ctx context.Context) string {
+	if ctx.Value(prefixAppliedKey) != nil {
+		return ""
+	}
+	tenant, _ := ctx.Value(tenantPrefixKey).(string)
+	return h.prefix + tenant
+}
+
+func (h *prefixHook) before(ctx context.Context, cmds []goRedis.Cmder) context.Context {
+	prefix := h.keyPrefix(ctx)
+	if prefix == "" {
+		if ctx.Value(prefixAppliedKey) != nil {
+			return context.WithValue(ctx, prefixSkipKey, true)
+		}
+		return ctx
+	}
+
+	for _, cmd := range cmds {
+		prefixArgs(cmd.Args(), prefix)
+	}
+	return context.WithValue(ctx, prefixAppliedKey, prefix)
+}
+
+func (h *prefixHook) after(ctx context.Context, cmds []goRedis.Cmder) {
+	if ctx.Value(prefixSkipKey) != nil {
+		return
+	}
+	prefix, _ := ctx.Value(prefixAppliedKey).(string)
+	if prefix == "" {
+		return
+	}
+
+	for _, cmd := range cmds {
+		switch c := cmd.(type) {
+		case *goRedis.ScanCmd:
+			if c.Name() == "scan" {
+				keys, cursor := c.Val()
+				c.SetVal(stripPrefix(keys, prefix), cursor)
+			}
+		case *goRedis.StringSliceCmd:
+			if c.Name() == "keys" {
+				c.SetVal(stripPrefix(c.Val(), prefix))
+			}
+		}
+	}
+}
+
+func (h *prefixHook) BeforeProcess(ctx context.Context, cmd goRedis.Cmder) (context.Context, error) {
+	return h.before(ctx, []goRedis.Cmder{cmd}), nil
+}
+
+func (h *prefixHook) AfterProcess(ctx context.Context, cmd goRedis.Cmder) error {
+	h.after(ctx, []goRedis.Cmder{cmd})
+	return nil
+}
+
+func (h *prefixHook) BeforeProcessPipeline(ctx context.Context, cmds []goRedis.Cmder) (context.Context, error) {
+	return h.before(ctx, cmds), nil
+}
+
+func (h *prefixHook) AfterProcessPipeline(ctx context.Context, cmds []goRedis.Cmder) error {
+	h.after(ctx, cmds)
+	return nil
+}
+
+// prefixArgs 原地修改命令参数
+func prefixArgs(args []interface{}, prefix string) {
+	if len(args) < 2 {
+		return
+	}
+	name, _ := args[0].(string)
+	name = strings.ToLower(name)
+
+	add := func(i int) {
+		if key, ok := args[i].(string); ok {
+			args[i] = prefix + key
+		}
+	}
+	addRange := func(from, to int) {
+		for i := from; i < to && i < len(args); i++ {
+			add(i)
+		}
+	}
+
+	switch {
+	case firstKeyCmds[name]:
+		add(1)
+	case secondKeyCmds[name]:
+		addRange(2, 3)
+	case twoKeysCmds[name]:
+		addRange(1, 3)
+	case allKeysCmds[name]:
+		addRange(1, len(args))
+	case blockingCmds[name]:
+		addRange(1, len(args)-1)
+	case name == "mset" || name == "msetnx":
+		for i := 1; i < len(args); i += 2 {
+			add(i)
+		}
+	case name == "eval" || name == "evalsha":
+		// EVAL script numkeys key...
+		addRange(3, 3+argInt(args, 2))
+	case name == "zunionstore" || name == "zinterstore" || name == "zdiffstore":
+		// ZUNIONSTORE dest numkeys key...
+		add(1)
+		addRange(3, 3+argInt(args, 2))
+	case name == "zunion" || name == "zinter" || name == "zdiff":
+		addRange(2, 2+argInt(args, 1))
+	case name == "xread" || name == "xreadgroup":
+		// STREAMS key... id...，键和 ID 各占一半
+		for i := 1; i < len(args); i++ {
+			if s, _ := args[i].(string); strings.ToLower(s) == "streams" {
+				addRange(i+1, i+1+(len(args)-i-1)/2)
+				break
+			}
+		}
+	case name == "keys":
+		if pattern, ok := args[1].(string); ok {
+			args[1] = escapePattern(prefix) + pattern
+		}
+	case name == "scan":
+		// SCAN cursor MATCH pattern，没有 MATCH 时结果中不带前缀的键被过滤掉
+		for i := 2; i+1 < len(args); i++ {
+			if s, _ := args[i].(string); strings.ToLower(s) == "match" {
+				if pattern, ok := args[i+1].(string); ok {
+					args[i+1] = escapePattern(prefix) + pattern
+				}
+				break
+			}
+		}
+	}
+}
+
+func argInt(args []interface{}, i int) int {
+	if i >= len(args) {
+		return 0
+	}
+	switch v := args[i].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+// escapePattern 转义前缀中的 glob 特殊字符
+func escapePattern(s string) string {
+	if !strings.ContainsAny(s, `*?[]\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// stripPrefix 去掉前缀，丢弃不带前缀的键
+func stripPrefix(keys []string, prefix string) []string {
+	out := keys[:0]
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			out = append(out, key[len(prefix):])
+		}
+	}
+	return out
+}
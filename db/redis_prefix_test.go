@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	goRedis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestRedisKeyPrefix(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	logger := log.New(os.Stdout, log.InfoLevel)
+	redisDB, mr := newTestRedis(t, RedisConfig{LogLevel: LogOff, KeyPrefix: "toruk:"}, logger)
+	assert.Nil(t, mr.Set("other:1", "hachi"))
+
+	assert.Nil(t, redisDB.Set(ctx, "book:1", "hachi", 0).Err())
+	assert.Nil(t, redisDB.MSet(ctx, "book:2", "hachi2", "book:3", "hachi3").Err())
+	assert.Equal(t, "hachi", redisDB.Get(ctx, "book:1").Val())
+	assert.Equal(t, []interface{}{"hachi2", "hachi3"}, redisDB.MGet(ctx, "book:2", "book:3").Val())
+	assert.Equal(t, []string{"other:1", "toruk:book:1", "toruk:book:2", "toruk:book:3"}, mr.Keys())
+
+	// 租户前缀加在 KeyPrefix 之后
+	tenant := WithKeyPrefix(ctx, "t1:")
+	assert.Nil(t, redisDB.Set(tenant, "book:1", "tenant", 0).Err())
+	got, _ := mr.Get("toruk:t1:book:1")
+	assert.Equal(t, "tenant", got)
+
+	// pipeline 和脚本
+	_, err := redisDB.Pipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		pipe.Incr(ctx, "counter")
+		pipe.Expire(ctx, "counter", time.Minute)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, mr.Exists("toruk:counter"))
+	n, err := redisDB.Eval(ctx, `return redis.call("incr", KEYS[1])`, []string{"counter"}).Int64()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+
+	// SCAN 和 KEYS 的结果去掉前缀
+	keys, _, err := redisDB.Scan(ctx, 0, "book:*", 100).Result()
+	assert.Nil(t, err)
+	sort.Strings(keys)
+	assert.Equal(t, []string{"book:1", "book:2", "book:3"}, keys)
+	keys, _, err = redisDB.Scan(ctx, 0, "", 100).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(keys))
+	keys, err = redisDB.Keys(tenant, "*").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"book:1"}, keys)
+
+	// SCAN 工具按前缀删除
+	deleted, err := redisDB.DeleteByPattern(ctx, "book:*", DeleteOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), deleted)
+	assert.Equal(t, []string{"other:1", "toruk:counter", "toruk:t1:book:1"}, mr.Keys())
+}
+
+func TestPrefixArgs(t *testing.T) {
+	cases := []struct {
+		args []interface{}
+		want []interface{}
+	}{
+		{[]interface{}{"del", "a", "b"}, []interface{}{"del", "p:a", "p:b"}},
+		{[]interface{}{"rename", "a", "b"}, []interface{}{"rename", "p:a", "p:b"}},
+		{[]interface{}{"blpop", "a", "b", 0}, []interface{}{"blpop", "p:a", "p:b", 0}},
+		{[]interface{}{"memory", "usage", "a"}, []interface{}{"memory", "usage", "p:a"}},
+		{[]interface{}{"evalsha", "sha", 1, "a", "arg"}, []interface{}{"evalsha", "sha", 1, "p:a", "arg"}},
+		{[]interface{}{"zunionstore", "d", 2, "a", "b", "weights", 1, 2}, []interface{}{"zunionstore", "p:d", 2, "p:a", "p:b", "weights", 1, 2}},
+		{[]interface{}{"xreadgroup", "group", "g", "c", "streams", "a", "b", ">", ">"}, []interface{}{"xreadgroup", "group", "g", "c", "streams", "p:a", "p:b", ">", ">"}},
+		{[]interface{}{"scan", 0, "match", "a*", "count", 10}, []interface{}{"scan", 0, "match", "p:a*", "count", 10}},
+		{[]interface{}{"publish", "a", "b"}, []interface{}{"publish", "a", "b"}},
+	}
+	for _, c := range cases {
+		prefixArgs(c.args, "p:")
+		assert.Equal(t, c.want, c.args)
+	}
+
+	args := []interface{}{"keys", "*"}
+	prefixArgs(args, "a*b:")
+	assert.Equal(t, []interface{}{"keys", `a\*b:*`}, args)
+}
@@ -0,0 +1,277 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	goRedis "github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultSubscriberConcurrency = 1
+	defaultSubscriberPing        = 30 * time.Second
+	// 断线重新订阅的退避时间
+	resubscribeMinBackoff = 100 * time.Millisecond
+	resubscribeMaxBackoff = 5 * time.Second
+)
+
+type SubscriberConfig struct {
+	// 同时执行的处理函数数，默认 1，即按收到的顺序逐条处理
+	Concurrency int
+	// 超过该时间没有收到消息时发送 PING 检查连接，默认 30s
+	PingInterval time.Duration
+}
+
+// MessageHandler 处理订阅收到的消息，ctx 与订阅无关，Close 时不会取消
+type MessageHandler func(ctx context.Context, msg *goRedis.Message)
+
+// Subscriber 按频道或模式分发 pub/sub 消息，断线后自动重新订阅全部频道
+// 断线期间发布的消息会丢失，需要可靠投递时使用 stream。
+type Subscriber struct {
+	client *Redis
+	cnf    SubscriberConfig
+
+	mu       sync.RWMutex
+	channels map[string]MessageHandler
+	patterns map[string]MessageHandler
+	ps       *goRedis.PubSub // 当前连接，重新订阅期间为 nil
+
+	jobs      chan *goRedis.Message
+	cancel    context.CancelFunc
+	loop      sync.WaitGroup
+	workers   sync.WaitGroup
+	startOnce sync.Once
+	closeOnce sync.Once
+}
+
+// NewSubscriber 创建订阅者，用 Handle 和 HandlePattern 注册处理函数后调用 Start
+func (r *Redis) NewSubscriber(cnf SubscriberConfig) *Subscriber {
+	if cnf.Concurrency <= 0 {
+		cnf.Concurrency = defaultSubscriberConcurrency
+	}
+	if cnf.PingInterval <= 0 {
+		cnf.PingInterval = defaultSubscriberPing
+	}
+
+	return &Subscriber{
+		client:   r,
+		cnf:      cnf,
+		channels: make(map[string]MessageHandler),
+		patterns: make(map[string]MessageHandler),
+		jobs:     make(chan *goRedis.Message),
+		cancel:   func() {},
+	}
+}
+
+// Handle 注册频道的处理函数，已经 Start 时立即订阅，重复注册覆盖之前的处理函数
+func (s *Subscriber) Handle(ctx context.Context, channel string, h MessageHandler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.channels[channel] = h
+	if s.ps != nil {
+		return s.ps.Subscribe(ctx, channel)
+	}
+	return nil
+}
+
+// HandlePattern 注册模式（PSUBSCRIBE）的处理函数，同时匹配频道和模式的消息两者都会收到
+func (s *Subscriber) HandlePattern(ctx context.Context, pattern string, h MessageHandler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.patterns[pattern] = h
+	if s.ps != nil {
+		return s.ps.PSubscribe(ctx, pattern)
+	}
+	return nil
+}
+
+// Start 在后台订阅并处理消息，直到 Close
+func (s *Subscriber) Start() {
+	s.startOnce.Do(func() {
+		ctx, cancel := context.WithCancel(hctx.GetContext(context.Background(), ""))
+		s.cancel = cancel
+
+		for i := 0; i < s.cnf.Concurrency; i++ {
+			s.workers.Add(1)
+			go func() {
+				defer s.workers.Done()
+				for msg := range s.jobs {
+					s.process(msg)
+				}
+			}()
+		}
+
+		s.loop.Add(1)
+		go func() {
+			defer s.loop.Done()
+			s.run(ctx)
+		}()
+	})
+}
+
+// Close 取消订阅并等待正在执行的处理函数返回
+func (s *Subscriber) Close() error {
+	s.closeOnce.Do(func() {
+		// 未 Start 时占用 startOnce，避免 Close 之后再启动
+		s.startOnce.Do(func() {})
+		s.cancel()
+		// ReceiveTimeout 不响应 ctx，关闭连接使其立即返回
+		s.mu.Lock()
+		if s.ps != nil {
+			_ = s.ps.Close()
+		}
+		s.mu.Unlock()
+		s.loop.Wait()
+		close(s.jobs)
+		s.workers.Wait()
+	})
+	return nil
+}
+
+func (s *Subscriber) run(ctx context.Context) {
+	wait := resubscribeMinBackoff
+	for {
+		err := s.subscribe(ctx, &wait)
+		if ctx.Err() != nil {
+			return
+		}
+
+		channels, patterns := s.names()
+		s.client.log.Warn(ctx, "redis pubsub resubscribe",
+			log.Any("channels", channels),
+			log.Any("patterns", patterns),
+			log.Duration("wait", wait),
+			log.ErrorType("err", err),
+		)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if wait *= 2; wait > resubscribeMaxBackoff {
+			wait = resubscribeMaxBackoff
+		}
+	}
+}
+
+// subscribe 用新连接订阅全部频道并接收消息，连接出错时返回
+func (s *Subscriber) subscribe(ctx context.Context, wait *time.Duration) error {
+	s.mu.Lock()
+	ps := s.client.Subscribe(ctx)
+	channels, patterns := s.namesLocked()
+	var err error
+	if len(channels) > 0 {
+		err = ps.Subscribe(ctx, channels...)
+	}
+	if err == nil && len(patterns) > 0 {
+		err = ps.PSubscribe(ctx, patterns...)
+	}
+	if err == nil {
+		s.ps = ps
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		if s.ps == ps {
+			s.ps = nil
+		}
+		s.mu.Unlock()
+		_ = ps.Close()
+	}()
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := ps.ReceiveTimeout(ctx, s.cnf.PingInterval)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				if err = ps.Ping(ctx); err == nil {
+					continue
+				}
+			}
+			return err
+		}
+
+		switch m := msg.(type) {
+		case *goRedis.Subscription:
+			// 收到订阅确认说明连接恢复
+			*wait = resubscribeMinBackoff
+		case *goRedis.Message:
+			select {
+			case s.jobs <- m:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+func (s *Subscriber) process(msg *goRedis.Message) {
+	s.mu.RLock()
+	h := s.channels[msg.Channel]
+	if msg.Pattern != "" {
+		h = s.patterns[msg.Pattern]
+	}
+	s.mu.RUnlock()
+	if h == nil {
+		return
+	}
+
+	ctx := hctx.GetContext(context.Background(), "")
+	start := time.Now()
+	if err := safeHandleMessage(ctx, h, msg); err != nil {
+		s.client.log.Error(ctx, "redis pubsub handle",
+			log.String("channel", msg.Channel),
+			log.String("pattern", msg.Pattern),
+			log.Duration("time", time.Since(start)),
+			log.ErrorType("err", err),
+		)
+	}
+}
+
+func safeHandleMessage(ctx context.Context, h MessageHandler, msg *goRedis.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("redis pubsub: handler panic: %v", r)
+		}
+	}()
+	h(ctx, msg)
+	return nil
+}
+
+func (s *Subscriber) names() ([]string, []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.namesLocked()
+}
+
+// namesLocked 返回排序后的频道和模式，调用方持有锁
+func (s *Subscriber) namesLocked() ([]string, []string) {
+	channels := make([]string, 0, len(s.channels))
+	for c := range s.channels {
+		channels = append(channels, c)
+	}
+	patterns := make([]string, 0, len(s.patterns))
+	for p := range s.patterns {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(channels)
+	sort.Strings(patterns)
+	return channels, patterns
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	goRedis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestRedisSubscriber(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	logger := log.New(os.Stdout, log.InfoLevel)
+	redisDB, mr := newTestRedis(t, RedisConfig{LogLevel: LogOff}, logger)
+
+	books := make(chan string, 10)
+	events := make(chan string, 10)
+	sub := redisDB.NewSubscriber(SubscriberConfig{Concurrency: 2})
+	assert.Nil(t, sub.Handle(ctx, "books", func(ctx context.Context, msg *goRedis.Message) {
+		if msg.Payload == "panic" {
+			panic("hachi")
+		}
+		books <- msg.Payload
+	}))
+	assert.Nil(t, sub.HandlePattern(ctx, "event:*", func(ctx context.Context, msg *goRedis.Message) {
+		events <- msg.Channel + "=" + msg.Payload
+	}))
+	sub.Start()
+	waitSubscribed(t, redisDB, "books")
+
+	// 处理函数 panic 不影响后续消息
+	assert.Nil(t, redisDB.Publish(ctx, "books", "panic").Err())
+	assert.Nil(t, redisDB.Publish(ctx, "books", "hachi").Err())
+	assert.Nil(t, redisDB.Publish(ctx, "event:created", "42").Err())
+	assert.Equal(t, "hachi", receive(t, books))
+	assert.Equal(t, "event:created=42", receive(t, events))
+
+	// Start 之后注册的频道立即订阅
+	var dogs int32
+	assert.Nil(t, sub.Handle(ctx, "dogs", func(ctx context.Context, msg *goRedis.Message) {
+		atomic.AddInt32(&dogs, 1)
+	}))
+	waitSubscribed(t, redisDB, "dogs")
+	assert.Nil(t, redisDB.Publish(ctx, "dogs", "hachi").Err())
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&dogs) == 1 }, time.Second, 10*time.Millisecond)
+
+	// 断线后重新订阅全部频道
+	mr.Close()
+	assert.Nil(t, mr.Restart())
+	waitSubscribed(t, redisDB, "books")
+	waitSubscribed(t, redisDB, "dogs")
+	assert.Nil(t, redisDB.Publish(ctx, "books", "hachi2").Err())
+	assert.Equal(t, "hachi2", receive(t, books))
+
+	// Close 之后不再接收
+	assert.Nil(t, sub.Close())
+	assert.Nil(t, sub.Close())
+	assert.Eventually(t, func() bool {
+		return redisDB.PubSubNumSub(ctx, "books").Val()["books"] == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func waitSubscribed(t *testing.T, redisDB *Redis, channel string) {
+	ctx := hctx.GetContext(context.Background(), "")
+	assert.Eventually(t, func() bool {
+		return redisDB.PubSubNumSub(ctx, channel).Val()[channel] == 1
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func receive(t *testing.T, ch <-chan string) string {
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+		return ""
+	}
+}
@@ -0,0 +1,270 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	goRedis "github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultScanCount   = 100
+	defaultDeleteBatch = 100
+	defaultBigKeysTopN = 10
+)
+
+// ErrEmptyPattern 按模式删除时模式为空
+var ErrEmptyPattern = errors.New("redis: empty pattern")
+
+type ScanOptions struct {
+	// 匹配模式，为空时遍历全部键
+	Match string
+	// 每次 SCAN 的 COUNT 提示，默认 100
+	Count int64
+	// 只返回该类型的键（SCAN TYPE，需要 redis 6.0）
+	Type string
+}
+
+// ScanKeys 用 SCAN 遍历键，每次 SCAN 的结果调用一次 fn，fn 返回错误时停止遍历
+// 集群模式下依次遍历每个主节点，client 为键所在的节点；其他模式下 client 为 r 本身。
+// 遍历期间修改的键可能被跳过或重复返回。
+func (r *Redis) ScanKeys(ctx context.Context, opt ScanOptions, fn func(ctx context.Context, client goRedis.Cmdable, keys []string) error) error {
+	if opt.Count <= 0 {
+		opt.Count = defaultScanCount
+	}
+
+	if cluster, ok := r.UniversalClient.(*goRedis.ClusterClient); ok {
+		// ForEachMaster 并发执行，这里逐个节点遍历，避免同时对所有节点施加压力
+		var mu sync.Mutex
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *goRedis.Client) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return scanNode(ctx, node, opt, fn)
+		})
+	}
+	return scanNode(ctx, r.UniversalClient, opt, fn)
+}
+
+func scanNode(ctx context.Context, client goRedis.Cmdable, opt ScanOptions, fn func(ctx context.Context, client goRedis.Cmdable, keys []string) error) error {
+	var cursor uint64
+	for {
+		var keys []string
+		var err error
+		if opt.Type != "" {
+			keys, cursor, err = client.ScanType(ctx, cursor, opt.Match, opt.Count, opt.Type).Result()
+		} else {
+			keys, cursor, err = client.Scan(ctx, cursor, opt.Match, opt.Count).Result()
+		}
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err = fn(ctx, client, keys); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+type DeleteOptions struct {
+	// 每批删除的键数，默认 100
+	BatchSize int
+	// 每秒最多删除的键数，0 表示不限制
+	RatePerSecond int
+	// 只统计匹配的键数，不删除
+	DryRun bool
+}
+
+// DeleteByPattern 用 SCAN 找到匹配的键，分批 UNLINK，返回删除（DryRun 时为匹配）的键数
+// 按 RatePerSecond 在批次之间等待，避免删除大量键时阻塞 redis；出错时返回已删除的键数。
+func (r *Redis) DeleteByPattern(ctx context.Context, pattern string, opt DeleteOptions) (int64, error) {
+	if pattern == "" {
+		return 0, ErrEmptyPattern
+	}
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = defaultDeleteBatch
+	}
+	var interval time.Duration
+	if opt.RatePerSecond > 0 {
+		interval = time.Second * time.Duration(opt.BatchSize) / time.Duration(opt.RatePerSecond)
+	}
+
+	start := time.Now()
+	var total int64
+	var next time.Time
+	deleteBatch := func(ctx context.Context, client goRedis.Cmdable, keys []string) error {
+		if opt.DryRun {
+			total += int64(len(keys))
+			return nil
+		}
+		if wait := time.Until(next); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		next = time.Now().Add(interval)
+
+		// 逐个 UNLINK，集群模式下同一节点的键也可能属于不同的槽
+		cmds, err := client.Pipelined(ctx, func(pipe goRedis.Pipeliner) error {
+			for _, key := range keys {
+				pipe.Unlink(ctx, key)
+			}
+			return nil
+		})
+		for _, cmd := range cmds {
+			total += cmd.(*goRedis.IntCmd).Val()
+		}
+		return err
+	}
+
+	err := r.ScanKeys(ctx, ScanOptions{Match: pattern, Count: int64(opt.BatchSize)}, func(ctx context.Context, client goRedis.Cmdable, keys []string) error {
+		for len(keys) > 0 {
+			n := opt.BatchSize
+			if n > len(keys) {
+				n = len(keys)
+			}
+			if err := deleteBatch(ctx, client, keys[:n]); err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+		return nil
+	})
+
+	fields := []log.Field{
+		log.String("pattern", pattern),
+		log.Int64("keys", total),
+		log.Any("dry_run", opt.DryRun),
+		log.Duration("time", time.Since(start)),
+	}
+	if err != nil {
+		r.log.Error(ctx, "redis delete by pattern", append(fields, log.ErrorType("err", err))...)
+		return total, err
+	}
+	r.log.Info(ctx, "redis delete by pattern", fields...)
+	return total, nil
+}
+
+// BigKey 占用内存较多的键
+type BigKey struct {
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	Bytes int64  `json:"bytes"`
+}
+
+type BigKeysOptions struct {
+	// 匹配模式，为空时遍历全部键
+	Match string
+	// 每种类型返回的键数，默认 10
+	TopN int
+	// 每次 SCAN 的 COUNT 提示，默认 100
+	Count int64
+	// MEMORY USAGE 对集合类型的采样数，0 使用 redis 的默认值 5
+	Samples int
+}
+
+// BigKeys 用 MEMORY USAGE 统计每个键占用的内存，按类型返回占用最多的 TopN 个键，从大到小排序
+// 需要对每个键执行 TYPE 和 MEMORY USAGE，键较多时应在从节点或低峰期执行。
+func (r *Redis) BigKeys(ctx context.Context, opt BigKeysOptions) (map[string][]BigKey, error) {
+	if opt.TopN <= 0 {
+		opt.TopN = defaultBigKeysTopN
+	}
+
+	top := make(map[string][]BigKey)
+	err := r.ScanKeys(ctx, ScanOptions{Match: opt.Match, Count: opt.Count}, func(ctx context.Context, client goRedis.Cmdable, keys []string) error {
+		types := make([]*goRedis.StatusCmd, len(keys))
+		usages := make([]*goRedis.IntCmd, len(keys))
+		_, err := client.Pipelined(ctx, func(pipe goRedis.Pipeliner) error {
+			for i, key := range keys {
+				types[i] = pipe.Type(ctx, key)
+				if opt.Samples > 0 {
+					usages[i] = pipe.MemoryUsage(ctx, key, opt.Samples)
+				} else {
+					usages[i] = pipe.MemoryUsage(ctx, key)
+				}
+			}
+			return nil
+		})
+		// 遍历期间被删除的键 MEMORY USAGE 返回 nil
+		if err != nil && err != goRedis.Nil {
+			return err
+		}
+
+		for i, key := range keys {
+			typ := types[i].Val()
+			if typ == "none" || usages[i].Err() != nil {
+				continue
+			}
+			top[typ] = append(top[typ], BigKey{Key: key, Type: typ, Bytes: usages[i].Val()})
+			if len(top[typ]) >= 2*opt.TopN {
+				top[typ] = sortBigKeys(top[typ])[:opt.TopN]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for typ, keys := range top {
+		keys = sortBigKeys(keys)
+		if len(keys) > opt.TopN {
+			keys = keys[:opt.TopN]
+		}
+		top[typ] = keys
+	}
+	return top, nil
+}
+
+func sortBigKeys(keys []BigKey) []BigKey {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Bytes != keys[j].Bytes {
+			return keys[i].Bytes > keys[j].Bytes
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
+
+// CountByPrefix 按 sep 分隔的前 depth 段统计键数，例如 sep 为 ":"、depth 为 1 时 "book:42:title" 计入 "book"
+// 段数不足 depth 的键按完整的键计数。
+func (r *Redis) CountByPrefix(ctx context.Context, match, sep string, depth int) (map[string]int64, error) {
+	if depth <= 0 {
+		depth = 1
+	}
+
+	counts := make(map[string]int64)
+	err := r.ScanKeys(ctx, ScanOptions{Match: match}, func(_ context.Context, _ goRedis.Cmdable, keys []string) error {
+		for _, key := range keys {
+			counts[keyPrefix(key, sep, depth)]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func keyPrefix(key, sep string, depth int) string {
+	if sep == "" {
+		return key
+	}
+	parts := strings.SplitN(key, sep, depth+1)
+	if len(parts) <= depth {
+		return key
+	}
+	return strings.Join(parts[:depth], sep)
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestRedisDeleteByPattern(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	logger := log.New(os.Stdout, log.InfoLevel)
+	redisDB, mr := newTestRedis(t, RedisConfig{LogLevel: LogOff}, logger)
+
+	for i := 0; i < 250; i++ {
+		assert.Nil(t, mr.Set(fmt.Sprintf("book:%d", i), "hachi"))
+	}
+	assert.Nil(t, mr.Set("user:1", "hachi"))
+
+	_, err := redisDB.DeleteByPattern(ctx, "", DeleteOptions{})
+	assert.Equal(t, ErrEmptyPattern, err)
+
+	// DryRun 只统计
+	n, err := redisDB.DeleteByPattern(ctx, "book:*", DeleteOptions{DryRun: true})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(250), n)
+	assert.Equal(t, 251, len(mr.Keys()))
+
+	n, err = redisDB.DeleteByPattern(ctx, "book:*", DeleteOptions{BatchSize: 50, RatePerSecond: 100000})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(250), n)
+	assert.Equal(t, []string{"user:1"}, mr.Keys())
+}
+
+func TestRedisBigKeys(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	logger := log.New(os.Stdout, log.InfoLevel)
+	redisDB, mr := newTestRedis(t, RedisConfig{LogLevel: LogOff}, logger)
+
+	// miniredis 没有 MEMORY 命令，按键名长度模拟占用的内存
+	assert.Nil(t, mr.Server().Register("MEMORY", func(c *server.Peer, cmd string, args []string) {
+		if len(args) < 2 || strings.ToUpper(args[0]) != "USAGE" {
+			c.WriteError("ERR syntax error")
+			return
+		}
+		if !mr.Exists(args[1]) {
+			c.WriteNull()
+			return
+		}
+		c.WriteInt(len(args[1]) * 10)
+	}))
+
+	assert.Nil(t, mr.Set("book:1", "hachi"))
+	assert.Nil(t, mr.Set("book:100", "hachi"))
+	assert.Nil(t, mr.Set("book:10", "hachi"))
+	mr.HSet("user:1", "name", "hachi")
+	mr.HSet("user:1000", "name", "hachi")
+
+	top, err := redisDB.BigKeys(ctx, BigKeysOptions{TopN: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]BigKey{
+		"string": {{Key: "book:100", Type: "string", Bytes: 80}, {Key: "book:10", Type: "string", Bytes: 70}},
+		"hash":   {{Key: "user:1000", Type: "hash", Bytes: 90}, {Key: "user:1", Type: "hash", Bytes: 60}},
+	}, top)
+
+	counts, err := redisDB.CountByPrefix(ctx, "", ":", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"book": 3, "user": 2}, counts)
+}
+
+func TestKeyPrefix(t *testing.T) {
+	assert.Equal(t, "book", keyPrefix("book:42:title", ":", 1))
+	assert.Equal(t, "book:42", keyPrefix("book:42:title", ":", 2))
+	assert.Equal(t, "book:42", keyPrefix("book:42", ":", 2))
+	assert.Equal(t, "hachi", keyPrefix("hachi", ":", 1))
+	assert.Equal(t, "book:42", keyPrefix("book:42", "", 1))
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"context"
+	"crypto/sha1"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	goRedis "github.com/go-redis/redis/v8"
+)
+
+var (
+	// ErrScriptNotFound 执行未注册的脚本
+	ErrScriptNotFound = errors.New("redis: script not found")
+	// ErrScriptExists 同名脚本已注册且内容不同，或使用了内置脚本的前缀
+	ErrScriptExists = errors.New("redis: script already registered")
+)
+
+// 内置脚本，NewRedis 时自动注册
+//
+//go:embed scripts/*.lua
+var builtinScripts embed.FS
+
+const (
+	scriptExt = ".lua"
+	// 日志中脚本名的前缀，代替 EVAL 的脚本源码和 EVALSHA 的摘要
+	scriptLogPrefix = "script:"
+	// 内置脚本名的前缀，RegisterScript 不能使用
+	builtinScriptPrefix = "builtin:"
+)
+
+type redisScript struct {
+	name string
+	src  string
+	hash string
+}
+
+// scriptRegistry 按名称保存脚本，新建连接时预加载全部脚本
+type scriptRegistry struct {
+	log log.Logger
+
+	mu     sync.RWMutex
+	byName map[string]*redisScript
+	// 摘要和源码到脚本名，用于日志
+	byHash map[string]string
+	bySrc  map[string]string
+}
+
+func newScriptRegistry(log log.Logger) *scriptRegistry {
+	return &scriptRegistry{
+		log:    log,
+		byName: make(map[string]*redisScript),
+		byHash: make(map[string]string),
+		bySrc:  make(map[string]string),
+	}
+}
+
+// add 注册脚本，同名同内容时返回已注册的脚本，同名不同内容时返回 ErrScriptExists
+func (s *scriptRegistry) add(name, src string) (*redisScript, error) {
+	sum := sha1.Sum([]byte(src))
+	script := &redisScript{name: name, src: src, hash: hex.EncodeToString(sum[:])}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.byName[name]; ok {
+		if old.hash != script.hash {
+			return nil, fmt.Errorf("%w: %s", ErrScriptExists, name)
+		}
+		return old, nil
+	}
+	s.byName[name] = script
+	s.byHash[script.hash] = name
+	s.bySrc[src] = name
+	return script, nil
+}
+
+func (s *scriptRegistry) get(name string) (*redisScript, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	script, ok := s.byName[name]
+	return script, ok
+}
+
+func (s *scriptRegistry) all() []*redisScript {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	scripts := make([]*redisScript, 0, len(s.byName))
+	for _, script := range s.byName {
+		scripts = append(scripts, script)
+	}
+	return scripts
+}
+
+// logName 返回命令中脚本源码或摘要的位置和对应的脚本名，未注册的脚本返回 -1
+// 处理 EVAL、EVALSHA 和 SCRIPT LOAD。
+func (s *scriptRegistry) logName(args []interface{}) (int, string) {
+	if len(args) < 2 {
+		return -1, ""
+	}
+	cmd, _ := args[0].(string)
+	i := 1
+	switch strings.ToLower(cmd) {
+	case "eval", "evalsha":
+	case "script":
+		if sub, _ := args[1].(string); strings.ToLower(sub) != "load" || len(args) < 3 {
+			return -1, ""
+		}
+		i = 2
+	default:
+		return -1, ""
+	}
+	v, ok := args[i].(string)
+	if !ok {
+		return -1, ""
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name, ok := s.bySrc[v]
+	if !ok {
+		name, ok = s.byHash[v]
+	}
+	if !ok {
+		return -1, ""
+	}
+	return i, scriptLogPrefix + name
+}
+
+// onConnect 新建连接时加载全部脚本，redis 重启或主从切换后 EVALSHA 不必先失败一次
+// 加载失败不影响连接，执行时仍会退回 EVAL。
+func (s *scriptRegistry) onConnect(ctx context.Context, cn *goRedis.Conn) error {
+	for _, script := range s.all() {
+		if err := cn.ScriptLoad(ctx, script.src).Err(); err != nil {
+			s.log.Warn(ctx, "redis script preload", log.String("script", script.name), log.ErrorType("err", err))
+			continue
+		}
+	}
+	return nil
+}
+
+// RegisterScripts 注册 fsys 中 dir 目录下的全部 *.lua 文件，脚本名为去掉扩展名的文件名
+// 通常 fsys 为 go:embed 嵌入的目录，注册后立即加载到 redis，之后新建的连接也会预加载。
+func (r *Redis) RegisterScripts(ctx context.Context, fsys fs.FS, dir string) error {
+	names, err := fs.Glob(fsys, path.Join(dir, "*"+scriptExt))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		src, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if err = r.RegisterScript(ctx, strings.TrimSuffix(path.Base(name), scriptExt), string(src)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterScript 注册脚本并加载到 redis
+// 同名同内容时只重新加载，同名不同内容或名称以 builtin: 开头时返回 ErrScriptExists。
+func (r *Redis) RegisterScript(ctx context.Context, name, src string) error {
+	if strings.HasPrefix(name, builtinScriptPrefix) {
+		return fmt.Errorf("%w: %s is reserved", ErrScriptExists, name)
+	}
+	script, err := r.scripts.add(name, src)
+	if err != nil {
+		return err
+	}
+	if err := r.ScriptLoad(ctx, script.src).Err(); err != nil {
+		return fmt.Errorf("redis: load script %s: %w", name, err)
+	}
+	return nil
+}
+
+// RunScript 用 EVALSHA 执行已注册的脚本，redis 中没有该脚本（NOSCRIPT）时退回 EVAL
+func (r *Redis) RunScript(ctx context.Context, name string, keys []string, args ...interface{}) *goRedis.Cmd {
+	script, ok := r.scripts.get(name)
+	if !ok {
+		cmd := goRedis.NewCmd(ctx, "evalsha", scriptLogPrefix+name)
+		cmd.SetErr(fmt.Errorf("%w: %s", ErrScriptNotFound, name))
+		return cmd
+	}
+
+	cmd := r.EvalSha(ctx, script.hash, keys, args...)
+	if err := cmd.Err(); err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		return r.Eval(ctx, script.src, keys, args...)
+	}
+	return cmd
+}
+
+// registerBuiltinScripts 以 builtin: 前缀注册内置脚本，只加入注册表，由新建连接时预加载
+func registerBuiltinScripts(scripts *scriptRegistry) {
+	names, _ := fs.Glob(builtinScripts, "scripts/*"+scriptExt)
+	for _, name := range names {
+		src, _ := fs.ReadFile(builtinScripts, name)
+		_, _ = scripts.add(builtinScriptPrefix+strings.TrimSuffix(path.Base(name), scriptExt), string(src))
+	}
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	goRedis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func TestRedisScript(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, log.DebugLevel)
+	redisDB, _ := newTestRedis(t, RedisConfig{LogLevel: LogDebug}, logger)
+
+	fsys := fstest.MapFS{
+		"lua/incrby.lua": {Data: []byte(`return redis.call("incrby", KEYS[1], ARGV[1])`)},
+		"lua/README.md":  {Data: []byte(`hachi`)},
+	}
+	assert.Nil(t, redisDB.RegisterScripts(ctx, fsys, "lua"))
+
+	n, err := redisDB.RunScript(ctx, "incrby", []string{"hachi"}, 2).Int64()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+
+	// 脚本缓存被清空后退回 EVAL
+	assert.Nil(t, redisDB.ScriptFlush(ctx).Err())
+	n, err = redisDB.RunScript(ctx, "incrby", []string{"hachi"}, 3).Int64()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), n)
+
+	_, err = redisDB.RunScript(ctx, "missing", nil).Result()
+	assert.True(t, errors.Is(err, ErrScriptNotFound))
+
+	// 日志记录脚本名而不是摘要或源码
+	out := buf.String()
+	assert.True(t, strings.Contains(out, "script:incrby"))
+	assert.False(t, strings.Contains(out, "incrby\\\", KEYS"))
+
+	// 内置脚本
+	lock, err := redisDB.TryLock(ctx, "lock:job", 0, LockRetry{})
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Release(ctx))
+	assert.True(t, strings.Contains(buf.String(), "script:builtin:unlock"))
+
+	// 同名不同内容和内置脚本名被拒绝，同名同内容可以重复注册
+	assert.Nil(t, redisDB.RegisterScripts(ctx, fsys, "lua"))
+	err = redisDB.RegisterScript(ctx, "incrby", `return redis.call("decrby", KEYS[1], ARGV[1])`)
+	assert.True(t, errors.Is(err, ErrScriptExists))
+	err = redisDB.RegisterScript(ctx, "builtin:unlock", `return 1`)
+	assert.True(t, errors.Is(err, ErrScriptExists))
+	lock, err = redisDB.TryLock(ctx, "lock:job", 0, LockRetry{})
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Release(ctx))
+}
+
+func TestScriptPreload(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	redisDB, _ := newTestRedis(t, RedisConfig{}, log.Default())
+
+	// 一个脚本加载失败不影响其他脚本
+	scripts := newScriptRegistry(*log.Default())
+	for i := 0; i < 4; i++ {
+		_, err := scripts.add(fmt.Sprintf("bad%d", i), "return (")
+		assert.Nil(t, err)
+	}
+	good, err := scripts.add("good", "return 1")
+	assert.Nil(t, err)
+
+	cn := redisDB.UniversalClient.(*goRedis.Client).Conn(ctx)
+	defer cn.Close()
+	assert.Nil(t, scripts.onConnect(ctx, cn))
+	exists, err := redisDB.ScriptExists(ctx, good.hash).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true}, exists)
+}
@@ -1,12 +1,29 @@
 package db
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
 	"git.zhwenxue.com/zhgo/gocontrib/log"
+	"github.com/alicebob/miniredis/v2"
+	goRedis "github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -42,3 +59,198 @@ func TestAll(t *testing.T) {
 	assert.Nil(t, info.Err())
 	fmt.Println(info.Val())
 }
+
+func TestRedisMode(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx := hctx.GetContext(context.Background(), "")
+
+	mr := miniredis.RunT(t)
+	host, port, _ := net.SplitHostPort(mr.Addr())
+	p, _ := strconv.Atoi(port)
+	redisDB, err := NewRedis(&RedisConfig{Host: host, Port: p, Mode: RedisModeSingle}, *logger)
+	assert.Nil(t, err)
+	assert.Nil(t, redisDB.Set(ctx, "hachi", "hachi123", time.Second*20).Err())
+	assert.Equal(t, "hachi123", redisDB.Get(ctx, "hachi").Val())
+
+	// 集群客户端在第一次执行命令时才连接
+	redisDB, err = NewRedis(&RedisConfig{Mode: RedisModeCluster, ClusterAddrs: []string{mr.Addr()}, ReadFrom: RedisReadReplica}, *logger)
+	assert.Nil(t, err)
+	assert.Nil(t, redisDB.Close())
+	redisDB, err = NewRedis(&RedisConfig{Mode: RedisModeSentinel, MasterName: "mymaster", SentinelAddrs: []string{mr.Addr()}, ReadFrom: RedisReadRandom}, *logger)
+	assert.Nil(t, err)
+	assert.Nil(t, redisDB.Close())
+
+	for _, cnf := range []*RedisConfig{
+		{Mode: "ring"},
+		{Mode: RedisModeSingle, ReadFrom: RedisReadLatency},
+		{Mode: RedisModeSentinel, MasterName: "mymaster"},
+		{Mode: RedisModeSentinel, MasterName: "mymaster", SentinelAddrs: []string{mr.Addr()}, ReadFrom: RedisReadReplica},
+		{Mode: RedisModeSentinel, MasterName: "mymaster", SentinelAddrs: []string{mr.Addr()}, ReadFrom: RedisReadLatency, DB: 1},
+		{Mode: RedisModeCluster},
+		{Mode: RedisModeCluster, ClusterAddrs: []string{mr.Addr()}, ReadFrom: "slave"},
+	} {
+		_, err = NewRedis(cnf, *logger)
+		assert.NotNil(t, err, "%+v", cnf)
+	}
+}
+
+func newTestRedis(t *testing.T, cnf RedisConfig, logger *log.Logger) (*Redis, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	host, port, _ := net.SplitHostPort(mr.Addr())
+	cnf.Host = host
+	cnf.Port, _ = strconv.Atoi(port)
+	redisDB, err := NewRedis(&cnf, *logger)
+	assert.Nil(t, err)
+	return redisDB, mr
+}
+
+func TestRedisHook(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, log.DebugLevel)
+
+	// 关闭正常命令的日志，redis.Nil 不算失败
+	redisDB, _ := newTestRedis(t, RedisConfig{LogLevel: LogOff}, logger)
+	assert.Nil(t, redisDB.Set(ctx, "hachi", "hachi123", 0).Err())
+	_ = redisDB.Get(ctx, "missing")
+	assert.Equal(t, "", buf.String())
+
+	// 失败的命令记录 Error
+	_ = redisDB.Incr(ctx, "hachi")
+	assert.True(t, strings.Contains(buf.String(), `"level":"error"`))
+
+	// 没有失败的 pipeline
+	buf.Reset()
+	redisDB, _ = newTestRedis(t, RedisConfig{LogLevel: LogDebug, LogArgMaxLen: 8}, logger)
+	_, err := redisDB.Pipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		pipe.Set(ctx, "hachi", strings.Repeat("x", 100), 0)
+		pipe.Get(ctx, "hachi")
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(buf.String(), `"level":"debug"`))
+	assert.True(t, strings.Contains(buf.String(), "xxxxxxxx...(100 bytes)"))
+	assert.False(t, strings.Contains(buf.String(), strings.Repeat("x", 9)))
+
+	// 慢命令记录 Warn，ExecSlowMs 单位为毫秒，优先于已废弃的 ExecSlowTime
+	h := newHook(*logger, &RedisConfig{ExecSlowMs: 100, ExecSlowTime: 50 * time.Millisecond}, newScriptRegistry(*logger))
+	assert.Equal(t, 100*time.Millisecond, h.slow)
+	assert.Equal(t, 50*time.Millisecond, newHook(*logger, &RedisConfig{ExecSlowTime: 50 * time.Millisecond}, newScriptRegistry(*logger)).slow)
+	buf.Reset()
+	h.write(ctx, "redis_cmd", 200*time.Millisecond, false, nil)
+	assert.True(t, strings.Contains(buf.String(), `"level":"warn"`))
+	// 阻塞命令的等待时间不算慢
+	buf.Reset()
+	h.sweep(context.WithValue(ctx, startKey, time.Now().Add(-2*time.Second)), goRedis.NewXStreamSliceCmd(ctx, "xreadgroup", "group", "g", "c", "block", 2000, "streams", "s", ">"))
+	h.sweep(context.WithValue(ctx, startKey, time.Now().Add(-2*time.Second)), goRedis.NewStringSliceCmd(ctx, "brpop", "q", 2))
+	assert.False(t, strings.Contains(buf.String(), "_slow"))
+	assert.Equal(t, 0, len(h.stats.latency))
+	h.sweep(context.WithValue(ctx, startKey, time.Now().Add(-2*time.Second)), goRedis.NewStringCmd(ctx, "get", "k"))
+	assert.True(t, strings.Contains(buf.String(), "redis_cmd_slow"))
+
+	var cnf RedisConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("log_level: off\nexec_slow_ms: 50\nexec_slow_time: 80ms"), &cnf))
+	assert.Equal(t, LogOff, cnf.LogLevel)
+	assert.Equal(t, 50, cnf.ExecSlowMs)
+	assert.Equal(t, 80*time.Millisecond, cnf.ExecSlowTime)
+
+	// RedisServerOption 的 LogLevel 同样生效
+	mr := miniredis.RunT(t)
+	host, port, _ := net.SplitHostPort(mr.Addr())
+	p, _ := strconv.Atoi(port)
+	buf.Reset()
+	redisDB, err = NewRedisWithOption(&RedisServerOption{Host: host, Port: p, Log: *logger, LogLevel: LogOff})
+	assert.Nil(t, err)
+	assert.Nil(t, redisDB.Set(ctx, "hachi", "hachi123", 0).Err())
+	assert.Equal(t, "", buf.String())
+	redisDB, _ = NewRedisWithOption(&RedisServerOption{Host: host, Port: p, Log: *logger, LogLevel: LogDebug})
+	assert.Nil(t, redisDB.Set(ctx, "hachi", "hachi123", 0).Err())
+	assert.True(t, strings.Contains(buf.String(), `"level":"debug"`))
+	assert.NotNil(t, yaml.Unmarshal([]byte("log_level: verbose"), &cnf))
+}
+
+func TestRedisConnOptions(t *testing.T) {
+	logger := log.New(os.Stdout, log.InfoLevel)
+	ctx := hctx.GetContext(context.Background(), "")
+
+	// 自签名证书同时作为服务端证书和 CA
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis"},
+		DNSNames:              []string{"redis"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	certFile, keyFile := filepath.Join(dir, "redis.crt"), filepath.Join(dir, "redis.key")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.Nil(t, err)
+	mr, err := miniredis.RunTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.Nil(t, err)
+	defer mr.Close()
+	mr.RequireUserAuth("hachi", "hachi123")
+
+	host, port, _ := net.SplitHostPort(mr.Addr())
+	p, _ := strconv.Atoi(port)
+	cnf := RedisConfig{
+		Host:         host,
+		Port:         p,
+		Username:     "hachi",
+		Password:     "hachi123",
+		IdleSize:     2,
+		MaxConnAge:   time.Minute,
+		DialTimeout:  time.Second,
+		ReadTimeout:  -1,
+		MaxRetries:   -1,
+		TLS:          &RedisTLSConfig{CAFile: certFile, ServerName: "redis"},
+		LogLevel:     LogOff,
+		WriteTimeout: time.Second,
+	}
+	redisDB, err := NewRedis(&cnf, *logger)
+	assert.Nil(t, err)
+	defer redisDB.Close()
+	assert.Nil(t, redisDB.Set(ctx, "hachi", "hachi123", 0).Err())
+	assert.Equal(t, "hachi123", redisDB.Get(ctx, "hachi").Val())
+	assert.Eventually(t, func() bool {
+		return redisDB.PoolStats().IdleConns >= 2
+	}, time.Second, 10*time.Millisecond)
+
+	// 服务端证书不是由系统根证书签发
+	cnf.TLS = &RedisTLSConfig{ServerName: "redis"}
+	redisDB, err = NewRedis(&cnf, *logger)
+	assert.Nil(t, err)
+	assert.NotNil(t, redisDB.Ping(ctx).Err())
+	_ = redisDB.Close()
+
+	// 错误的用户名
+	cnf.TLS = &RedisTLSConfig{InsecureSkipVerify: true}
+	cnf.Username = "toruk"
+	redisDB, err = NewRedis(&cnf, *logger)
+	assert.Nil(t, err)
+	assert.NotNil(t, redisDB.Ping(ctx).Err())
+	_ = redisDB.Close()
+
+	for _, c := range []*RedisConfig{
+		{Network: "udp"},
+		{TLS: &RedisTLSConfig{CAFile: filepath.Join(dir, "missing.crt")}},
+		{TLS: &RedisTLSConfig{CAFile: keyFile}},
+		{TLS: &RedisTLSConfig{CertFile: certFile}},
+	} {
+		_, err = NewRedis(c, *logger)
+		assert.NotNil(t, err, "%+v", c)
+	}
+}
@@ -0,0 +1,5 @@
+-- 仅当值等于 token 时延长过期时间
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
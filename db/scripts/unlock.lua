@@ -0,0 +1,5 @@
+-- 仅当值等于 token 时删除
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
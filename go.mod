@@ -3,6 +3,7 @@ module git.zhwenxue.com/zhgo/gocontrib
 go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.4
 	github.com/coocood/freecache v1.2.0
 	github.com/fortytw2/leaktest v1.3.0 // indirect
 	github.com/go-redis/redis/v8 v8.11.4
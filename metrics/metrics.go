@@ -0,0 +1,170 @@
+// metrics 包提供延迟直方图以及 Prometheus 文本格式的输出
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets 默认的延迟桶上界，单位秒
+var DefaultBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Histogram 固定桶的延迟直方图，并发安全
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sumBits uint64
+}
+
+// NewHistogram buckets 为升序的桶上界，单位秒，为空时使用 DefaultBuckets
+func NewHistogram(buckets []float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Observe 记录一次耗时
+func (h *Histogram) Observe(d time.Duration) {
+	v := d.Seconds()
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// Snapshot 返回直方图当前的快照
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Buckets: make([]Bucket, len(h.buckets)),
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     math.Float64frombits(atomic.LoadUint64(&h.sumBits)),
+	}
+
+	var cumulative uint64
+	for i, upper := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		s.Buckets[i] = Bucket{UpperBound: upper, Count: cumulative}
+	}
+
+	return s
+}
+
+// HistogramSnapshot 直方图快照
+type HistogramSnapshot struct {
+	// 各桶的累计计数
+	Buckets []Bucket `json:"buckets"`
+	// 总次数
+	Count uint64 `json:"count"`
+	// 总耗时，单位秒
+	Sum float64 `json:"sum"`
+}
+
+// Bucket 小于等于 UpperBound 秒的次数
+type Bucket struct {
+	UpperBound float64 `json:"upper_bound"`
+	Count      uint64  `json:"count"`
+}
+
+// Label 指标标签
+type Label struct {
+	Name  string
+	Value string
+}
+
+// WriteHeader 输出指标的 HELP 和 TYPE 行，typ 为 counter|gauge|histogram
+func WriteHeader(w io.Writer, name, help, typ string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+	return err
+}
+
+// WriteSample 输出一行样本
+func WriteSample(w io.Writer, name string, labels []Label, value float64) error {
+	_, err := fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels), formatValue(value))
+	return err
+}
+
+// WriteHistogram 输出直方图的 _bucket、_sum 和 _count 样本
+func WriteHistogram(w io.Writer, name string, labels []Label, s HistogramSnapshot) error {
+	bucketLabels := make([]Label, len(labels), len(labels)+1)
+	copy(bucketLabels, labels)
+	bucketLabels = append(bucketLabels, Label{Name: "le"})
+
+	for _, b := range s.Buckets {
+		bucketLabels[len(labels)].Value = formatValue(b.UpperBound)
+		if err := WriteSample(w, name+"_bucket", bucketLabels, float64(b.Count)); err != nil {
+			return err
+		}
+	}
+	bucketLabels[len(labels)].Value = "+Inf"
+	if err := WriteSample(w, name+"_bucket", bucketLabels, float64(s.Count)); err != nil {
+		return err
+	}
+	if err := WriteSample(w, name+"_sum", labels, s.Sum); err != nil {
+		return err
+	}
+
+	return WriteSample(w, name+"_count", labels, float64(s.Count))
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(l.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.001, 0.01})
+	h.Observe(500 * time.Microsecond)
+	h.Observe(5 * time.Millisecond)
+	h.Observe(time.Second)
+
+	s := h.Snapshot()
+	assert.Equal(t, uint64(3), s.Count)
+	assert.InDelta(t, 1.0055, s.Sum, 1e-9)
+	assert.Equal(t, []Bucket{{UpperBound: 0.001, Count: 1}, {UpperBound: 0.01, Count: 2}}, s.Buckets)
+
+	buf := bytes.Buffer{}
+	labels := []Label{{Name: "cache", Value: `local "l1"`}}
+	assert.Nil(t, WriteHeader(&buf, "cache_op_duration_seconds", "Cache op latency.", "histogram"))
+	assert.Nil(t, WriteHistogram(&buf, "cache_op_duration_seconds", labels, s))
+	assert.Equal(t, `# HELP cache_op_duration_seconds Cache op latency.
+# TYPE cache_op_duration_seconds histogram
+cache_op_duration_seconds_bucket{cache="local \"l1\"",le="0.001"} 1
+cache_op_duration_seconds_bucket{cache="local \"l1\"",le="0.01"} 2
+cache_op_duration_seconds_bucket{cache="local \"l1\"",le="+Inf"} 3
+cache_op_duration_seconds_sum{cache="local \"l1\""} 1.0055
+cache_op_duration_seconds_count{cache="local \"l1\""} 3
+`, buf.String())
+}
@@ -0,0 +1,235 @@
+// delayqueue 包基于 redis 提供延时任务队列，支持可见性超时、失败重试和死信
+package delayqueue
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	goRedis "github.com/go-redis/redis/v8"
+	guuid "github.com/google/uuid"
+)
+
+// Job 任务，ID 相同的任务在完成前只会入队一次
+type Job struct {
+	ID      string    `json:"id"`
+	Payload []byte    `json:"payload"`
+	RunAt   time.Time `json:"run_at"`
+	// 已执行的次数，包括本次，由队列维护；同时作为本次取出的凭证，确认和重试时校验
+	Attempts int `json:"-"`
+}
+
+// DeadJob 重试次数用尽的任务
+type DeadJob struct {
+	Job
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// Stats 队列中各状态的任务数
+type Stats struct {
+	Delayed    int64
+	Ready      int64
+	Processing int64
+	Dead       int64
+}
+
+// Queue 延时队列，所有键使用 {name} 作为 hash tag，在集群模式下位于同一个槽
+// 时间取各实例的本地时钟，实例之间需要保持时钟同步。
+type Queue struct {
+	client     *db.Redis
+	delayed    string // 有序集合，成员为任务 ID，分数为执行时间
+	ready      string // 列表，到期等待执行的任务 ID
+	processing string // 有序集合，分数为可见性超时的截止时间
+	jobs       string // 哈希，任务 ID 到任务内容
+	attempts   string // 哈希，任务 ID 到执行次数
+	dead       string // 列表，死信任务
+}
+
+func NewQueue(client *db.Redis, name string) *Queue {
+	prefix := "delayqueue:{" + name + "}:"
+	return &Queue{
+		client:     client,
+		delayed:    prefix + "delayed",
+		ready:      prefix + "ready",
+		processing: prefix + "processing",
+		jobs:       prefix + "jobs",
+		attempts:   prefix + "attempts",
+		dead:       prefix + "dead",
+	}
+}
+
+var enqueueScript = goRedis.NewScript(`
+if redis.call("HSETNX", KEYS[2], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// Enqueue 在 runAt 执行任务，id 为空时自动生成；同 ID 的任务未完成时返回 false，不会重复入队
+func (q *Queue) Enqueue(ctx context.Context, id string, payload []byte, runAt time.Time) (bool, error) {
+	if id == "" {
+		id = guuid.New().String()
+	}
+	data, err := json.Marshal(Job{ID: id, Payload: payload, RunAt: runAt})
+	if err != nil {
+		return false, err
+	}
+
+	n, err := enqueueScript.Run(ctx, q.client, []string{q.delayed, q.jobs}, id, data, msec(runAt)).Int()
+	return n == 1, err
+}
+
+// EnqueueIn 在 delay 之后执行任务
+func (q *Queue) EnqueueIn(ctx context.Context, id string, payload []byte, delay time.Duration) (bool, error) {
+	return q.Enqueue(ctx, id, payload, time.Now().Add(delay))
+}
+
+// 到期的任务和可见性超时的任务移入就绪列表
+var promoteScript = goRedis.NewScript(`
+local n = 0
+for i = 1, 2 do
+	local ids = redis.call("ZRANGEBYSCORE", KEYS[i], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+	for _, id in ipairs(ids) do
+		redis.call("ZREM", KEYS[i], id)
+		redis.call("RPUSH", KEYS[3], id)
+	end
+	n = n + #ids
+end
+return n
+`)
+
+// promote 返回移入就绪列表的任务数
+func (q *Queue) promote(ctx context.Context, now time.Time, limit int) (int, error) {
+	return promoteScript.Run(ctx, q.client, []string{q.delayed, q.processing, q.ready}, msec(now), limit).Int()
+}
+
+var reserveScript = goRedis.NewScript(`
+while true do
+	local id = redis.call("LPOP", KEYS[1])
+	if not id then
+		return false
+	end
+	local data = redis.call("HGET", KEYS[3], id)
+	if data then
+		redis.call("ZADD", KEYS[2], ARGV[1], id)
+		local attempts = redis.call("HINCRBY", KEYS[4], id, 1)
+		return {data, attempts}
+	end
+end
+`)
+
+// reserve 取出一个就绪任务，在 deadline 之前未确认时重新入队；没有任务时返回 nil
+func (q *Queue) reserve(ctx context.Context, deadline time.Time) (*Job, error) {
+	res, err := reserveScript.Run(ctx, q.client, []string{q.ready, q.processing, q.jobs, q.attempts}, msec(deadline)).Slice()
+	if err == goRedis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var job Job
+	data, _ := res[0].(string)
+	if err = json.Unmarshal([]byte(data), &job); err != nil {
+		return nil, err
+	}
+	attempts, _ := res[1].(int64)
+	job.Attempts = int(attempts)
+
+	return &job, nil
+}
+
+// 任务仍在处理中且执行次数与取出时相同才属于本次取出，KEYS[1] 为 processing，KEYS[2] 为 attempts
+// 可见性超时后任务会被重新取出，执行次数增加，之前的执行者不能再确认或重试。
+const reservedCheck = `
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) or redis.call("HGET", KEYS[2], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+`
+
+var ackScript = goRedis.NewScript(reservedCheck + `
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("HDEL", KEYS[3], ARGV[1])
+return 1
+`)
+
+// ack 任务完成，删除任务；任务已被重新取出时返回 false
+func (q *Queue) ack(ctx context.Context, job *Job) (bool, error) {
+	n, err := ackScript.Run(ctx, q.client, []string{q.processing, q.attempts, q.jobs}, job.ID, job.Attempts).Int()
+	return n == 1, err
+}
+
+var retryScript = goRedis.NewScript(reservedCheck + `
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1])
+return 1
+`)
+
+// retry 任务在 runAt 重新执行；任务已因可见性超时重新入队或被重新取出时返回 false
+func (q *Queue) retry(ctx context.Context, job *Job, runAt time.Time) (bool, error) {
+	n, err := retryScript.Run(ctx, q.client, []string{q.processing, q.attempts, q.delayed}, job.ID, job.Attempts, msec(runAt)).Int()
+	return n == 1, err
+}
+
+var buryScript = goRedis.NewScript(reservedCheck + `
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("HDEL", KEYS[3], ARGV[1])
+redis.call("RPUSH", KEYS[4], ARGV[3])
+return 1
+`)
+
+// bury 任务移入死信列表；任务已被重新取出时返回 false
+func (q *Queue) bury(ctx context.Context, job *Job, cause error) (bool, error) {
+	data, err := json.Marshal(DeadJob{Job: *job, Attempts: job.Attempts, Error: cause.Error(), FailedAt: time.Now()})
+	if err != nil {
+		return false, err
+	}
+	n, err := buryScript.Run(ctx, q.client, []string{q.processing, q.attempts, q.jobs, q.dead}, job.ID, job.Attempts, data).Int()
+	return n == 1, err
+}
+
+// Dead 返回最早的 n 个死信任务
+func (q *Queue) Dead(ctx context.Context, n int64) ([]DeadJob, error) {
+	items, err := q.client.LRange(ctx, q.dead, 0, n-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]DeadJob, 0, len(items))
+	for _, item := range items {
+		var job DeadJob
+		if err = json.Unmarshal([]byte(item), &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (q *Queue) Stats(ctx context.Context) (Stats, error) {
+	pipe := q.client.Pipeline()
+	delayed := pipe.ZCard(ctx, q.delayed)
+	ready := pipe.LLen(ctx, q.ready)
+	processing := pipe.ZCard(ctx, q.processing)
+	dead := pipe.LLen(ctx, q.dead)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Stats{}, err
+	}
+
+	return Stats{
+		Delayed:    delayed.Val(),
+		Ready:      ready.Val(),
+		Processing: processing.Val(),
+		Dead:       dead.Val(),
+	}, nil
+}
+
+func msec(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
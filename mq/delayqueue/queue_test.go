@@ -0,0 +1,131 @@
+package delayqueue
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func newTestQueue(t *testing.T) *Queue {
+	mr := miniredis.RunT(t)
+	host, port, _ := net.SplitHostPort(mr.Addr())
+	p, _ := strconv.Atoi(port)
+	client, err := db.NewRedis(&db.RedisConfig{Host: host, Port: p, LogLevel: db.LogOff}, *log.Default())
+	assert.Nil(t, err)
+	return NewQueue(client, "reminders")
+}
+
+func TestQueue(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	q := newTestQueue(t)
+	now := time.Now()
+
+	ok, err := q.Enqueue(ctx, "job:1", []byte("hachi"), now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	// 同 ID 去重
+	ok, err = q.Enqueue(ctx, "job:1", []byte("hachi"), now)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 未到期
+	n, err := q.promote(ctx, now, promoteBatch)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	n, _ = q.promote(ctx, now.Add(time.Minute), promoteBatch)
+	assert.Equal(t, 1, n)
+
+	job, err := q.reserve(ctx, now.Add(2*time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, "job:1", job.ID)
+	assert.Equal(t, []byte("hachi"), job.Payload)
+	assert.Equal(t, 1, job.Attempts)
+	none, _ := q.reserve(ctx, now)
+	assert.Nil(t, none)
+
+	// 可见性超时后重新入队
+	n, _ = q.promote(ctx, now.Add(2*time.Minute), promoteBatch)
+	assert.Equal(t, 1, n)
+	// 超时的执行者在重新取出前后都不能确认或重试
+	ok, err = q.retry(ctx, job, now)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	stale := job
+	job, _ = q.reserve(ctx, now.Add(3*time.Minute))
+	assert.Equal(t, 2, job.Attempts)
+	ok, _ = q.retry(ctx, stale, now)
+	assert.False(t, ok)
+	ok, _ = q.ack(ctx, stale)
+	assert.False(t, ok)
+	ok, _ = q.bury(ctx, stale, errors.New("stale"))
+	assert.False(t, ok)
+	stats, _ := q.Stats(ctx)
+	assert.Equal(t, Stats{Processing: 1}, stats)
+
+	ok, err = q.ack(ctx, job)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	stats, err = q.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, Stats{}, stats)
+	// 完成后可以再次入队
+	ok, _ = q.Enqueue(ctx, "job:1", nil, now)
+	assert.True(t, ok)
+}
+
+func TestWorker(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	q := newTestQueue(t)
+
+	_, _ = q.EnqueueIn(ctx, "job:ok", []byte("ok"), 30*time.Millisecond)
+	_, _ = q.EnqueueIn(ctx, "job:bad", []byte("bad"), 0)
+
+	var mu sync.Mutex
+	runs := make(map[string]int)
+	w := NewWorker(q, WorkerConfig{
+		Concurrency:  2,
+		PollInterval: 5 * time.Millisecond,
+		MaxAttempts:  3,
+		MinBackoff:   10 * time.Millisecond,
+	}, func(ctx context.Context, job Job) error {
+		mu.Lock()
+		runs[job.ID]++
+		mu.Unlock()
+		if job.ID == "job:bad" {
+			return errors.New("bad job")
+		}
+		return nil
+	}, log.Default())
+
+	runCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, w.Run(runCtx))
+
+	mu.Lock()
+	assert.Equal(t, map[string]int{"job:ok": 1, "job:bad": 3}, runs)
+	mu.Unlock()
+
+	stats, _ := q.Stats(ctx)
+	assert.Equal(t, Stats{Dead: 1}, stats)
+	dead, err := q.Dead(ctx, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(dead))
+	assert.Equal(t, "job:bad", dead[0].ID)
+	assert.Equal(t, 3, dead[0].Attempts)
+	assert.Equal(t, "bad job", dead[0].Error)
+
+	assert.Equal(t, time.Second, NewWorker(q, WorkerConfig{}, nil, log.Default()).backoff(1))
+	assert.Equal(t, 4*time.Second, NewWorker(q, WorkerConfig{}, nil, log.Default()).backoff(3))
+	assert.Equal(t, 10*time.Minute, NewWorker(q, WorkerConfig{}, nil, log.Default()).backoff(20))
+}
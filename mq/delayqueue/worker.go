@@ -0,0 +1,220 @@
+package delayqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+const (
+	defaultPollInterval      = time.Second
+	defaultVisibilityTimeout = 30 * time.Second
+	defaultMaxAttempts       = 5
+	defaultMinBackoff        = time.Second
+	defaultMaxBackoff        = 10 * time.Minute
+	// 每次移入就绪列表的最大任务数
+	promoteBatch = 100
+)
+
+// errVisibilityTimeout 任务最后一次执行超过可见性超时仍未确认
+var errVisibilityTimeout = errors.New("delayqueue: visibility timeout exceeded")
+
+type WorkerConfig struct {
+	// 并发执行的任务数，默认 1
+	Concurrency int `yaml:"concurrency"`
+	// 没有任务时的轮询间隔，也是移入到期任务的间隔，默认 1s
+	PollInterval time.Duration `yaml:"pollInterval"`
+	// 任务取出后未确认超过该时间会重新入队，应大于执行一个任务的最长时间，默认 30s
+	VisibilityTimeout time.Duration `yaml:"visibilityTimeout"`
+	// 最多执行次数，之后移入死信，默认 5
+	MaxAttempts int `yaml:"maxAttempts"`
+	// 第一次重试的等待时间，之后每次翻倍，默认 1s
+	MinBackoff time.Duration `yaml:"minBackoff"`
+	// 重试的最长等待时间，默认 10m
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+// Handler 执行任务，返回 nil 时任务完成，否则按退避重试
+type Handler func(ctx context.Context, job Job) error
+
+type Worker struct {
+	queue   *Queue
+	cnf     WorkerConfig
+	handler Handler
+	log     *log.Logger
+}
+
+func NewWorker(queue *Queue, cnf WorkerConfig, handler Handler, logger *log.Logger) *Worker {
+	if cnf.Concurrency <= 0 {
+		cnf.Concurrency = 1
+	}
+	if cnf.PollInterval <= 0 {
+		cnf.PollInterval = defaultPollInterval
+	}
+	if cnf.VisibilityTimeout <= 0 {
+		cnf.VisibilityTimeout = defaultVisibilityTimeout
+	}
+	if cnf.MaxAttempts <= 0 {
+		cnf.MaxAttempts = defaultMaxAttempts
+	}
+	if cnf.MinBackoff <= 0 {
+		cnf.MinBackoff = defaultMinBackoff
+	}
+	if cnf.MaxBackoff <= 0 {
+		cnf.MaxBackoff = defaultMaxBackoff
+	}
+
+	return &Worker{queue: queue, cnf: cnf, handler: handler, log: logger}
+}
+
+// Run 执行任务直到 ctx 结束，之后等待正在执行的任务完成后返回
+// 执行任务时使用独立的 ctx，不会因为关闭而中断。
+func (w *Worker) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.promote(ctx)
+	}()
+	for i := 0; i < w.cnf.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work(ctx)
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// promote 定期将到期和超时的任务移入就绪列表
+func (w *Worker) promote(ctx context.Context) {
+	ticker := time.NewTicker(w.cnf.PollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := w.queue.promote(ctx, time.Now(), promoteBatch)
+			if err != nil {
+				if ctx.Err() == nil {
+					w.log.Error(ctx, "delayqueue promote", log.ErrorType("err", err))
+				}
+				break
+			}
+			if n < promoteBatch {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Worker) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := w.queue.reserve(ctx, time.Now().Add(w.cnf.VisibilityTimeout))
+		if err != nil && ctx.Err() == nil {
+			w.log.Error(ctx, "delayqueue reserve", log.ErrorType("err", err))
+		}
+		if job == nil {
+			sleep(ctx, w.cnf.PollInterval)
+			continue
+		}
+
+		w.process(job)
+	}
+}
+
+func (w *Worker) process(job *Job) {
+	ctx := hctx.GetContext(context.Background(), "")
+	fields := []log.Field{
+		log.String("id", job.ID),
+		log.Int("attempts", job.Attempts),
+	}
+
+	// 上一次执行超时未确认，次数已用尽
+	if job.Attempts > w.cnf.MaxAttempts {
+		w.fail(ctx, job, errVisibilityTimeout, fields)
+		return
+	}
+
+	start := time.Now()
+	err := w.safeHandle(ctx, *job)
+	fields = append(fields, log.Duration("time", time.Since(start)))
+	if err == nil {
+		ok, err := w.queue.ack(ctx, job)
+		if err != nil {
+			w.log.Error(ctx, "delayqueue ack", append(fields, log.ErrorType("err", err))...)
+		} else if !ok {
+			w.log.Warn(ctx, "delayqueue reservation lost", fields...)
+		}
+		return
+	}
+
+	if job.Attempts >= w.cnf.MaxAttempts {
+		w.fail(ctx, job, err, fields)
+		return
+	}
+
+	delay := w.backoff(job.Attempts)
+	w.log.Warn(ctx, "delayqueue retry", append(fields, log.Duration("delay", delay), log.ErrorType("err", err))...)
+	ok, err := w.queue.retry(ctx, job, time.Now().Add(delay))
+	if err != nil {
+		// 任务仍在处理中列表，可见性超时后会重新执行
+		w.log.Error(ctx, "delayqueue retry", append(fields, log.ErrorType("err", err))...)
+	} else if !ok {
+		w.log.Warn(ctx, "delayqueue reservation lost", fields...)
+	}
+}
+
+func (w *Worker) fail(ctx context.Context, job *Job, cause error, fields []log.Field) {
+	ok, err := w.queue.bury(ctx, job, cause)
+	if err != nil {
+		w.log.Error(ctx, "delayqueue bury", append(fields, log.ErrorType("err", err))...)
+		return
+	}
+	if !ok {
+		w.log.Warn(ctx, "delayqueue reservation lost", fields...)
+		return
+	}
+	w.log.Error(ctx, "delayqueue dead", append(fields, log.ErrorType("err", cause))...)
+}
+
+func (w *Worker) safeHandle(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("delayqueue: handler panic: %v", r)
+		}
+	}()
+	return w.handler(ctx, job)
+}
+
+// backoff 第 attempts 次失败后的等待时间
+func (w *Worker) backoff(attempts int) time.Duration {
+	d := w.cnf.MinBackoff
+	for i := 1; i < attempts && d < w.cnf.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > w.cnf.MaxBackoff {
+		d = w.cnf.MaxBackoff
+	}
+	return d
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
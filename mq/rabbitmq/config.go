@@ -58,6 +58,8 @@ var (
 	messageTTL  = int64(time.Hour / time.Millisecond)          // TTL for message in queue
 	queueExpire = int64(time.Hour * 24 * 7 / time.Millisecond) // expire time for unused queue
 
+	transientQueueExpire = int64(time.Minute / time.Millisecond) // expire time for unused transient queue
+
 	//errAck     = errors.New("ack")
 	errNack    = errors.New("nack")
 	errFull    = errors.New("full")
@@ -87,6 +89,10 @@ type Broker struct {
 	//一个exchange管理多个routingKey绑定到一个queue上, 要想创建多个queue 需要多次调用
 	//NewPublisher和NewConsumer
 	Topics []Topic `yaml:"topics"`
+
+	//Transient 为 true 时消费者的队列为非持久、独占、自动删除，连接断开后由 rabbitmq 删除
+	//用于每个实例各自一个、只在运行期间有意义的队列，如广播通知
+	Transient bool `yaml:"transient"`
 }
 
 // Topic config equal to exchang info
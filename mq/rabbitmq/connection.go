@@ -193,6 +193,11 @@ func (clt *RMQClient) Close() error {
 		clt.cancel()
 	})
 
+	// 生产者没有 MsgProcess，Done 为 nil
+	if clt.Done == nil {
+		return nil
+	}
+
 	// wait for MsgProcess() to exit
 	return <-clt.Done
 }
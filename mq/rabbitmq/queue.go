@@ -40,11 +40,17 @@ func (clt *RMQClient) queInit(server Broker, ifFresh bool) (err error) {
 	args := make(amqp.Table)
 	args["x-message-ttl"] = messageTTL
 	args["x-expires"] = queueExpire
+	durable, autoDelete, exclusive := true, false, false
+	if server.Transient {
+		//独占队列随连接删除，x-expires 兜底
+		durable, autoDelete, exclusive = false, true, true
+		args["x-expires"] = transientQueueExpire
+	}
 	q, err := ch.QueueDeclare(
 		server.QuePrefix+"."+clt.device, // name of the queue
-		true,                            // durable
-		false,                           // delete when usused
-		false,                           // exclusive
+		durable,                         // durable
+		autoDelete,                      // delete when usused
+		exclusive,                       // exclusive
 		false,                           // no-wait
 		args,                            // arguments
 	)
@@ -0,0 +1,352 @@
+package redisstream
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+	goRedis "github.com/go-redis/redis/v8"
+	guuid "github.com/google/uuid"
+)
+
+const (
+	defaultBatchSize     = 10
+	defaultBlock         = 2 * time.Second
+	defaultClaimInterval = 30 * time.Second
+	defaultClaimMinIdle  = time.Minute
+	defaultMaxDeliveries = 5
+	// 出错后重试读取前的等待时间
+	retryWait = time.Second
+)
+
+type ConsumerConfig struct {
+	Stream string `yaml:"stream"`
+	// 消费者组，不存在时自动创建，从 stream 的起始位置消费
+	Group string `yaml:"group"`
+	// 消费者名，默认为主机名加随机后缀
+	Consumer string `yaml:"consumer"`
+	// 并发处理的消息数，默认 1
+	Concurrency int `yaml:"concurrency"`
+	// 每次读取的消息数，默认 10
+	BatchSize int64 `yaml:"batchSize"`
+	// 没有消息时阻塞读取的时间，也是关闭时等待读取返回的最长时间，默认 2s
+	Block time.Duration `yaml:"block"`
+	// 认领超时未确认消息的间隔，默认 30s
+	ClaimInterval time.Duration `yaml:"claimInterval"`
+	// 消息未确认超过该时间后可以被认领，应大于处理一条消息的最长时间，默认 1m
+	ClaimMinIdle time.Duration `yaml:"claimMinIdle"`
+	// 投递次数超过该值的消息移入死信 stream，默认 5
+	MaxDeliveries int64 `yaml:"maxDeliveries"`
+	// 死信 stream，默认为 Stream + ":dead"
+	DeadLetterStream string `yaml:"deadLetterStream"`
+}
+
+// Message 收到的消息
+type Message struct {
+	ID     string
+	Stream string
+	Values map[string]interface{}
+	// 投递次数，第一次投递为 1
+	Deliveries int64
+}
+
+// Handler 处理消息，返回 nil 时确认消息，否则消息保留在待确认列表中，超过 ClaimMinIdle 后重新投递
+type Handler func(ctx context.Context, msg Message) error
+
+// Consumer 消费者组中的一个消费者
+type Consumer struct {
+	client  *db.Redis
+	cnf     ConsumerConfig
+	handler Handler
+	log     *log.Logger
+}
+
+func NewConsumer(client *db.Redis, cnf ConsumerConfig, handler Handler, logger *log.Logger) *Consumer {
+	if cnf.Consumer == "" {
+		host, _ := os.Hostname()
+		cnf.Consumer = host + "-" + guuid.New().String()[:8]
+	}
+	if cnf.Concurrency <= 0 {
+		cnf.Concurrency = 1
+	}
+	if cnf.BatchSize <= 0 {
+		cnf.BatchSize = defaultBatchSize
+	}
+	if cnf.Block <= 0 {
+		cnf.Block = defaultBlock
+	}
+	if cnf.ClaimInterval <= 0 {
+		cnf.ClaimInterval = defaultClaimInterval
+	}
+	if cnf.ClaimMinIdle <= 0 {
+		cnf.ClaimMinIdle = defaultClaimMinIdle
+	}
+	if cnf.MaxDeliveries <= 0 {
+		cnf.MaxDeliveries = defaultMaxDeliveries
+	}
+	if cnf.DeadLetterStream == "" {
+		cnf.DeadLetterStream = cnf.Stream + ":dead"
+	}
+
+	return &Consumer{client: client, cnf: cnf, handler: handler, log: logger}
+}
+
+// Run 消费消息直到 ctx 结束，之后等待正在处理的消息完成后返回
+// 处理消息时使用独立的 ctx，不会因为关闭而中断。
+func (c *Consumer) Run(ctx context.Context) error {
+	if err := c.createGroup(ctx); err != nil {
+		return err
+	}
+
+	jobs := make(chan Message)
+	var workers sync.WaitGroup
+	for i := 0; i < c.cnf.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for msg := range jobs {
+				c.process(msg)
+			}
+		}()
+	}
+
+	var loops sync.WaitGroup
+	loops.Add(2)
+	go func() {
+		defer loops.Done()
+		c.read(ctx, jobs)
+	}()
+	go func() {
+		defer loops.Done()
+		c.claim(ctx, jobs)
+	}()
+
+	loops.Wait()
+	close(jobs)
+	workers.Wait()
+
+	return nil
+}
+
+func (c *Consumer) createGroup(ctx context.Context) error {
+	err := c.client.XGroupCreateMkStream(ctx, c.cnf.Stream, c.cnf.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// read 读取新消息交给 worker
+func (c *Consumer) read(ctx context.Context, jobs chan<- Message) {
+	for ctx.Err() == nil {
+		streams, err := c.client.XReadGroup(ctx, &goRedis.XReadGroupArgs{
+			Group:    c.cnf.Group,
+			Consumer: c.cnf.Consumer,
+			Streams:  []string{c.cnf.Stream, ">"},
+			Count:    c.cnf.BatchSize,
+			Block:    c.cnf.Block,
+		}).Result()
+		if err == goRedis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.log.Error(ctx, "redis stream read", log.String("stream", c.cnf.Stream), log.ErrorType("err", err))
+			if err = c.createGroup(ctx); err != nil {
+				// 组可能随 stream 被删除，重新创建失败时等待后重试
+				sleep(ctx, retryWait)
+			}
+			continue
+		}
+
+		for _, s := range streams {
+			for _, m := range s.Messages {
+				if !dispatch(ctx, jobs, c.message(m, 1)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// claim 定期认领超时未确认的消息，投递次数过多的移入死信 stream
+func (c *Consumer) claim(ctx context.Context, jobs chan<- Message) {
+	ticker := time.NewTicker(c.cnf.ClaimInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := "0-0"
+		for {
+			msgs, next, err := c.autoClaim(ctx, start)
+			if err != nil {
+				if ctx.Err() == nil {
+					c.log.Error(ctx, "redis stream claim", log.String("stream", c.cnf.Stream), log.ErrorType("err", err))
+				}
+				break
+			}
+
+			for _, m := range msgs {
+				deliveries, err := c.deliveries(ctx, m.ID)
+				if err != nil {
+					c.log.Error(ctx, "redis stream pending", log.String("id", m.ID), log.ErrorType("err", err))
+					continue
+				}
+				msg := c.message(m, deliveries)
+				if deliveries > c.cnf.MaxDeliveries {
+					c.deadLetter(ctx, msg)
+					continue
+				}
+				if !dispatch(ctx, jobs, msg) {
+					return
+				}
+			}
+
+			if next == "0-0" || next == "" {
+				break
+			}
+			start = next
+		}
+	}
+}
+
+// autoClaim 执行 XAUTOCLAIM
+// go-redis 只能解析 redis 6.2 的两段响应，redis 7 增加了第三段（已删除的 ID），这里自行解析兼容两者。
+func (c *Consumer) autoClaim(ctx context.Context, start string) ([]goRedis.XMessage, string, error) {
+	res, err := c.client.Do(ctx, "xautoclaim", c.cnf.Stream, c.cnf.Group, c.cnf.Consumer,
+		c.cnf.ClaimMinIdle.Milliseconds(), start, "count", c.cnf.BatchSize).Slice()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(res) < 2 {
+		return nil, "", fmt.Errorf("redis stream: unexpected xautoclaim reply %v", res)
+	}
+
+	next, _ := res[0].(string)
+	entries, _ := res[1].([]interface{})
+	msgs := make([]goRedis.XMessage, 0, len(entries))
+	for _, e := range entries {
+		// redis 6.2 中已删除的消息为空
+		entry, ok := e.([]interface{})
+		if !ok || len(entry) != 2 {
+			continue
+		}
+		id, _ := entry[0].(string)
+		fields, _ := entry[1].([]interface{})
+		values := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			k, _ := fields[i].(string)
+			values[k] = fields[i+1]
+		}
+		msgs = append(msgs, goRedis.XMessage{ID: id, Values: values})
+	}
+
+	return msgs, next, nil
+}
+
+func (c *Consumer) deliveries(ctx context.Context, id string) (int64, error) {
+	pending, err := c.client.XPendingExt(ctx, &goRedis.XPendingExtArgs{
+		Stream: c.cnf.Stream,
+		Group:  c.cnf.Group,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(pending) == 0 {
+		// 已被其他消费者确认
+		return 0, fmt.Errorf("redis stream: message %s not pending", id)
+	}
+	return pending[0].RetryCount, nil
+}
+
+// deadLetter 写入死信 stream 后确认原消息，保留原消息 ID 和投递次数
+func (c *Consumer) deadLetter(ctx context.Context, msg Message) {
+	values := make(map[string]interface{}, len(msg.Values)+2)
+	for k, v := range msg.Values {
+		values[k] = v
+	}
+	values["origin_id"] = msg.ID
+	values["deliveries"] = msg.Deliveries
+
+	err := c.client.XAdd(ctx, &goRedis.XAddArgs{Stream: c.cnf.DeadLetterStream, Values: values}).Err()
+	if err == nil {
+		err = c.client.XAck(ctx, c.cnf.Stream, c.cnf.Group, msg.ID).Err()
+	}
+	if err != nil {
+		c.log.Error(ctx, "redis stream dead letter", log.String("id", msg.ID), log.ErrorType("err", err))
+		return
+	}
+	c.log.Warn(ctx, "redis stream dead letter",
+		log.String("stream", c.cnf.Stream),
+		log.String("id", msg.ID),
+		log.Int64("deliveries", msg.Deliveries),
+	)
+}
+
+func (c *Consumer) process(msg Message) {
+	ctx := hctx.GetContext(context.Background(), "")
+	start := time.Now()
+
+	err := c.safeHandle(ctx, msg)
+	if err != nil {
+		c.log.Error(ctx, "redis stream handle",
+			log.String("stream", msg.Stream),
+			log.String("id", msg.ID),
+			log.Int64("deliveries", msg.Deliveries),
+			log.Duration("time", time.Since(start)),
+			log.ErrorType("err", err),
+		)
+		return
+	}
+
+	if err = c.client.XAck(ctx, c.cnf.Stream, c.cnf.Group, msg.ID).Err(); err != nil {
+		c.log.Error(ctx, "redis stream ack", log.String("id", msg.ID), log.ErrorType("err", err))
+	}
+}
+
+func (c *Consumer) safeHandle(ctx context.Context, msg Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("redis stream: handler panic: %v", r)
+		}
+	}()
+	return c.handler(ctx, msg)
+}
+
+func (c *Consumer) message(m goRedis.XMessage, deliveries int64) Message {
+	return Message{ID: m.ID, Stream: c.cnf.Stream, Values: m.Values, Deliveries: deliveries}
+}
+
+// dispatch 交给 worker，ctx 结束时返回 false
+func dispatch(ctx context.Context, jobs chan<- Message, msg Message) bool {
+	select {
+	case jobs <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
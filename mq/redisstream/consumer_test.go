@@ -0,0 +1,98 @@
+package redisstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func newTestRedis(t *testing.T) *db.Redis {
+	mr := miniredis.RunT(t)
+	host, port, _ := net.SplitHostPort(mr.Addr())
+	p, _ := strconv.Atoi(port)
+	client, err := db.NewRedis(&db.RedisConfig{Host: host, Port: p, LogLevel: db.LogOff}, *log.Default())
+	assert.Nil(t, err)
+	return client
+}
+
+func TestProducer(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	client := newTestRedis(t)
+
+	p := NewProducer(client, "events", 5)
+	for i := 0; i < 20; i++ {
+		id, err := p.Publish(ctx, map[string]interface{}{"n": i})
+		assert.Nil(t, err)
+		assert.NotEmpty(t, id)
+	}
+	n, err := client.XLen(ctx, "events").Result()
+	assert.Nil(t, err)
+	assert.True(t, n < 20)
+}
+
+func TestConsumer(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	client := newTestRedis(t)
+	p := NewProducer(client, "events", 0)
+	for i := 0; i < 5; i++ {
+		_, err := p.Publish(ctx, map[string]interface{}{"n": i})
+		assert.Nil(t, err)
+	}
+
+	var mu sync.Mutex
+	handled := make(map[string]int64)
+	c := NewConsumer(client, ConsumerConfig{
+		Stream:        "events",
+		Group:         "workers",
+		Concurrency:   2,
+		Block:         20 * time.Millisecond,
+		ClaimInterval: 20 * time.Millisecond,
+		ClaimMinIdle:  10 * time.Millisecond,
+		MaxDeliveries: 2,
+	}, func(ctx context.Context, msg Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		n := msg.Values["n"].(string)
+		handled[n] = msg.Deliveries
+		if n == "3" {
+			return errors.New("bad message")
+		}
+		if n == "4" {
+			panic("handler panic")
+		}
+		return nil
+	}, log.Default())
+
+	runCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, c.Run(runCtx))
+
+	// 失败的消息重试到上限后移入死信
+	mu.Lock()
+	assert.Equal(t, 5, len(handled))
+	assert.Equal(t, int64(1), handled["0"])
+	assert.Equal(t, int64(2), handled["3"])
+	assert.Equal(t, int64(2), handled["4"])
+	mu.Unlock()
+
+	pending, err := client.XPending(ctx, "events", "workers").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), pending.Count)
+
+	dead, err := client.XRange(ctx, "events:dead", "-", "+").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(dead))
+	assert.Equal(t, "3", dead[0].Values["n"])
+	assert.Equal(t, "3", dead[0].Values["deliveries"])
+}
@@ -0,0 +1,36 @@
+// redisstream 包基于 redis stream 提供消息的生产和消费者组消费，适合内部事件等轻量场景
+package redisstream
+
+import (
+	"context"
+
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	goRedis "github.com/go-redis/redis/v8"
+)
+
+// Producer 向 stream 写入消息，按 MaxLen 近似裁剪
+type Producer struct {
+	client *db.Redis
+	stream string
+	maxLen int64
+}
+
+// NewProducer maxLen 为 stream 保留的大致消息数，0 表示不裁剪
+func NewProducer(client *db.Redis, stream string, maxLen int64) *Producer {
+	return &Producer{client: client, stream: stream, maxLen: maxLen}
+}
+
+// Publish 写入一条消息，返回消息 ID
+func (p *Producer) Publish(ctx context.Context, values map[string]interface{}) (string, error) {
+	args := &goRedis.XAddArgs{
+		Stream: p.stream,
+		Values: values,
+	}
+	if p.maxLen > 0 {
+		// 近似裁剪，由 redis 按宏节点删除，开销远小于精确裁剪
+		args.MaxLen = p.maxLen
+		args.Approx = true
+	}
+
+	return p.client.XAdd(ctx, args).Result()
+}
@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+// KeyFunc 从请求中取出限流的键，返回空字符串时不限流
+type KeyFunc func(r *http.Request) string
+
+// ByIP 按客户端 IP 限流，不解析 X-Forwarded-For
+func ByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ByHeader 按请求头限流，如用户 ID、API key
+func ByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// Middleware 超出配额时返回 429 并设置 Retry-After，拒绝以 Warn 级别记录
+// redis 出错时放行请求并记录 Error，避免限流故障影响业务。
+func Middleware(l Limiter, keyFunc KeyFunc, logger *log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := keyFunc(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+			res, err := Allow(ctx, l, key)
+			if err != nil {
+				logger.Error(ctx, "ratelimit", log.String("key", key), log.String("path", r.URL.Path), log.ErrorType("err", err))
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(res.Remaining, 10))
+			if !res.Allowed {
+				retryAfter := int(math.Ceil(res.RetryAfter.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				logger.Warn(ctx, "ratelimit denied",
+					log.String("key", key),
+					log.String("method", r.Method),
+					log.String("path", r.URL.Path),
+					log.Duration("retry_after", res.RetryAfter),
+				)
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,196 @@
+// ratelimit 包提供基于 redis 的分布式限流，多实例共享同一份配额
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	goRedis "github.com/go-redis/redis/v8"
+	guuid "github.com/google/uuid"
+)
+
+const defaultPrefix = "ratelimit:"
+
+var (
+	// ErrInvalidLimit Rate 或 Period 不大于 0
+	ErrInvalidLimit = errors.New("ratelimit: invalid limit")
+	// ErrExceedsLimit 一次请求的数量超过桶容量或窗口上限，永远不会被允许
+	ErrExceedsLimit = errors.New("ratelimit: n exceeds limit")
+)
+
+// Limit 每 Period 允许 Rate 次请求
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	// 令牌桶容量，即允许的突发请求数，默认等于 Rate，只用于令牌桶
+	Burst int
+}
+
+func PerSecond(rate int) Limit {
+	return Limit{Rate: rate, Period: time.Second}
+}
+
+func PerMinute(rate int) Limit {
+	return Limit{Rate: rate, Period: time.Minute}
+}
+
+func PerHour(rate int) Limit {
+	return Limit{Rate: rate, Period: time.Hour}
+}
+
+// Result 一次限流判断的结果
+type Result struct {
+	// 是否允许
+	Allowed bool
+	// 剩余配额
+	Remaining int64
+	// 被拒绝时，距离下次可能允许的等待时间
+	RetryAfter time.Duration
+}
+
+type Limiter interface {
+	// AllowN 判断 key 是否允许 n 次请求，允许时扣除配额
+	AllowN(ctx context.Context, key string, n int) (Result, error)
+}
+
+// Allow 判断 key 是否允许一次请求
+func Allow(ctx context.Context, l Limiter, key string) (Result, error) {
+	return l.AllowN(ctx, key, 1)
+}
+
+// 令牌桶：按速率补充令牌，容量为 burst；时间取 redis 的 TIME，避免各实例时钟不一致
+var tokenBucketScript = goRedis.NewScript(`
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed, retry = 0, 0
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+else
+	retry = math.ceil((n - tokens) / rate)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate))
+return {allowed, math.floor(tokens), retry}
+`)
+
+// 滑动窗口日志：有序集合记录窗口内每次请求的时间
+var slidingWindowScript = goRedis.NewScript(`
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+if count + n <= limit then
+	for i = 1, n do
+		redis.call("ZADD", KEYS[1], now, ARGV[4] .. ":" .. i)
+	end
+	redis.call("PEXPIRE", KEYS[1], window)
+	return {1, limit - count - n, 0}
+end
+
+-- 等到足够多的旧请求移出窗口
+local oldest = redis.call("ZRANGE", KEYS[1], count + n - limit - 1, count + n - limit - 1, "WITHSCORES")
+local retry = tonumber(oldest[2]) + window - now
+return {0, limit - count, math.max(retry, 1)}
+`)
+
+// TokenBucket 令牌桶，允许 Burst 次突发，之后按 Rate/Period 的速率恢复
+type TokenBucket struct {
+	client *db.Redis
+	prefix string
+	limit  Limit
+}
+
+// NewTokenBucket 键为 prefix + key，prefix 为空时使用 "ratelimit:"
+func NewTokenBucket(client *db.Redis, prefix string, limit Limit) (*TokenBucket, error) {
+	if limit.Rate <= 0 || limit.Period <= 0 {
+		return nil, ErrInvalidLimit
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = limit.Rate
+	}
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return &TokenBucket{client: client, prefix: prefix, limit: limit}, nil
+}
+
+func (b *TokenBucket) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	if n > b.limit.Burst {
+		return Result{}, ErrExceedsLimit
+	}
+
+	// 每毫秒补充的令牌数
+	perMs := float64(b.limit.Rate) * float64(time.Millisecond) / float64(b.limit.Period)
+	rate := strconv.FormatFloat(perMs, 'g', -1, 64)
+
+	return run(ctx, tokenBucketScript, b.client, b.prefix+key, n, rate, b.limit.Burst, n)
+}
+
+// SlidingWindow 滑动窗口日志，任意 Period 长度的窗口内最多 Rate 次请求
+// 每次请求在有序集合中占一个成员，适合 Rate 不太大的场景。
+type SlidingWindow struct {
+	client *db.Redis
+	prefix string
+	limit  Limit
+}
+
+// NewSlidingWindow 键为 prefix + key，prefix 为空时使用 "ratelimit:"
+func NewSlidingWindow(client *db.Redis, prefix string, limit Limit) (*SlidingWindow, error) {
+	if limit.Rate <= 0 || limit.Period < time.Millisecond {
+		return nil, ErrInvalidLimit
+	}
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return &SlidingWindow{client: client, prefix: prefix, limit: limit}, nil
+}
+
+func (w *SlidingWindow) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	if n > w.limit.Rate {
+		return Result{}, ErrExceedsLimit
+	}
+
+	return run(ctx, slidingWindowScript, w.client, w.prefix+key, n,
+		w.limit.Period.Milliseconds(), w.limit.Rate, n, guuid.New().String())
+}
+
+// run n <= 0 时不访问 redis 直接允许
+func run(ctx context.Context, script *goRedis.Script, client *db.Redis, key string, n int, args ...interface{}) (Result, error) {
+	if n <= 0 {
+		return Result{Allowed: true}, nil
+	}
+
+	res, err := script.Run(ctx, client, []string{key}, args...).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(res) != 3 {
+		return Result{}, errors.New("ratelimit: unexpected script result")
+	}
+
+	return Result{
+		Allowed:    res[0] == 1,
+		Remaining:  res[1],
+		RetryAfter: time.Duration(res[2]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+
+	hctx "git.zhwenxue.com/zhgo/gocontrib/context"
+	"git.zhwenxue.com/zhgo/gocontrib/db"
+	"git.zhwenxue.com/zhgo/gocontrib/log"
+)
+
+func newTestRedis(t *testing.T) (*db.Redis, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	host, port, _ := net.SplitHostPort(mr.Addr())
+	p, _ := strconv.Atoi(port)
+	client, err := db.NewRedis(&db.RedisConfig{Host: host, Port: p, LogLevel: db.LogOff}, *log.Default())
+	assert.Nil(t, err)
+	return client, mr
+}
+
+func TestTokenBucket(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	client, mr := newTestRedis(t)
+	now := time.Now()
+	mr.SetTime(now)
+
+	l, err := NewTokenBucket(client, "", Limit{Rate: 1, Period: time.Second, Burst: 3})
+	assert.Nil(t, err)
+	for i := 2; i >= 0; i-- {
+		res, err := Allow(ctx, l, "user:1")
+		assert.Nil(t, err)
+		assert.Equal(t, Result{Allowed: true, Remaining: int64(i)}, res)
+	}
+	res, err := Allow(ctx, l, "user:1")
+	assert.Nil(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+
+	// 其他键不受影响
+	res, _ = Allow(ctx, l, "user:2")
+	assert.True(t, res.Allowed)
+
+	// 按速率恢复
+	mr.SetTime(now.Add(1500 * time.Millisecond))
+	res, _ = Allow(ctx, l, "user:1")
+	assert.True(t, res.Allowed)
+	res, _ = Allow(ctx, l, "user:1")
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 500*time.Millisecond, res.RetryAfter)
+
+	_, err = l.AllowN(ctx, "user:1", 4)
+	assert.Equal(t, ErrExceedsLimit, err)
+	_, err = NewTokenBucket(client, "", Limit{})
+	assert.Equal(t, ErrInvalidLimit, err)
+}
+
+func TestSlidingWindow(t *testing.T) {
+	ctx := hctx.GetContext(context.Background(), "")
+	client, mr := newTestRedis(t)
+	now := time.Now()
+	mr.SetTime(now)
+
+	l, err := NewSlidingWindow(client, "api:", PerMinute(3))
+	assert.Nil(t, err)
+	res, err := l.AllowN(ctx, "user:1", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, Result{Allowed: true, Remaining: 1}, res)
+
+	mr.SetTime(now.Add(20 * time.Second))
+	res, _ = Allow(ctx, l, "user:1")
+	assert.Equal(t, Result{Allowed: true, Remaining: 0}, res)
+	res, _ = Allow(ctx, l, "user:1")
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 40*time.Second, res.RetryAfter)
+	assert.True(t, mr.Exists("api:user:1"))
+
+	// 最早的两次请求移出窗口
+	mr.SetTime(now.Add(61 * time.Second))
+	res, _ = l.AllowN(ctx, "user:1", 2)
+	assert.Equal(t, Result{Allowed: true, Remaining: 0}, res)
+}
+
+func TestMiddleware(t *testing.T) {
+	client, _ := newTestRedis(t)
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, log.InfoLevel)
+	l, _ := NewSlidingWindow(client, "", PerMinute(1))
+	h := Middleware(l, ByHeader("X-User"), logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/books", nil)
+		req = req.WithContext(hctx.GetContext(req.Context(), ""))
+		req.Header.Set("X-User", user)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, serve("42").Code)
+	rec := serve("42")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+	assert.True(t, strings.Contains(buf.String(), "ratelimit denied"))
+	// 没有键时不限流
+	assert.Equal(t, http.StatusOK, serve("").Code)
+	assert.Equal(t, http.StatusOK, serve("").Code)
+}